@@ -25,9 +25,141 @@ package config
 
 import (
 	"errors"
-	"reflect"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/models"
+)
+
+// Supported GlucoseRule comparisons
+const (
+	ComparisonGreater        = ">"
+	ComparisonGreaterOrEqual = ">="
+	ComparisonLess           = "<"
+	ComparisonLessOrEqual    = "<="
+	// ComparisonBetween matches values from Threshold (inclusive) up to UpperThreshold (exclusive)
+	ComparisonBetween = "between"
+)
+
+// Supported GlucoseRule actions
+const (
+	ActionActuate = "actuate"
+	ActionNotify  = "notify"
+	ActionNone    = "none"
+	// ActionSuspend immediately stops the insulin injector and blocks further actuation until glucose recovers
+	ActionSuspend = "suspend"
+	// ActionSkip skips dosing for the current reading only, it is only valid as a SuspendConfig PredictiveAction
+	ActionSkip = "skip"
+)
+
+// Supported insulin activity decay curves
+const (
+	DecayCurveLinear      = "linear"
+	DecayCurveExponential = "exponential"
+)
+
+// Supported injector delivery modes
+const (
+	// DeliveryModeDuration switches the injector on and back off once the dose has been delivered at the pump rate
+	DeliveryModeDuration = "duration"
+	// DeliveryModeDose sends the dose in units to the injector which meters it itself
+	DeliveryModeDose = "dose"
+)
+
+// Supported dose controllers
+const (
+	// ControllerCorrection doses the correction needed to bring glucose down to target less insulin on board
+	ControllerCorrection = "correction"
+	// ControllerPID doses the output of a PID controller on the glucose error, reduced by insulin feedback
+	ControllerPID = "pid"
+)
+
+// Supported glucose reading filters
+const (
+	FilterNone = "none"
+	// FilterMedian replaces each reading with the median of the last WindowSize readings
+	FilterMedian = "median"
+	// FilterKalman smooths readings with a one dimensional Kalman filter modelling glucose as a random walk
+	FilterKalman = "kalman"
+)
+
+// Bounds on glucose reading filtering, a longer window or more rejections would delay the response to real changes.
+const (
+	MaxFilterWindow     = 15
+	MaxRejectedReadings = 10
+)
+
+// Supported MQTT authentication modes, named as for the EdgeX MQTT export
+const (
+	MqttAuthNone = "none"
+	// MqttAuthUsernamePassword authenticates with the username and password secrets
+	MqttAuthUsernamePassword = "usernamepassword"
+	// MqttAuthClientCert authenticates with the clientcert and clientkey secrets
+	MqttAuthClientCert = "clientcert"
+	// MqttAuthCACert only verifies the broker, against the cacert secret
+	MqttAuthCACert = "cacert"
+)
+
+// Supported glucose units
+const (
+	UnitsMgDl  = "mg/dL"
+	UnitsMmolL = "mmol/L"
+)
+
+// GlucoseResource is the ResourceName of rules matching readings of the glucose resource configured for each device
+// profile in GlucoseResources
+const GlucoseResource = "Glucose"
+
+// MgDlPerMmolL converts glucose in mmol/L to mg/dL, from the molar mass of glucose
+const MgDlPerMmolL = 18.0182
+
+// NormalizeUnits returns the supported glucose units matching units regardless of case, mg/dL when units is empty.
+func NormalizeUnits(units string) (string, bool) {
+	switch strings.ToLower(strings.TrimSpace(units)) {
+	case "", strings.ToLower(UnitsMgDl):
+		return UnitsMgDl, true
+	case strings.ToLower(UnitsMmolL):
+		return UnitsMmolL, true
+	}
+	return "", false
+}
+
+// Safety bounds applied when validating GlucoseRules. Thresholds are in mg/dL.
+const (
+	// MinActuateThreshold is the lowest glucose level at which a rule may actuate the insulin injector.
+	MinActuateThreshold = 100
+	// MaxGlucoseThreshold is the highest glucose level a CGM reports, anything above is not a usable threshold.
+	MaxGlucoseThreshold = 600
+	// MinTargetGlucose and MaxTargetGlucose bound the glucose level correction doses may aim for.
+	MinTargetGlucose = 80
+	MaxTargetGlucose = 200
+	// MaxGlucoseAgeMinutes is the oldest a glucose reading may be to be considered current.
+	MaxGlucoseAgeMinutes = 30
+	// MaxMealCarbs is the most carbohydrate, in grams, a single announced meal may contain.
+	MaxMealCarbs = 250
+)
+
+// Bounds on injector command retries, which delay handling of further readings while an injector is unconfirmed.
+const (
+	MaxCommandAttempts    = 5
+	MaxRetryBackoffMillis = 10000
 )
 
+// MaxReconnectSeconds bounds the backoff between attempts to connect to the MQTT broker, glucose readings are missed
+// while disconnected.
+const MaxReconnectSeconds = 300
+
+// MaxLockoutMinutes bounds the lockout after an actuation, longer would withhold correction doses for too long.
+const MaxLockoutMinutes = 240
+
+// categoryPattern matches the characters EdgeX accepts in a notification category
+var categoryPattern = regexp.MustCompile(`^[A-Za-z0-9\-._~]+$`)
+
 // TODO: Define your structured custom configuration types. Must be wrapped with an outer struct with
 //
 //	single element that matches the top level custom configuration element in your configuration.yaml file,
@@ -41,15 +173,1025 @@ type ServiceConfig struct {
 // configuration.yaml file and Configuration Provider (aka Consul), if enabled.
 type AppCustomConfig struct {
 	ResourceNames string
-	SomeValue     int
-	SomeService   HostInfo
+	// GlucoseRules are the default glucose response bands evaluated against each glucose reading, keyed by band name.
+	GlucoseRules map[string]GlucoseRule
+	// GlucoseResources names the resource carrying glucose readings in each device profile, keyed by device profile
+	// name. Readings of it are matched against the rules for the Glucose resource instead of rules naming it.
+	GlucoseResources map[string]string
+	// Asset identifies the patient on the patient monitoring dashboard for glucose monitors without a patient profile.
+	Asset AssetConfig
+	// MqttMonitorDevice is a glucose monitor without a patient profile whose readings are published on the MQTT
+	// topics, alongside those of the patients' monitors.
+	MqttMonitorDevice string
+	// Patients holds the therapy profile of each patient, keyed by patient name. A profile overrides the defaults
+	// for readings from the patient's glucose monitor.
+	Patients map[string]PatientConfig
+	// Insulin configures how delivered insulin is dosed and tracked while it remains active.
+	Insulin InsulinConfig
+	// Injector configures how a calculated dose is delivered by the insulin injector.
+	Injector InjectorConfig
+	// Suspend configures low and predicted low glucose suspension of insulin delivery.
+	Suspend SuspendConfig
+	// Bolus configures the checks on manually requested doses.
+	Bolus BolusConfig
+	// Lockout configures how long after an actuation an injector may not be actuated again automatically.
+	Lockout LockoutConfig
+	// Controller selects and tunes the controller calculating automatic doses for patients without their own.
+	Controller ControllerConfig
+	// Filter configures the smoothing and outlier rejection applied to glucose readings before they are acted on.
+	Filter FilterConfig
+	// Liveness configures how long a glucose monitor may go without a reading before it is reported stale.
+	Liveness LivenessConfig
+	// DisplayUnits are the glucose units, mg/dL or mmol/L, used in alerts and reports for patients without their own,
+	// mg/dL when empty. Glucose is always evaluated in mg/dL.
+	DisplayUnits string
+	// Mqtt configures the connection to the MQTT broker and the topics glucose readings are subscribed to.
+	Mqtt MqttConfig
+}
+
+// MqttConfig configures the MQTT subscription to glucose readings. Changes are applied by reconnecting, or by
+// resubscribing when only the topics or QoS change.
+type MqttConfig struct {
+	// BrokerAddress is the URL of the broker, e.g. tcp://edgex-mqtt-broker:1883
+	BrokerAddress string
+	// ClientId identifies the subscriber to the broker, it must be set for a persistent session
+	ClientId string
+	// Topics is a comma separated list of topic filters, which may use the + and # wildcards
+	Topics string
+	// DeadLetterTopic is the topic malformed glucose messages are published to, with the reason they were rejected.
+	// Rejected messages are only logged when empty.
+	DeadLetterTopic string
+	// Qos is the quality of service, 0, 1 or 2, requested for each topic and used for dead letters
+	Qos          int
+	CleanSession bool
+	// KeepAliveSeconds is the interval at which the connection is checked when no messages are received
+	KeepAliveSeconds int
+	// MaxReconnectSeconds bounds the backoff between attempts to connect, which doubles after each failed attempt
+	MaxReconnectSeconds int
+	// AuthMode is 'none', 'usernamepassword', 'clientcert' or 'cacert', empty is 'none'
+	AuthMode string
+	// SecretName is the secret in the secret store holding the credentials for AuthMode, username and password or
+	// clientcert and clientkey, and the optional cacert the broker is verified against
+	SecretName string
+	// ServerName overrides the broker host name the broker's TLS certificate is verified against
+	ServerName string
+}
+
+// TLS reports whether the broker is connected to over TLS.
+func (mc MqttConfig) TLS() bool {
+	broker, err := url.Parse(mc.BrokerAddress)
+	if err != nil {
+		return false
+	}
+	switch broker.Scheme {
+	case "ssl", "tls", "mqtts", "wss":
+		return true
+	}
+	return false
+}
+
+// TopicList returns the topic filters listed in Topics.
+func (mc MqttConfig) TopicList() []string {
+	var topics []string
+	for _, topic := range strings.Split(mc.Topics, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+// Validate ensures the broker can be connected to and each topic filter is well formed.
+func (mc MqttConfig) Validate() error {
+	broker, err := url.Parse(mc.BrokerAddress)
+	if err != nil || broker.Host == "" {
+		return fmt.Errorf("BrokerAddress '%s' must be a URL such as tcp://host:1883", mc.BrokerAddress)
+	}
+	switch broker.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss":
+	default:
+		return fmt.Errorf("BrokerAddress scheme '%s' is not supported", broker.Scheme)
+	}
+
+	switch mc.AuthMode {
+	case "", MqttAuthNone:
+	case MqttAuthUsernamePassword, MqttAuthClientCert, MqttAuthCACert:
+		if mc.SecretName == "" {
+			return fmt.Errorf("SecretName must be set for AuthMode '%s'", mc.AuthMode)
+		}
+		// Credentials are never sent in plaintext
+		if !mc.TLS() {
+			return fmt.Errorf("AuthMode '%s' requires a TLS BrokerAddress, ssl, tls, mqtts or wss", mc.AuthMode)
+		}
+	default:
+		return fmt.Errorf("AuthMode '%s' is not supported", mc.AuthMode)
+	}
+
+	if mc.ServerName != "" && !mc.TLS() {
+		return errors.New("ServerName requires a TLS BrokerAddress, ssl, tls, mqtts or wss")
+	}
+
+	if !mc.CleanSession && mc.ClientId == "" {
+		return errors.New("ClientId must be set when CleanSession is false")
+	}
+
+	topics := mc.TopicList()
+	if len(topics) == 0 {
+		return errors.New("Topics must contain at least one topic")
+	}
+	for _, topic := range topics {
+		if err := validateTopicFilter(topic); err != nil {
+			return fmt.Errorf("Topics '%s' %s", topic, err.Error())
+		}
+	}
+
+	if mc.DeadLetterTopic != "" {
+		if strings.ContainsAny(mc.DeadLetterTopic, "+#") {
+			return fmt.Errorf("DeadLetterTopic '%s' must not use wildcards", mc.DeadLetterTopic)
+		}
+		// Dead letters must not be received as glucose messages again
+		for _, topic := range topics {
+			if topicMatches(topic, mc.DeadLetterTopic) {
+				return fmt.Errorf("DeadLetterTopic '%s' must not match Topics '%s'", mc.DeadLetterTopic, topic)
+			}
+		}
+	}
+
+	if mc.Qos < 0 || mc.Qos > 2 {
+		return errors.New("Qos must be 0, 1 or 2")
+	}
+
+	if mc.KeepAliveSeconds <= 0 || mc.KeepAliveSeconds > math.MaxUint16 {
+		return fmt.Errorf("KeepAliveSeconds must be between 1 and %d", math.MaxUint16)
+	}
+
+	if mc.MaxReconnectSeconds <= 0 || mc.MaxReconnectSeconds > MaxReconnectSeconds {
+		return fmt.Errorf("MaxReconnectSeconds must be between 1 and %d", MaxReconnectSeconds)
+	}
+
+	return nil
+}
+
+// validateTopicFilter ensures wildcards occupy a whole topic level, and the multi-level wildcard only the last.
+func validateTopicFilter(topic string) error {
+	levels := strings.Split(topic, "/")
+	for index, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || index != len(levels)-1) {
+			return errors.New("may only use the # wildcard as the last topic level")
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return errors.New("may only use the + wildcard as a whole topic level")
+		}
+	}
+	return nil
+}
+
+// topicMatches reports whether a topic is matched by a well formed topic filter.
+func topicMatches(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for index, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if index >= len(topicLevels) || (level != "+" && level != topicLevels[index]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// FilterConfig configures the filter applied to each monitor's glucose readings before they are acted on, and the
+// rejection of readings changing implausibly fast, e.g. a single spurious spike.
+type FilterConfig struct {
+	// Type is 'none', 'median' or 'kalman', empty is 'none'
+	Type string
+	// WindowSize is how many readings the 'median' filter takes the median of
+	WindowSize int
+	// ProcessNoise is the variance of the change in glucose per minute, in (mg/dL)^2, and MeasurementNoise the
+	// variance of the sensor noise, in (mg/dL)^2, used by the 'kalman' filter
+	ProcessNoise     float64
+	MeasurementNoise float64
+	// MaxRatePerMinute rejects readings that differ from the filtered glucose by more than this many mg/dL per
+	// minute since the last accepted reading, zero accepts every reading
+	MaxRatePerMinute float64
+	// MaxRejected is how many consecutive readings may be rejected before a reading is accepted as a real change
+	MaxRejected int
+}
+
+// Validate ensures the filter is supported and its parameters are usable.
+func (fc FilterConfig) Validate() error {
+	switch fc.Type {
+	case "", FilterNone:
+	case FilterMedian:
+		if fc.WindowSize < 3 || fc.WindowSize > MaxFilterWindow {
+			return fmt.Errorf("WindowSize must be between 3 and %d", MaxFilterWindow)
+		}
+	case FilterKalman:
+		if fc.ProcessNoise <= 0 || fc.MeasurementNoise <= 0 {
+			return errors.New("ProcessNoise and MeasurementNoise must be greater than zero")
+		}
+	default:
+		return fmt.Errorf("Type '%s' is not supported", fc.Type)
+	}
+
+	if fc.MaxRatePerMinute < 0 {
+		return errors.New("MaxRatePerMinute must not be negative")
+	}
+
+	if fc.MaxRatePerMinute > 0 && (fc.MaxRejected < 1 || fc.MaxRejected > MaxRejectedReadings) {
+		return fmt.Errorf("MaxRejected must be between 1 and %d", MaxRejectedReadings)
+	}
+
+	return nil
+}
+
+// ControllerConfig selects the controller calculating automatic doses and tunes the PID controller. Gains act on the
+// glucose error above target in mg/dL, with time in minutes, and their outputs are in units of insulin.
+type ControllerConfig struct {
+	// Type is either 'correction' or 'pid'. Empty selects 'correction' by default and the default controller for a
+	// patient.
+	Type string
+	// Kp, Ki and Kd are the proportional, integral and derivative gains
+	Kp float64
+	Ki float64
+	Kd float64
+	// IntegralLimit bounds the integral term, in units, so it cannot wind up during long highs
+	IntegralLimit float64
+	// InsulinFeedback is the fraction of insulin on board subtracted from the controller output, between 0 and 1
+	InsulinFeedback float64
+}
+
+// Validate ensures the controller is supported and its PID tuning is usable.
+func (cc ControllerConfig) Validate() error {
+	switch cc.Type {
+	case "", ControllerCorrection:
+		return nil
+	case ControllerPID:
+	default:
+		return fmt.Errorf("Type '%s' is not supported", cc.Type)
+	}
+
+	if cc.Kp < 0 || cc.Ki < 0 || cc.Kd < 0 || cc.Kp+cc.Ki+cc.Kd == 0 {
+		return errors.New("Kp, Ki and Kd must not be negative and at least one must be greater than zero")
+	}
+
+	if cc.IntegralLimit <= 0 {
+		return errors.New("IntegralLimit must be greater than zero")
+	}
+
+	if cc.InsulinFeedback < 0 || cc.InsulinFeedback > 1 {
+		return errors.New("InsulinFeedback must be between 0 and 1")
+	}
+
+	return nil
+}
+
+// LockoutConfig configures the refractory period after each actuation during which readings do not actuate the
+// injector again, giving the delivered insulin time to act.
+type LockoutConfig struct {
+	// Minutes is the lockout after an actuation for injectors not listed in Devices, zero for no lockout
+	Minutes int
+	// Devices overrides Minutes for individual injectors, keyed by injector device name
+	Devices map[string]int
+}
+
+// Validate ensures each lockout is within bounds.
+func (lc LockoutConfig) Validate() error {
+	if lc.Minutes < 0 || lc.Minutes > MaxLockoutMinutes {
+		return fmt.Errorf("Minutes must be between 0 and %d", MaxLockoutMinutes)
+	}
+
+	for _, name := range sortedNames(lc.Devices) {
+		if minutes := lc.Devices[name]; minutes < 0 || minutes > MaxLockoutMinutes {
+			return fmt.Errorf("Devices '%s' must be between 0 and %d minutes", name, MaxLockoutMinutes)
+		}
+	}
+
+	return nil
+}
+
+// Duration returns the lockout after an actuation by the named injector.
+func (lc LockoutConfig) Duration(deviceName string) time.Duration {
+	minutes, ok := lc.Devices[deviceName]
+	if !ok {
+		minutes = lc.Minutes
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// LivenessConfig configures the detection of glucose monitors that have stopped publishing readings. A monitor is
+// stale when its latest reading is older than its stale interval, an alert is raised and automatic doses are not
+// delivered on readings older than it.
+type LivenessConfig struct {
+	// StaleMinutes is the stale interval of monitors not listed in Devices, zero disables liveness tracking
+	StaleMinutes int
+	// Devices overrides StaleMinutes for individual monitors, keyed by monitor device name
+	Devices map[string]int
+}
+
+// Validate ensures each stale interval is no longer than a glucose reading is considered current.
+func (lc LivenessConfig) Validate() error {
+	if lc.StaleMinutes < 0 || lc.StaleMinutes > MaxGlucoseAgeMinutes {
+		return fmt.Errorf("StaleMinutes must be between 0 and %d", MaxGlucoseAgeMinutes)
+	}
+
+	for _, name := range sortedNames(lc.Devices) {
+		if minutes := lc.Devices[name]; minutes < 0 || minutes > MaxGlucoseAgeMinutes {
+			return fmt.Errorf("Devices '%s' must be between 0 and %d minutes", name, MaxGlucoseAgeMinutes)
+		}
+	}
+
+	return nil
+}
+
+// Interval returns the stale interval of the named monitor, zero when it is not tracked.
+func (lc LivenessConfig) Interval(deviceName string) time.Duration {
+	minutes, ok := lc.Devices[deviceName]
+	if !ok {
+		minutes = lc.StaleMinutes
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// BolusConfig configures the checks on manually requested doses, in addition to the insulin dose limits.
+type BolusConfig struct {
+	// MinGlucose is the lowest current glucose in mg/dL at which a manual dose may be delivered
+	MinGlucose float64
+	// MaxGlucoseAgeMinutes is how old the latest glucose reading may be to count as the current glucose
+	MaxGlucoseAgeMinutes int
+}
+
+// Validate ensures manual doses are only delivered with a recent glucose reading above a safe level.
+func (bc BolusConfig) Validate() error {
+	if bc.MinGlucose < MinTargetGlucose || bc.MinGlucose > MaxGlucoseThreshold {
+		return fmt.Errorf("MinGlucose must be between %d and %d %s", MinTargetGlucose, MaxGlucoseThreshold, UnitsMgDl)
+	}
+
+	if bc.MaxGlucoseAgeMinutes <= 0 || bc.MaxGlucoseAgeMinutes > MaxGlucoseAgeMinutes {
+		return fmt.Errorf("MaxGlucoseAgeMinutes must be greater than zero and no more than %d", MaxGlucoseAgeMinutes)
+	}
+
+	return nil
+}
+
+// SuspendConfig configures low glucose suspension of insulin delivery, including predictive suspension when the
+// glucose trend projects a low within PredictionMinutes.
+type SuspendConfig struct {
+	// ResumeGlucose is the glucose level in mg/dL a suspended injector must recover to before it may actuate again
+	ResumeGlucose float64
+	// PredictiveAction is taken when glucose is projected to fall below PredictiveFloor, either 'suspend',
+	// 'skip' to skip dosing for the current reading only, or 'none' to disable predictive suspension
+	PredictiveAction string
+	// PredictiveFloor is the glucose level in mg/dL the projection must stay above
+	PredictiveFloor float64
+	// PredictionMinutes is how far ahead glucose is projected
+	PredictionMinutes int
+	// TrendWindowMinutes is how far back readings are kept per device to calculate the rate of change
+	TrendWindowMinutes int
+	// MinTrendReadings is the fewest readings in the window needed to calculate the rate of change
+	MinTrendReadings int
+}
+
+// Validate ensures the suspend configuration resumes delivery above every band that suspends it.
+func (sc SuspendConfig) Validate(rules map[string]GlucoseRule) error {
+	if sc.ResumeGlucose <= 0 || sc.ResumeGlucose > MaxTargetGlucose {
+		return fmt.Errorf("ResumeGlucose must be greater than zero and no more than %d %s", MaxTargetGlucose, UnitsMgDl)
+	}
+
+	switch sc.PredictiveAction {
+	case ActionNone:
+	case ActionSuspend, ActionSkip:
+		if sc.PredictiveFloor <= 0 || sc.PredictiveFloor > sc.ResumeGlucose {
+			return errors.New("PredictiveFloor must be greater than zero and no more than ResumeGlucose")
+		}
+		if sc.PredictionMinutes <= 0 || sc.TrendWindowMinutes <= 0 {
+			return errors.New("PredictionMinutes and TrendWindowMinutes must be greater than zero")
+		}
+		if sc.MinTrendReadings < 2 {
+			return errors.New("MinTrendReadings must be at least 2")
+		}
+	default:
+		return fmt.Errorf("PredictiveAction '%s' is not supported", sc.PredictiveAction)
+	}
+
+	for _, name := range sortedNames(rules) {
+		rule := rules[name]
+		if rule.Action != ActionSuspend {
+			continue
+		}
+
+		if _, _, high, _ := rule.bounds(); high > sc.ResumeGlucose {
+			return fmt.Errorf("ResumeGlucose must be at or above the upper bound of suspend band '%s'", name)
+		}
+	}
+
+	return nil
+}
+
+// InjectorConfig describes how the insulin injector is commanded to deliver a dose.
+type InjectorConfig struct {
+	// DeviceName is the EdgeX device name of the insulin injector
+	DeviceName string
+	// DeliveryMode is either 'duration' to switch the injector on for as long as the dose takes at the pump rate,
+	// or 'dose' to send the dose in units using DoseCommand and DoseResource
+	DeliveryMode string
+	DoseCommand  string
+	DoseResource string
+	// PendingStopsFile is where stops scheduled for injectors are persisted so they survive a restart.
+	// Changes take effect on the next restart.
+	PendingStopsFile string
+	// CommandAttempts is how many times a command is sent before the injector is considered unresponsive. Each
+	// attempt is confirmed by reading back the injector state.
+	CommandAttempts int
+	// RetryBackoffMillis is the wait before the first retry, doubling for each further retry up to
+	// MaxRetryBackoffMillis
+	RetryBackoffMillis    int
+	MaxRetryBackoffMillis int
+}
+
+// Validate ensures the injector configuration can deliver a dose.
+func (ic InjectorConfig) Validate() error {
+	switch ic.DeliveryMode {
+	case DeliveryModeDuration:
+	case DeliveryModeDose:
+		if ic.DoseCommand == "" || ic.DoseResource == "" {
+			return errors.New("DoseCommand and DoseResource must be set for 'dose' DeliveryMode")
+		}
+	default:
+		return fmt.Errorf("DeliveryMode '%s' is not supported", ic.DeliveryMode)
+	}
+
+	if ic.PendingStopsFile == "" {
+		return errors.New("PendingStopsFile must be set")
+	}
+
+	if ic.CommandAttempts < 1 || ic.CommandAttempts > MaxCommandAttempts {
+		return fmt.Errorf("CommandAttempts must be between 1 and %d", MaxCommandAttempts)
+	}
+
+	if ic.RetryBackoffMillis <= 0 || ic.MaxRetryBackoffMillis < ic.RetryBackoffMillis || ic.MaxRetryBackoffMillis > MaxRetryBackoffMillis {
+		return fmt.Errorf("RetryBackoffMillis must be greater than zero and no more than MaxRetryBackoffMillis, which must be no more than %d", MaxRetryBackoffMillis)
+	}
+
+	if ic.DeviceName == "" {
+		return errors.New("DeviceName must be set")
+	}
+
+	return nil
+}
+
+// InsulinConfig describes the insulin delivered per actuation and how long it remains active (insulin on board).
+type InsulinConfig struct {
+	// ActionDurationMinutes is how long a dose keeps lowering glucose after delivery
+	ActionDurationMinutes int
+	// DecayCurve is the shape of the insulin activity curve, either 'linear' or 'exponential'
+	DecayCurve string
+	// PeakMinutes is when insulin activity peaks, only used by the 'exponential' curve
+	PeakMinutes int
+	// TargetGlucose is the glucose level in mg/dL correction doses aim for
+	TargetGlucose float64
+	// SensitivityFactor is the drop in glucose, in mg/dL, expected from one unit of insulin
+	SensitivityFactor float64
+	// CarbRatio is the grams of carbohydrate covered by one unit of insulin, zero disables meal doses
+	CarbRatio float64
+	// MinDoseUnits is the smallest dose the injector can deliver, smaller calculated doses are skipped
+	MinDoseUnits float64
+	// MaxDoseUnits is the largest single dose that may be delivered
+	MaxDoseUnits float64
+	// PumpRateUnitsPerMinute is the rate the injector delivers insulin while actuated
+	PumpRateUnitsPerMinute float64
+	// MaxOnBoardUnits is the most insulin allowed on board, new doses are reduced or suppressed to stay below it
+	MaxOnBoardUnits float64
+	// MaxHourlyUnits and MaxDailyUnits limit the total insulin delivered in the last hour and last 24 hours
+	MaxHourlyUnits float64
+	MaxDailyUnits  float64
+}
+
+// ActionDuration returns how long a dose remains active.
+func (ic InsulinConfig) ActionDuration() time.Duration {
+	return time.Duration(ic.ActionDurationMinutes) * time.Minute
 }
 
-// HostInfo is example struct for defining connection information for external service
-type HostInfo struct {
-	Host     string
-	Port     int
-	Protocol string
+// ActuationDuration returns how long the injector must be actuated to deliver the given units.
+func (ic InsulinConfig) ActuationDuration(units float64) time.Duration {
+	return time.Duration(units / ic.PumpRateUnitsPerMinute * float64(time.Minute))
+}
+
+// Validate ensures the insulin configuration describes a usable insulin model.
+func (ic InsulinConfig) Validate() error {
+	if ic.ActionDurationMinutes <= 0 {
+		return errors.New("ActionDurationMinutes must be greater than zero")
+	}
+
+	switch ic.DecayCurve {
+	case DecayCurveLinear:
+	case DecayCurveExponential:
+		if ic.PeakMinutes <= 0 || ic.PeakMinutes*2 >= ic.ActionDurationMinutes {
+			return errors.New("PeakMinutes must be greater than zero and less than half of ActionDurationMinutes")
+		}
+	default:
+		return fmt.Errorf("DecayCurve '%s' is not supported", ic.DecayCurve)
+	}
+
+	if ic.TargetGlucose < MinTargetGlucose || ic.TargetGlucose > MaxTargetGlucose {
+		return fmt.Errorf("TargetGlucose must be between %d and %d %s", MinTargetGlucose, MaxTargetGlucose, UnitsMgDl)
+	}
+
+	if ic.SensitivityFactor <= 0 {
+		return errors.New("SensitivityFactor must be greater than zero")
+	}
+
+	if ic.CarbRatio < 0 {
+		return errors.New("CarbRatio must not be negative")
+	}
+
+	if ic.MinDoseUnits < 0 || ic.MaxDoseUnits <= 0 || ic.MinDoseUnits > ic.MaxDoseUnits {
+		return errors.New("MaxDoseUnits must be greater than zero and no less than MinDoseUnits")
+	}
+
+	if ic.PumpRateUnitsPerMinute <= 0 {
+		return errors.New("PumpRateUnitsPerMinute must be greater than zero")
+	}
+
+	if ic.MaxOnBoardUnits <= 0 {
+		return errors.New("MaxOnBoardUnits must be greater than zero")
+	}
+
+	if ic.MaxHourlyUnits < ic.MaxDoseUnits || ic.MaxDailyUnits < ic.MaxHourlyUnits {
+		return errors.New("MaxHourlyUnits must be no less than MaxDoseUnits and no more than MaxDailyUnits")
+	}
+
+	return nil
+}
+
+// AssetConfig identifies a patient on the patient monitoring dashboard.
+type AssetConfig struct {
+	// Id is the dashboard asset id of the patient
+	Id int
+	// Name is the device name the dashboard shows the patient's data under
+	Name string
+}
+
+// Validate ensures the patient can be identified on the dashboard.
+func (ac AssetConfig) Validate() error {
+	if ac.Id <= 0 {
+		return errors.New("Id must be greater than zero")
+	}
+	if ac.Name == "" {
+		return errors.New("Name must be set")
+	}
+	return nil
+}
+
+// PatientConfig is the therapy profile of the patient wearing MonitorDevice: the injector delivering their insulin,
+// their identity on the dashboard, their glucose response bands, therapy settings and delivery limits, and who is
+// notified about them.
+type PatientConfig struct {
+	MonitorDevice string
+	// InjectorDevice is the injector delivering the patient's insulin. Each patient has an injector of their own, the
+	// default Injector DeviceName delivers to monitors without a profile.
+	InjectorDevice string
+	Asset          AssetConfig
+	// Recipients is a comma separated list of labels added to the patient's notifications, which support
+	// notifications subscriptions use to route them to the patient's care team
+	Recipients   string
+	GlucoseRules map[string]GlucoseRule
+	// TargetGlucose, SensitivityFactor, CarbRatio, MaxDoseUnits, MaxOnBoardUnits, MaxHourlyUnits and MaxDailyUnits
+	// override the Insulin settings for the patient, zero keeps the default
+	TargetGlucose     float64
+	SensitivityFactor float64
+	CarbRatio         float64
+	MaxDoseUnits      float64
+	MaxOnBoardUnits   float64
+	MaxHourlyUnits    float64
+	MaxDailyUnits     float64
+	// PumpRateUnitsPerMinute overrides the Insulin pump rate for the patient's injector, zero keeps the default
+	PumpRateUnitsPerMinute float64
+	// Schedule varies the patient's therapy settings and glucose response bands by time of day and weekday
+	Schedule Schedule
+	// Controller selects and tunes the controller calculating the patient's automatic doses, Controller when its
+	// Type is empty
+	Controller ControllerConfig
+	// DisplayUnits are the glucose units used in the patient's alerts and reports, DisplayUnits when empty
+	DisplayUnits string
+}
+
+// ApplyTo returns the insulin configuration with the patient's therapy settings and delivery limits applied.
+func (pc PatientConfig) ApplyTo(insulin InsulinConfig) InsulinConfig {
+	if pc.TargetGlucose > 0 {
+		insulin.TargetGlucose = pc.TargetGlucose
+	}
+	if pc.SensitivityFactor > 0 {
+		insulin.SensitivityFactor = pc.SensitivityFactor
+	}
+	if pc.CarbRatio > 0 {
+		insulin.CarbRatio = pc.CarbRatio
+	}
+	if pc.MaxDoseUnits > 0 {
+		insulin.MaxDoseUnits = pc.MaxDoseUnits
+	}
+	if pc.MaxOnBoardUnits > 0 {
+		insulin.MaxOnBoardUnits = pc.MaxOnBoardUnits
+	}
+	if pc.MaxHourlyUnits > 0 {
+		insulin.MaxHourlyUnits = pc.MaxHourlyUnits
+	}
+	if pc.MaxDailyUnits > 0 {
+		insulin.MaxDailyUnits = pc.MaxDailyUnits
+	}
+	if pc.PumpRateUnitsPerMinute > 0 {
+		insulin.PumpRateUnitsPerMinute = pc.PumpRateUnitsPerMinute
+	}
+	return insulin
+}
+
+// RecipientList returns the patient's notification recipients.
+func (pc PatientConfig) RecipientList() []string {
+	var recipients []string
+	for _, recipient := range strings.Split(pc.Recipients, ",") {
+		if recipient = strings.TrimSpace(recipient); recipient != "" {
+			recipients = append(recipients, recipient)
+		}
+	}
+	return recipients
+}
+
+// Validate ensures the patient's profile is complete and its therapy settings are within the bounds applied to
+// the defaults.
+func (pc PatientConfig) Validate(insulin InsulinConfig) error {
+	if pc.MonitorDevice == "" {
+		return errors.New("MonitorDevice is not set")
+	}
+
+	if err := pc.Asset.Validate(); err != nil {
+		return fmt.Errorf("Asset %s", err.Error())
+	}
+
+	if err := ValidateGlucoseRules(pc.GlucoseRules); err != nil {
+		return fmt.Errorf("GlucoseRules %s", err.Error())
+	}
+
+	if pc.TargetGlucose < 0 || pc.SensitivityFactor < 0 || pc.CarbRatio < 0 || pc.MaxDoseUnits < 0 || pc.MaxOnBoardUnits < 0 ||
+		pc.MaxHourlyUnits < 0 || pc.MaxDailyUnits < 0 || pc.PumpRateUnitsPerMinute < 0 {
+		return errors.New("therapy settings and delivery limits must not be negative")
+	}
+
+	insulin = pc.ApplyTo(insulin)
+	if err := insulin.Validate(); err != nil {
+		return err
+	}
+
+	if err := pc.Schedule.Validate(insulin); err != nil {
+		return fmt.Errorf("Schedule %s", err.Error())
+	}
+
+	if err := pc.Controller.Validate(); err != nil {
+		return fmt.Errorf("Controller %s", err.Error())
+	}
+
+	if _, ok := NormalizeUnits(pc.DisplayUnits); !ok {
+		return fmt.Errorf("DisplayUnits '%s' is not supported", pc.DisplayUnits)
+	}
+
+	return nil
+}
+
+// minutesPerDay and minutesPerWeek bound the minute of the week schedule segments are resolved against
+const (
+	minutesPerDay  = 24 * 60
+	minutesPerWeek = 7 * minutesPerDay
+)
+
+// ScheduleSegment overrides a patient's therapy settings and glucose response bands from Start to End, on Days.
+type ScheduleSegment struct {
+	// Days is a comma separated list of the weekdays the segment starts on, e.g. 'Mon, Tue' or 'Saturday', every
+	// day when empty
+	Days string
+	// Start and End are the local time of day, as 'HH:MM', the segment is active from (inclusive) and until
+	// (exclusive). An End at or before Start runs past midnight, an End equal to Start covers the whole day.
+	Start string
+	End   string
+	// TargetGlucose, SensitivityFactor and CarbRatio override the patient's settings during the segment, zero
+	// keeps them
+	TargetGlucose     float64
+	SensitivityFactor float64
+	CarbRatio         float64
+	// GlucoseRules replace the patient's glucose response bands during the segment, the patient's bands apply
+	// when empty
+	GlucoseRules map[string]GlucoseRule
+}
+
+// ApplyTo returns the insulin configuration with the segment's therapy settings applied.
+func (ss ScheduleSegment) ApplyTo(insulin InsulinConfig) InsulinConfig {
+	if ss.TargetGlucose > 0 {
+		insulin.TargetGlucose = ss.TargetGlucose
+	}
+	if ss.SensitivityFactor > 0 {
+		insulin.SensitivityFactor = ss.SensitivityFactor
+	}
+	if ss.CarbRatio > 0 {
+		insulin.CarbRatio = ss.CarbRatio
+	}
+	return insulin
+}
+
+// Active reports whether the segment is active at the given time, in the time's location.
+func (ss ScheduleSegment) Active(at time.Time) bool {
+	intervals, err := ss.intervals()
+	if err != nil {
+		return false
+	}
+
+	minute := int(at.Weekday())*minutesPerDay + at.Hour()*60 + at.Minute()
+	for _, interval := range intervals {
+		if interval[0] <= minute && minute < interval[1] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// intervals returns the minutes of the week, counted from Sunday midnight, the segment is active as [start, end)
+// pairs. A segment running past the end of Saturday is split so every interval lies within the week.
+func (ss ScheduleSegment) intervals() ([][2]int, error) {
+	start, err := minuteOfDay(ss.Start)
+	if err != nil {
+		return nil, fmt.Errorf("Start %s", err.Error())
+	}
+	end, err := minuteOfDay(ss.End)
+	if err != nil {
+		return nil, fmt.Errorf("End %s", err.Error())
+	}
+	if end <= start {
+		end += minutesPerDay
+	}
+
+	days, err := weekdays(ss.Days)
+	if err != nil {
+		return nil, err
+	}
+
+	var intervals [][2]int
+	for _, day := range days {
+		from := int(day)*minutesPerDay + start
+		until := int(day)*minutesPerDay + end
+		if until > minutesPerWeek {
+			intervals = append(intervals, [2]int{from, minutesPerWeek}, [2]int{0, until - minutesPerWeek})
+			continue
+		}
+		intervals = append(intervals, [2]int{from, until})
+	}
+
+	return intervals, nil
+}
+
+// Validate ensures the segment's times are valid and its therapy settings are within the bounds applied to the
+// defaults.
+func (ss ScheduleSegment) Validate(insulin InsulinConfig) error {
+	if _, err := ss.intervals(); err != nil {
+		return err
+	}
+
+	if ss.TargetGlucose < 0 || ss.SensitivityFactor < 0 || ss.CarbRatio < 0 {
+		return errors.New("TargetGlucose, SensitivityFactor and CarbRatio must not be negative")
+	}
+
+	if len(ss.GlucoseRules) > 0 {
+		if err := ValidateGlucoseRules(ss.GlucoseRules); err != nil {
+			return fmt.Errorf("GlucoseRules %s", err.Error())
+		}
+	}
+
+	return ss.ApplyTo(insulin).Validate()
+}
+
+// minuteOfDay parses an 'HH:MM' time of day.
+func minuteOfDay(value string) (int, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' must be a time of day as 'HH:MM'", value)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+// weekdays parses a comma separated list of weekday names or their three letter abbreviations, every day when empty.
+func weekdays(value string) ([]time.Weekday, error) {
+	if strings.TrimSpace(value) == "" {
+		return []time.Weekday{time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday}, nil
+	}
+
+	var days []time.Weekday
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		day := time.Weekday(-1)
+		for candidate := time.Sunday; candidate <= time.Saturday; candidate++ {
+			if strings.EqualFold(name, candidate.String()) || strings.EqualFold(name, candidate.String()[:3]) {
+				day = candidate
+			}
+		}
+		if day < 0 {
+			return nil, fmt.Errorf("Days '%s' is not a weekday", name)
+		}
+		days = append(days, day)
+	}
+
+	return days, nil
+}
+
+// Schedule holds the segments of a patient's therapy schedule, keyed by segment name. Segments must not overlap,
+// outside of every segment the patient's own settings apply.
+type Schedule map[string]ScheduleSegment
+
+// Active returns the name of the segment active at the given time, in the time's location.
+func (s Schedule) Active(at time.Time) (string, ScheduleSegment, bool) {
+	for _, name := range sortedNames(s) {
+		if segment := s[name]; segment.Active(at) {
+			return name, segment, true
+		}
+	}
+	return "", ScheduleSegment{}, false
+}
+
+// Validate ensures each segment is valid for the given insulin configuration and that no two segments overlap.
+func (s Schedule) Validate(insulin InsulinConfig) error {
+	names := sortedNames(s)
+	intervals := make(map[string][][2]int, len(s))
+	for _, name := range names {
+		if err := s[name].Validate(insulin); err != nil {
+			return fmt.Errorf("'%s' is invalid: %s", name, err.Error())
+		}
+		intervals[name], _ = s[name].intervals()
+	}
+
+	for i, name := range names {
+		for _, otherName := range names[i+1:] {
+			for _, interval := range intervals[name] {
+				for _, other := range intervals[otherName] {
+					if interval[0] < other[1] && other[0] < interval[1] {
+						return fmt.Errorf("'%s' and '%s' overlap", name, otherName)
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// GlucoseRule describes a glucose response band. It compares readings from ResourceName against Threshold
+// (and UpperThreshold for the 'between' comparison) and names the Action to take on a match along with
+// the Severity and Category of the notification sent for the band.
+type GlucoseRule struct {
+	ResourceName   string
+	Comparison     string
+	Threshold      float64
+	UpperThreshold float64
+	Units          string
+	Action         string
+	Severity       string
+	Category       string
+}
+
+// Matches reports whether value satisfies the rule's comparison against its threshold.
+func (r GlucoseRule) Matches(value float64) bool {
+	switch r.Comparison {
+	case ComparisonGreater:
+		return value > r.Threshold
+	case ComparisonGreaterOrEqual:
+		return value >= r.Threshold
+	case ComparisonLess:
+		return value < r.Threshold
+	case ComparisonLessOrEqual:
+		return value <= r.Threshold
+	case ComparisonBetween:
+		return value >= r.Threshold && value < r.UpperThreshold
+	default:
+		return false
+	}
+}
+
+// bounds returns the range of values matched by the rule and whether each end is inclusive.
+func (r GlucoseRule) bounds() (low float64, lowInclusive bool, high float64, highInclusive bool) {
+	switch r.Comparison {
+	case ComparisonGreater:
+		return r.Threshold, false, math.Inf(1), false
+	case ComparisonGreaterOrEqual:
+		return r.Threshold, true, math.Inf(1), false
+	case ComparisonLess:
+		return math.Inf(-1), false, r.Threshold, false
+	case ComparisonBetween:
+		return r.Threshold, true, r.UpperThreshold, false
+	default:
+		return math.Inf(-1), false, r.Threshold, true
+	}
+}
+
+// overlaps reports whether any value would be matched by both rules.
+func (r GlucoseRule) overlaps(other GlucoseRule) bool {
+	if r.ResourceName != other.ResourceName {
+		return false
+	}
+
+	low, lowInclusive, high, highInclusive := r.bounds()
+	otherLow, otherLowInclusive, otherHigh, otherHighInclusive := other.bounds()
+
+	// The intersection starts at the larger of the two lows and ends at the smaller of the two highs
+	if otherLow > low || (otherLow == low && !otherLowInclusive) {
+		low, lowInclusive = otherLow, otherLowInclusive
+	}
+	if otherHigh < high || (otherHigh == high && !otherHighInclusive) {
+		high, highInclusive = otherHigh, otherHighInclusive
+	}
+
+	return low < high || (low == high && lowInclusive && highInclusive)
+}
+
+// Validate ensures the rule is complete and safe to act on.
+func (r GlucoseRule) Validate() error {
+	if r.ResourceName == "" {
+		return errors.New("ResourceName is not set")
+	}
+
+	switch r.Comparison {
+	case ComparisonGreater, ComparisonGreaterOrEqual, ComparisonLess, ComparisonLessOrEqual:
+	case ComparisonBetween:
+		if r.UpperThreshold <= r.Threshold || r.UpperThreshold > MaxGlucoseThreshold {
+			return fmt.Errorf("UpperThreshold must be greater than Threshold and no more than %d %s", MaxGlucoseThreshold, UnitsMgDl)
+		}
+	default:
+		return fmt.Errorf("Comparison '%s' is not supported", r.Comparison)
+	}
+
+	if r.Units != UnitsMgDl {
+		return fmt.Errorf("Units '%s' is not supported", r.Units)
+	}
+
+	if r.Threshold <= 0 || r.Threshold > MaxGlucoseThreshold {
+		return fmt.Errorf("Threshold must be greater than zero and no more than %d %s", MaxGlucoseThreshold, UnitsMgDl)
+	}
+
+	switch r.Action {
+	case ActionActuate:
+		if r.Comparison == ComparisonLess || r.Comparison == ComparisonLessOrEqual {
+			return errors.New("actuate action is only allowed on rising thresholds ('>', '>=' or 'between')")
+		}
+		if r.Threshold < MinActuateThreshold {
+			return fmt.Errorf("actuate action Threshold must be at least %d %s", MinActuateThreshold, UnitsMgDl)
+		}
+	case ActionSuspend:
+		if r.Comparison == ComparisonGreater || r.Comparison == ComparisonGreaterOrEqual {
+			return errors.New("suspend action is only allowed on falling thresholds ('<', '<=' or 'between')")
+		}
+		if r.Severity != models.Critical {
+			return fmt.Errorf("suspend action Severity must be %s", models.Critical)
+		}
+	case ActionNotify, ActionNone:
+	default:
+		return fmt.Errorf("Action '%s' is not supported", r.Action)
+	}
+
+	if r.Action == ActionNone && r.Severity == "" && r.Category == "" {
+		return nil
+	}
+
+	switch r.Severity {
+	case models.Normal, models.Minor, models.Critical:
+	default:
+		return fmt.Errorf("Severity '%s' is not supported", r.Severity)
+	}
+
+	if !categoryPattern.MatchString(r.Category) {
+		return fmt.Errorf("Category '%s' must be non-empty and only contain letters, digits, '-', '.', '_' or '~'", r.Category)
+	}
+
+	return nil
+}
+
+// ValidateGlucoseRules ensures each rule is valid and that no two rules overlap.
+func ValidateGlucoseRules(rules map[string]GlucoseRule) error {
+	if len(rules) == 0 {
+		return errors.New("must contain at least one rule")
+	}
+
+	names := sortedNames(rules)
+	for _, name := range names {
+		if err := rules[name].Validate(); err != nil {
+			return fmt.Errorf("'%s' is invalid: %s", name, err.Error())
+		}
+	}
+
+	for i, name := range names {
+		rule := rules[name]
+		for _, otherName := range names[i+1:] {
+			if rule.overlaps(rules[otherName]) {
+				return fmt.Errorf("'%s' and '%s' overlap for resource '%s'", name, otherName, rule.ResourceName)
+			}
+		}
+	}
+
+	return nil
 }
 
 // TODO: Update using your Custom configuration type.
@@ -67,15 +1209,112 @@ func (c *ServiceConfig) UpdateFromRaw(rawConfig interface{}) bool {
 }
 
 // Validate ensures your custom configuration has proper values.
-// TODO: Update to properly validate your custom configuration
 func (ac *AppCustomConfig) Validate() error {
-	if ac.SomeValue <= 0 {
-		return errors.New("SomeValue must be greater than zero")
+	if err := ValidateGlucoseRules(ac.GlucoseRules); err != nil {
+		return fmt.Errorf("GlucoseRules %s", err.Error())
 	}
 
-	if reflect.DeepEqual(ac.SomeService, HostInfo{}) {
-		return errors.New("SomeService is not set")
+	if err := ac.Insulin.Validate(); err != nil {
+		return fmt.Errorf("Insulin %s", err.Error())
+	}
+
+	if err := ac.Asset.Validate(); err != nil {
+		return fmt.Errorf("Asset %s", err.Error())
+	}
+
+	if ac.MqttMonitorDevice == "" {
+		return errors.New("MqttMonitorDevice must be set")
+	}
+
+	if _, ok := NormalizeUnits(ac.DisplayUnits); !ok {
+		return fmt.Errorf("DisplayUnits '%s' is not supported", ac.DisplayUnits)
+	}
+
+	for _, profile := range sortedNames(ac.GlucoseResources) {
+		if strings.TrimSpace(ac.GlucoseResources[profile]) == "" {
+			return fmt.Errorf("GlucoseResources '%s' must name a resource", profile)
+		}
+	}
+
+	monitors := make(map[string]string, len(ac.Patients))
+	injectors := make(map[string]string, len(ac.Patients))
+	for _, name := range sortedNames(ac.Patients) {
+		patient := ac.Patients[name]
+		if err := patient.Validate(ac.Insulin); err != nil {
+			return fmt.Errorf("Patients '%s' %s", name, err.Error())
+		}
+
+		if other, exists := monitors[patient.MonitorDevice]; exists {
+			return fmt.Errorf("Patients '%s' and '%s' use the same MonitorDevice '%s'", name, other, patient.MonitorDevice)
+		}
+		monitors[patient.MonitorDevice] = name
+
+		// An injector delivers to a single patient, the default injector delivers to monitors without a profile
+		if patient.InjectorDevice == "" {
+			return fmt.Errorf("Patients '%s' InjectorDevice must be set", name)
+		}
+		if patient.InjectorDevice == ac.Injector.DeviceName {
+			return fmt.Errorf("Patients '%s' InjectorDevice '%s' is the default Injector DeviceName", name,
+				patient.InjectorDevice)
+		}
+		if other, exists := injectors[patient.InjectorDevice]; exists {
+			return fmt.Errorf("Patients '%s' and '%s' use the same InjectorDevice '%s'", name, other, patient.InjectorDevice)
+		}
+		injectors[patient.InjectorDevice] = name
+	}
+
+	if err := ac.Suspend.Validate(ac.GlucoseRules); err != nil {
+		return fmt.Errorf("Suspend %s", err.Error())
+	}
+	for _, name := range sortedNames(ac.Patients) {
+		patient := ac.Patients[name]
+		if err := ac.Suspend.Validate(patient.GlucoseRules); err != nil {
+			return fmt.Errorf("Suspend for Patients '%s' %s", name, err.Error())
+		}
+		for _, segment := range sortedNames(patient.Schedule) {
+			if err := ac.Suspend.Validate(patient.Schedule[segment].GlucoseRules); err != nil {
+				return fmt.Errorf("Suspend for Patients '%s' Schedule '%s' %s", name, segment, err.Error())
+			}
+		}
+	}
+
+	if err := ac.Injector.Validate(); err != nil {
+		return fmt.Errorf("Injector %s", err.Error())
+	}
+
+	if err := ac.Bolus.Validate(); err != nil {
+		return fmt.Errorf("Bolus %s", err.Error())
+	}
+
+	if err := ac.Lockout.Validate(); err != nil {
+		return fmt.Errorf("Lockout %s", err.Error())
+	}
+
+	if err := ac.Controller.Validate(); err != nil {
+		return fmt.Errorf("Controller %s", err.Error())
+	}
+
+	if err := ac.Filter.Validate(); err != nil {
+		return fmt.Errorf("Filter %s", err.Error())
+	}
+
+	if err := ac.Liveness.Validate(); err != nil {
+		return fmt.Errorf("Liveness %s", err.Error())
+	}
+
+	if err := ac.Mqtt.Validate(); err != nil {
+		return fmt.Errorf("Mqtt %s", err.Error())
 	}
 
 	return nil
 }
+
+// sortedNames returns the keys of a named configuration map in a stable order.
+func sortedNames[T any](items map[string]T) []string {
+	names := make([]string, 0, len(items))
+	for name := range items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
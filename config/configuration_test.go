@@ -0,0 +1,621 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppCustomConfig_Validate(t *testing.T) {
+	high := GlucoseRule{ResourceName: "Uint16", Comparison: ComparisonGreater, Threshold: 120, Units: UnitsMgDl, Action: ActionActuate, Severity: "CRITICAL", Category: "HYPERGLYCEMIA"}
+	low := GlucoseRule{ResourceName: "Uint16", Comparison: ComparisonLess, Threshold: 70, Units: UnitsMgDl, Action: ActionNotify, Severity: "CRITICAL", Category: "HYPOGLYCEMIA"}
+	normal := GlucoseRule{ResourceName: "Uint16", Comparison: ComparisonBetween, Threshold: 70, UpperThreshold: 120, Units: UnitsMgDl, Action: ActionNone}
+
+	withRule := func(rule GlucoseRule, change func(*GlucoseRule)) GlucoseRule {
+		change(&rule)
+		return rule
+	}
+
+	tests := []struct {
+		Name          string
+		Rules         map[string]GlucoseRule
+		ExpectedError string
+	}{
+		{"Valid", map[string]GlucoseRule{"high": high, "low": low}, ""},
+		{"Valid bands", map[string]GlucoseRule{"high": high, "normal": normal, "low": low}, ""},
+		{"Valid suspend", map[string]GlucoseRule{"high": high, "low": withRule(low, func(r *GlucoseRule) { r.Action = ActionSuspend })}, ""},
+		{"Adjacent rules", map[string]GlucoseRule{"high": high, "low": withRule(low, func(r *GlucoseRule) { r.Comparison = ComparisonLessOrEqual; r.Threshold = 120 })}, ""},
+		{"Different resources", map[string]GlucoseRule{"high": high, "other": withRule(high, func(r *GlucoseRule) { r.ResourceName = "Float32" })}, ""},
+		{"No rules", nil, "at least one rule"},
+		{"Missing resource", map[string]GlucoseRule{"high": withRule(high, func(r *GlucoseRule) { r.ResourceName = "" })}, "ResourceName is not set"},
+		{"Bad comparison", map[string]GlucoseRule{"high": withRule(high, func(r *GlucoseRule) { r.Comparison = "==" })}, "Comparison '==' is not supported"},
+		{"Bad units", map[string]GlucoseRule{"high": withRule(high, func(r *GlucoseRule) { r.Units = "g/L" })}, "Units 'g/L' is not supported"},
+		{"Bad action", map[string]GlucoseRule{"high": withRule(high, func(r *GlucoseRule) { r.Action = "inject" })}, "Action 'inject' is not supported"},
+		{"Threshold out of range", map[string]GlucoseRule{"high": withRule(high, func(r *GlucoseRule) { r.Threshold = 900 })}, "Threshold must be"},
+		{"Actuate on falling glucose", map[string]GlucoseRule{"high": withRule(high, func(r *GlucoseRule) { r.Comparison = ComparisonLess })}, "only allowed on rising thresholds"},
+		{"Actuate below safe threshold", map[string]GlucoseRule{"high": withRule(high, func(r *GlucoseRule) { r.Threshold = 90 })}, "must be at least"},
+		{"Overlapping rules", map[string]GlucoseRule{"high": high, "higher": withRule(high, func(r *GlucoseRule) { r.Threshold = 200 })}, "'high' and 'higher' overlap"},
+		{"Bad upper threshold", map[string]GlucoseRule{"normal": withRule(normal, func(r *GlucoseRule) { r.UpperThreshold = 60 })}, "UpperThreshold must be greater"},
+		{"Overlapping band", map[string]GlucoseRule{"high": high, "normal": withRule(normal, func(r *GlucoseRule) { r.UpperThreshold = 130 })}, "'high' and 'normal' overlap"},
+		{"Bad severity", map[string]GlucoseRule{"high": withRule(high, func(r *GlucoseRule) { r.Severity = "URGENT" })}, "Severity 'URGENT' is not supported"},
+		{"Bad category", map[string]GlucoseRule{"high": withRule(high, func(r *GlucoseRule) { r.Category = "high glucose" })}, "Category 'high glucose' must be"},
+		{"Suspend on rising glucose", map[string]GlucoseRule{"low": withRule(low, func(r *GlucoseRule) { r.Action = ActionSuspend; r.Comparison = ComparisonGreater })}, "only allowed on falling thresholds"},
+		{"Suspend not critical", map[string]GlucoseRule{"low": withRule(low, func(r *GlucoseRule) { r.Action = ActionSuspend; r.Severity = "MINOR" })}, "Severity must be CRITICAL"},
+		{"Suspend above resume", map[string]GlucoseRule{"low": withRule(low, func(r *GlucoseRule) { r.Action = ActionSuspend; r.Threshold = 95 })}, "ResumeGlucose must be at or above the upper bound of suspend band 'low'"},
+		{"Overlapping at threshold", map[string]GlucoseRule{"high": withRule(high, func(r *GlucoseRule) { r.Comparison = ComparisonGreaterOrEqual }), "low": withRule(low, func(r *GlucoseRule) { r.Comparison = ComparisonLessOrEqual; r.Threshold = 120 })}, "'high' and 'low' overlap"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			target := AppCustomConfig{GlucoseRules: test.Rules, Insulin: validInsulinConfig(), Asset: AssetConfig{Id: 34, Name: "Patient_Monitor_19524"}, MqttMonitorDevice: "Patient_Monitor_19524", Injector: InjectorConfig{DeliveryMode: DeliveryModeDuration, DeviceName: "insulin-injector", PendingStopsFile: "stops.json", CommandAttempts: 3, RetryBackoffMillis: 100, MaxRetryBackoffMillis: 1000}, Suspend: SuspendConfig{ResumeGlucose: 90, PredictiveAction: ActionNone}, Bolus: BolusConfig{MinGlucose: 120, MaxGlucoseAgeMinutes: 15}, Mqtt: validMqttConfig()}
+			err := target.Validate()
+			if test.ExpectedError == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.ExpectedError)
+		})
+	}
+}
+
+func TestAppCustomConfig_Validate_Patients(t *testing.T) {
+	rules := map[string]GlucoseRule{
+		"high": {ResourceName: "Uint16", Comparison: ComparisonGreater, Threshold: 120, Units: UnitsMgDl, Action: ActionActuate, Severity: "CRITICAL", Category: "HYPERGLYCEMIA"},
+	}
+
+	patient := func(monitor string, change func(*PatientConfig)) PatientConfig {
+		patient := PatientConfig{MonitorDevice: monitor, InjectorDevice: "injector-" + monitor, Asset: AssetConfig{Id: 35, Name: "Patient_Monitor_" + monitor}, GlucoseRules: rules}
+		if change != nil {
+			change(&patient)
+		}
+		return patient
+	}
+
+	tests := []struct {
+		Name          string
+		Patients      map[string]PatientConfig
+		ExpectedError string
+	}{
+		{"Valid", map[string]PatientConfig{"p1": patient("monitor-1", nil), "p2": patient("monitor-2", nil)}, ""},
+		{"Missing monitor", map[string]PatientConfig{"p1": patient("", nil)}, "Patients 'p1' MonitorDevice is not set"},
+		{"Shared monitor", map[string]PatientConfig{"p1": patient("monitor-1", nil), "p2": patient("monitor-1", nil)}, "'p2' and 'p1' use the same MonitorDevice"},
+		{"Missing rules", map[string]PatientConfig{"p1": patient("monitor-1", func(p *PatientConfig) { p.GlucoseRules = nil })}, "Patients 'p1' GlucoseRules must contain at least one rule"},
+		{"Missing asset", map[string]PatientConfig{"p1": patient("monitor-1", func(p *PatientConfig) { p.Asset = AssetConfig{} })}, "Patients 'p1' Asset Id must be greater than zero"},
+		{"Valid injectors", map[string]PatientConfig{
+			"p1": patient("monitor-1", func(p *PatientConfig) { p.InjectorDevice = "injector-1" }),
+			"p2": patient("monitor-2", func(p *PatientConfig) { p.InjectorDevice = "injector-2" }),
+			"p3": patient("monitor-3", nil),
+		}, ""},
+		{"Shared injector", map[string]PatientConfig{
+			"p1": patient("monitor-1", func(p *PatientConfig) { p.InjectorDevice = "injector-1" }),
+			"p2": patient("monitor-2", func(p *PatientConfig) { p.InjectorDevice = "injector-1" }),
+		}, "'p2' and 'p1' use the same InjectorDevice 'injector-1'"},
+		{"Missing injector", map[string]PatientConfig{"p1": patient("monitor-1", func(p *PatientConfig) { p.InjectorDevice = "" })}, "Patients 'p1' InjectorDevice must be set"},
+		{"Default injector", map[string]PatientConfig{"p1": patient("monitor-1", func(p *PatientConfig) { p.InjectorDevice = "insulin-injector" })}, "Patients 'p1' InjectorDevice 'insulin-injector' is the default Injector DeviceName"},
+		{"Valid therapy", map[string]PatientConfig{"p1": patient("monitor-1", func(p *PatientConfig) {
+			p.TargetGlucose = 120
+			p.SensitivityFactor = 40
+			p.MaxDoseUnits = 1
+			p.MaxOnBoardUnits = 2
+			p.MaxHourlyUnits = 2
+			p.MaxDailyUnits = 10
+		})}, ""},
+		{"Negative limit", map[string]PatientConfig{"p1": patient("monitor-1", func(p *PatientConfig) { p.MaxHourlyUnits = -1 })}, "Patients 'p1' therapy settings and delivery limits must not be negative"},
+		{"Negative pump rate", map[string]PatientConfig{"p1": patient("monitor-1", func(p *PatientConfig) { p.PumpRateUnitsPerMinute = -1 })}, "Patients 'p1' therapy settings and delivery limits must not be negative"},
+		{"Target out of range", map[string]PatientConfig{"p1": patient("monitor-1", func(p *PatientConfig) { p.TargetGlucose = 250 })}, "Patients 'p1' TargetGlucose must be between"},
+		{"Hourly above default daily", map[string]PatientConfig{"p1": patient("monitor-1", func(p *PatientConfig) { p.MaxHourlyUnits = 25 })}, "Patients 'p1' MaxHourlyUnits must be no less than MaxDoseUnits and no more than MaxDailyUnits"},
+		{"Valid schedule", map[string]PatientConfig{"p1": patient("monitor-1", func(p *PatientConfig) {
+			p.Schedule = Schedule{
+				"night":   {Start: "22:00", End: "06:00", TargetGlucose: 140, GlucoseRules: map[string]GlucoseRule{"high": {ResourceName: "Uint16", Comparison: ComparisonGreater, Threshold: 180, Units: UnitsMgDl, Action: ActionActuate, Severity: "CRITICAL", Category: "HYPERGLYCEMIA"}}},
+				"weekday": {Days: "Mon,Tue,Wed,Thu,Fri", Start: "06:00", End: "22:00", SensitivityFactor: 40},
+			}
+		})}, ""},
+		{"Invalid controller", map[string]PatientConfig{"p1": patient("monitor-1", func(p *PatientConfig) {
+			p.Controller = ControllerConfig{Type: ControllerPID, Kp: 0.01}
+		})}, "Patients 'p1' Controller IntegralLimit must be greater than zero"},
+		{"Overlapping segments", map[string]PatientConfig{"p1": patient("monitor-1", func(p *PatientConfig) {
+			p.Schedule = Schedule{"night": {Start: "22:00", End: "06:00"}, "morning": {Days: "Sat", Start: "05:00", End: "09:00"}}
+		})}, "Patients 'p1' Schedule 'morning' and 'night' overlap"},
+		{"Bad segment time", map[string]PatientConfig{"p1": patient("monitor-1", func(p *PatientConfig) {
+			p.Schedule = Schedule{"night": {Start: "10pm", End: "06:00"}}
+		})}, "Patients 'p1' Schedule 'night' is invalid: Start '10pm' must be a time of day as 'HH:MM'"},
+		{"Bad segment day", map[string]PatientConfig{"p1": patient("monitor-1", func(p *PatientConfig) {
+			p.Schedule = Schedule{"weekend": {Days: "Sat,Sundy", Start: "00:00", End: "00:00"}}
+		})}, "Patients 'p1' Schedule 'weekend' is invalid: Days 'Sundy' is not a weekday"},
+		{"Segment target out of range", map[string]PatientConfig{"p1": patient("monitor-1", func(p *PatientConfig) {
+			p.Schedule = Schedule{"night": {Start: "22:00", End: "06:00", TargetGlucose: 250}}
+		})}, "Patients 'p1' Schedule 'night' is invalid: TargetGlucose must be between"},
+		{"Segment suspend above resume", map[string]PatientConfig{"p1": patient("monitor-1", func(p *PatientConfig) {
+			p.Schedule = Schedule{"night": {Start: "22:00", End: "06:00", GlucoseRules: map[string]GlucoseRule{"low": {ResourceName: "Uint16", Comparison: ComparisonLess, Threshold: 100, Units: UnitsMgDl, Action: ActionSuspend, Severity: "CRITICAL", Category: "HYPOGLYCEMIA"}}}}
+		})}, "Suspend for Patients 'p1' Schedule 'night' ResumeGlucose must be at or above the upper bound of suspend band 'low'"},
+		{"Valid display units", map[string]PatientConfig{"p1": patient("monitor-1", func(p *PatientConfig) { p.DisplayUnits = "mmol/l" })}, ""},
+		{"Bad display units", map[string]PatientConfig{"p1": patient("monitor-1", func(p *PatientConfig) { p.DisplayUnits = "mmol" })}, "Patients 'p1' DisplayUnits 'mmol' is not supported"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			target := AppCustomConfig{GlucoseRules: rules, Patients: test.Patients, Insulin: validInsulinConfig(), Asset: AssetConfig{Id: 34, Name: "Patient_Monitor_19524"}, MqttMonitorDevice: "Patient_Monitor_19524", Injector: InjectorConfig{DeliveryMode: DeliveryModeDuration, DeviceName: "insulin-injector", PendingStopsFile: "stops.json", CommandAttempts: 3, RetryBackoffMillis: 100, MaxRetryBackoffMillis: 1000}, Suspend: SuspendConfig{ResumeGlucose: 90, PredictiveAction: ActionNone}, Bolus: BolusConfig{MinGlucose: 120, MaxGlucoseAgeMinutes: 15}, Mqtt: validMqttConfig()}
+			err := target.Validate()
+			if test.ExpectedError == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.ExpectedError)
+		})
+	}
+}
+
+func TestNormalizeUnits(t *testing.T) {
+	tests := []struct {
+		Units    string
+		Expected string
+		OK       bool
+	}{
+		{"", UnitsMgDl, true},
+		{"mg/dL", UnitsMgDl, true},
+		{"MG/DL", UnitsMgDl, true},
+		{"mmol/L", UnitsMmolL, true},
+		{" mmol/l ", UnitsMmolL, true},
+		{"g/L", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Units, func(t *testing.T) {
+			actual, ok := NormalizeUnits(test.Units)
+			assert.Equal(t, test.OK, ok)
+			assert.Equal(t, test.Expected, actual)
+		})
+	}
+}
+
+func TestPatientConfig_ApplyTo(t *testing.T) {
+	insulin := validInsulinConfig()
+
+	assert.Equal(t, insulin, PatientConfig{}.ApplyTo(insulin))
+
+	expected := insulin
+	expected.TargetGlucose = 120
+	expected.SensitivityFactor = 40
+	expected.MaxDailyUnits = 10
+	expected.PumpRateUnitsPerMinute = 0.5
+	assert.Equal(t, expected, PatientConfig{TargetGlucose: 120, SensitivityFactor: 40, MaxDailyUnits: 10,
+		PumpRateUnitsPerMinute: 0.5}.ApplyTo(insulin))
+}
+
+func TestSchedule_Active(t *testing.T) {
+	schedule := Schedule{
+		"night":   {Start: "22:00", End: "06:00", TargetGlucose: 140},
+		"weekday": {Days: "Mon, tuesday,WED,Thu,Fri", Start: "06:00", End: "22:00", SensitivityFactor: 40},
+	}
+
+	tests := []struct {
+		Name            string
+		At              time.Time
+		ExpectedSegment string
+	}{
+		{"Monday morning", time.Date(2024, 1, 1, 6, 0, 0, 0, time.UTC), "weekday"},
+		{"Monday evening", time.Date(2024, 1, 1, 21, 59, 0, 0, time.UTC), "weekday"},
+		{"Monday night", time.Date(2024, 1, 1, 22, 0, 0, 0, time.UTC), "night"},
+		{"Past midnight", time.Date(2024, 1, 2, 5, 59, 0, 0, time.UTC), "night"},
+		{"Saturday night into Sunday", time.Date(2024, 1, 7, 1, 0, 0, 0, time.UTC), "night"},
+		{"Saturday afternoon", time.Date(2024, 1, 6, 15, 0, 0, 0, time.UTC), ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			name, _, active := schedule.Active(test.At)
+			assert.Equal(t, test.ExpectedSegment, name)
+			assert.Equal(t, test.ExpectedSegment != "", active)
+		})
+	}
+
+	allDay := ScheduleSegment{Days: "Sun", Start: "00:00", End: "00:00"}
+	assert.True(t, allDay.Active(time.Date(2024, 1, 7, 23, 59, 0, 0, time.UTC)))
+	assert.False(t, allDay.Active(time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC)))
+
+	insulin := validInsulinConfig()
+	expected := insulin
+	expected.TargetGlucose = 140
+	assert.Equal(t, expected, schedule["night"].ApplyTo(insulin))
+}
+
+func TestPatientConfig_RecipientList(t *testing.T) {
+	assert.Nil(t, PatientConfig{}.RecipientList())
+	assert.Equal(t, []string{"ward-3", "dr-smith"}, PatientConfig{Recipients: " ward-3, ,dr-smith "}.RecipientList())
+}
+
+func TestInsulinConfig_Validate(t *testing.T) {
+	withInsulin := func(change func(*InsulinConfig)) InsulinConfig {
+		insulin := validInsulinConfig()
+		change(&insulin)
+		return insulin
+	}
+
+	tests := []struct {
+		Name          string
+		Insulin       InsulinConfig
+		ExpectedError string
+	}{
+		{"Valid exponential", validInsulinConfig(), ""},
+		{"Valid linear", withInsulin(func(ic *InsulinConfig) { ic.DecayCurve = DecayCurveLinear; ic.PeakMinutes = 0 }), ""},
+		{"Missing duration", withInsulin(func(ic *InsulinConfig) { ic.ActionDurationMinutes = 0 }), "ActionDurationMinutes must be"},
+		{"Bad curve", withInsulin(func(ic *InsulinConfig) { ic.DecayCurve = "bilinear" }), "DecayCurve 'bilinear' is not supported"},
+		{"Late peak", withInsulin(func(ic *InsulinConfig) { ic.PeakMinutes = 120 }), "PeakMinutes must be"},
+		{"Target too low", withInsulin(func(ic *InsulinConfig) { ic.TargetGlucose = 60 }), "TargetGlucose must be between"},
+		{"Missing sensitivity", withInsulin(func(ic *InsulinConfig) { ic.SensitivityFactor = 0 }), "SensitivityFactor must be"},
+		{"Negative carb ratio", withInsulin(func(ic *InsulinConfig) { ic.CarbRatio = -1 }), "CarbRatio must not be negative"},
+		{"Meals disabled", withInsulin(func(ic *InsulinConfig) { ic.CarbRatio = 0 }), ""},
+		{"Missing max dose", withInsulin(func(ic *InsulinConfig) { ic.MaxDoseUnits = 0 }), "MaxDoseUnits must be"},
+		{"Min dose above max", withInsulin(func(ic *InsulinConfig) { ic.MinDoseUnits = 5 }), "MaxDoseUnits must be"},
+		{"Missing pump rate", withInsulin(func(ic *InsulinConfig) { ic.PumpRateUnitsPerMinute = 0 }), "PumpRateUnitsPerMinute must be"},
+		{"Missing max on board", withInsulin(func(ic *InsulinConfig) { ic.MaxOnBoardUnits = -1 }), "MaxOnBoardUnits must be"},
+		{"Hourly below max dose", withInsulin(func(ic *InsulinConfig) { ic.MaxHourlyUnits = 1 }), "MaxHourlyUnits must be"},
+		{"Daily below hourly", withInsulin(func(ic *InsulinConfig) { ic.MaxDailyUnits = 3 }), "MaxHourlyUnits must be"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := test.Insulin.Validate()
+			if test.ExpectedError == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.ExpectedError)
+		})
+	}
+}
+
+func TestInjectorConfig_Validate(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Injector      InjectorConfig
+		ExpectedError string
+	}{
+		{"Valid duration", InjectorConfig{DeliveryMode: DeliveryModeDuration, DeviceName: "insulin-injector", PendingStopsFile: "stops.json", CommandAttempts: 3, RetryBackoffMillis: 100, MaxRetryBackoffMillis: 1000}, ""},
+		{"Valid dose", InjectorConfig{DeliveryMode: DeliveryModeDose, DoseCommand: "WriteFloat32Value", DoseResource: "Float32", DeviceName: "insulin-injector", PendingStopsFile: "stops.json", CommandAttempts: 3, RetryBackoffMillis: 100, MaxRetryBackoffMillis: 1000}, ""},
+		{"Dose missing command", InjectorConfig{DeliveryMode: DeliveryModeDose, DoseResource: "Float32"}, "DoseCommand and DoseResource must be set"},
+		{"Bad mode", InjectorConfig{DeliveryMode: "pulse"}, "DeliveryMode 'pulse' is not supported"},
+		{"Missing pending stops file", InjectorConfig{DeliveryMode: DeliveryModeDuration}, "PendingStopsFile must be set"},
+		{"No attempts", InjectorConfig{DeliveryMode: DeliveryModeDuration, PendingStopsFile: "stops.json", RetryBackoffMillis: 100, MaxRetryBackoffMillis: 1000}, "CommandAttempts must be between 1 and 5"},
+		{"Too many attempts", InjectorConfig{DeliveryMode: DeliveryModeDuration, PendingStopsFile: "stops.json", CommandAttempts: 10, RetryBackoffMillis: 100, MaxRetryBackoffMillis: 1000}, "CommandAttempts must be between 1 and 5"},
+		{"Missing device name", InjectorConfig{DeliveryMode: DeliveryModeDuration, PendingStopsFile: "stops.json", CommandAttempts: 3, RetryBackoffMillis: 100, MaxRetryBackoffMillis: 1000}, "DeviceName must be set"},
+		{"Backoff above max", InjectorConfig{DeliveryMode: DeliveryModeDuration, DeviceName: "insulin-injector", PendingStopsFile: "stops.json", CommandAttempts: 3, RetryBackoffMillis: 2000, MaxRetryBackoffMillis: 1000}, "RetryBackoffMillis must be"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := test.Injector.Validate()
+			if test.ExpectedError == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.ExpectedError)
+		})
+	}
+}
+
+func TestSuspendConfig_Validate(t *testing.T) {
+	predictive := SuspendConfig{
+		ResumeGlucose:      90,
+		PredictiveAction:   ActionSuspend,
+		PredictiveFloor:    80,
+		PredictionMinutes:  30,
+		TrendWindowMinutes: 20,
+		MinTrendReadings:   3,
+	}
+	withSuspend := func(change func(*SuspendConfig)) SuspendConfig {
+		suspend := predictive
+		change(&suspend)
+		return suspend
+	}
+
+	tests := []struct {
+		Name          string
+		Suspend       SuspendConfig
+		ExpectedError string
+	}{
+		{"Valid predictive suspend", predictive, ""},
+		{"Valid predictive skip", withSuspend(func(sc *SuspendConfig) { sc.PredictiveAction = ActionSkip }), ""},
+		{"Valid predictive disabled", SuspendConfig{ResumeGlucose: 90, PredictiveAction: ActionNone}, ""},
+		{"Missing resume", withSuspend(func(sc *SuspendConfig) { sc.ResumeGlucose = 0 }), "ResumeGlucose must be"},
+		{"Missing action", withSuspend(func(sc *SuspendConfig) { sc.PredictiveAction = "" }), "PredictiveAction '' is not supported"},
+		{"Actuate action", withSuspend(func(sc *SuspendConfig) { sc.PredictiveAction = ActionActuate }), "PredictiveAction 'actuate' is not supported"},
+		{"Floor above resume", withSuspend(func(sc *SuspendConfig) { sc.PredictiveFloor = 100 }), "PredictiveFloor must be"},
+		{"Missing prediction", withSuspend(func(sc *SuspendConfig) { sc.PredictionMinutes = 0 }), "PredictionMinutes and TrendWindowMinutes must be"},
+		{"Too few readings", withSuspend(func(sc *SuspendConfig) { sc.MinTrendReadings = 1 }), "MinTrendReadings must be at least 2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := test.Suspend.Validate(nil)
+			if test.ExpectedError == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.ExpectedError)
+		})
+	}
+}
+
+func TestBolusConfig_Validate(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Bolus         BolusConfig
+		ExpectedError string
+	}{
+		{"Valid", BolusConfig{MinGlucose: 120, MaxGlucoseAgeMinutes: 15}, ""},
+		{"Glucose too low", BolusConfig{MinGlucose: 60, MaxGlucoseAgeMinutes: 15}, "MinGlucose must be between"},
+		{"Missing age", BolusConfig{MinGlucose: 120}, "MaxGlucoseAgeMinutes must be"},
+		{"Age too old", BolusConfig{MinGlucose: 120, MaxGlucoseAgeMinutes: 60}, "MaxGlucoseAgeMinutes must be"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := test.Bolus.Validate()
+			if test.ExpectedError == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.ExpectedError)
+		})
+	}
+}
+
+func TestLockoutConfig_Validate(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Lockout       LockoutConfig
+		ExpectedError string
+	}{
+		{"Valid", LockoutConfig{Minutes: 15, Devices: map[string]int{"injector": 30}}, ""},
+		{"Disabled", LockoutConfig{}, ""},
+		{"Negative", LockoutConfig{Minutes: -1}, "Minutes must be between 0 and 240"},
+		{"Too long", LockoutConfig{Minutes: 300}, "Minutes must be between 0 and 240"},
+		{"Device too long", LockoutConfig{Minutes: 15, Devices: map[string]int{"injector": 300}}, "Devices 'injector' must be between 0 and 240 minutes"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := test.Lockout.Validate()
+			if test.ExpectedError == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.ExpectedError)
+		})
+	}
+}
+
+func TestControllerConfig_Validate(t *testing.T) {
+	pid := ControllerConfig{Type: ControllerPID, Kp: 0.01, Ki: 0.0005, Kd: 0.05, IntegralLimit: 1, InsulinFeedback: 0.5}
+	withPID := func(change func(*ControllerConfig)) ControllerConfig {
+		controller := pid
+		change(&controller)
+		return controller
+	}
+
+	tests := []struct {
+		Name          string
+		Controller    ControllerConfig
+		ExpectedError string
+	}{
+		{"Default", ControllerConfig{}, ""},
+		{"Correction", ControllerConfig{Type: ControllerCorrection}, ""},
+		{"PID", pid, ""},
+		{"Unsupported", ControllerConfig{Type: "mpc"}, "Type 'mpc' is not supported"},
+		{"No gains", withPID(func(cc *ControllerConfig) { cc.Kp, cc.Ki, cc.Kd = 0, 0, 0 }), "at least one must be greater than zero"},
+		{"Negative gain", withPID(func(cc *ControllerConfig) { cc.Kd = -0.1 }), "must not be negative"},
+		{"Missing integral limit", withPID(func(cc *ControllerConfig) { cc.IntegralLimit = 0 }), "IntegralLimit must be greater than zero"},
+		{"Feedback above one", withPID(func(cc *ControllerConfig) { cc.InsulinFeedback = 1.5 }), "InsulinFeedback must be between 0 and 1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := test.Controller.Validate()
+			if test.ExpectedError == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.ExpectedError)
+		})
+	}
+}
+
+func TestFilterConfig_Validate(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Filter        FilterConfig
+		ExpectedError string
+	}{
+		{"Default", FilterConfig{}, ""},
+		{"Median", FilterConfig{Type: FilterMedian, WindowSize: 5, MaxRatePerMinute: 10, MaxRejected: 2}, ""},
+		{"Kalman", FilterConfig{Type: FilterKalman, ProcessNoise: 1, MeasurementNoise: 25}, ""},
+		{"Unsupported", FilterConfig{Type: "mean"}, "Type 'mean' is not supported"},
+		{"Window too small", FilterConfig{Type: FilterMedian, WindowSize: 2}, "WindowSize must be between 3 and 15"},
+		{"Missing noise", FilterConfig{Type: FilterKalman, ProcessNoise: 1}, "ProcessNoise and MeasurementNoise must be greater than zero"},
+		{"Negative rate", FilterConfig{Type: FilterNone, MaxRatePerMinute: -1}, "MaxRatePerMinute must not be negative"},
+		{"Missing max rejected", FilterConfig{Type: FilterNone, MaxRatePerMinute: 10}, "MaxRejected must be between 1 and 10"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := test.Filter.Validate()
+			if test.ExpectedError == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.ExpectedError)
+		})
+	}
+}
+
+func TestLockoutConfig_Duration(t *testing.T) {
+	target := LockoutConfig{Minutes: 15, Devices: map[string]int{"injector": 30, "unlocked": 0}}
+
+	assert.Equal(t, 30*time.Minute, target.Duration("injector"))
+	assert.Equal(t, time.Duration(0), target.Duration("unlocked"))
+	assert.Equal(t, 15*time.Minute, target.Duration("other"))
+}
+
+func TestLivenessConfig_Validate(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Liveness      LivenessConfig
+		ExpectedError string
+	}{
+		{"Valid", LivenessConfig{StaleMinutes: 10, Devices: map[string]int{"monitor": 20}}, ""},
+		{"Disabled", LivenessConfig{}, ""},
+		{"Negative", LivenessConfig{StaleMinutes: -1}, "StaleMinutes must be between 0 and 30"},
+		{"Too long", LivenessConfig{StaleMinutes: 45}, "StaleMinutes must be between 0 and 30"},
+		{"Device too long", LivenessConfig{StaleMinutes: 10, Devices: map[string]int{"monitor": 60}}, "Devices 'monitor' must be between 0 and 30 minutes"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := test.Liveness.Validate()
+			if test.ExpectedError == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.ExpectedError)
+		})
+	}
+}
+
+func TestLivenessConfig_Interval(t *testing.T) {
+	target := LivenessConfig{StaleMinutes: 10, Devices: map[string]int{"monitor": 20, "untracked": 0}}
+
+	assert.Equal(t, 20*time.Minute, target.Interval("monitor"))
+	assert.Equal(t, time.Duration(0), target.Interval("untracked"))
+	assert.Equal(t, 10*time.Minute, target.Interval("other"))
+}
+
+func TestMqttConfig_Validate(t *testing.T) {
+	withConfig := func(change func(*MqttConfig)) MqttConfig {
+		mqtt := validMqttConfig()
+		change(&mqtt)
+		return mqtt
+	}
+
+	tests := []struct {
+		Name          string
+		Mqtt          MqttConfig
+		ExpectedError string
+	}{
+		{"Valid", validMqttConfig(), ""},
+		{"Wildcards", withConfig(func(m *MqttConfig) { m.Topics = "glucose/+/high, ward-3/#, #" }), ""},
+		{"Persistent session", withConfig(func(m *MqttConfig) { m.CleanSession = false; m.ClientId = "insulin" }), ""},
+		{"Missing broker", withConfig(func(m *MqttConfig) { m.BrokerAddress = "" }), "BrokerAddress '' must be a URL"},
+		{"Bad scheme", withConfig(func(m *MqttConfig) { m.BrokerAddress = "http://broker:1883" }), "BrokerAddress scheme 'http' is not supported"},
+		{"Persistent session without client id", withConfig(func(m *MqttConfig) { m.CleanSession = false }), "ClientId must be set when CleanSession is false"},
+		{"No topics", withConfig(func(m *MqttConfig) { m.Topics = " , " }), "Topics must contain at least one topic"},
+		{"Multi-level wildcard not last", withConfig(func(m *MqttConfig) { m.Topics = "glucose/#/high" }), "Topics 'glucose/#/high' may only use the # wildcard as the last topic level"},
+		{"Partial level wildcard", withConfig(func(m *MqttConfig) { m.Topics = "glucose/ward+" }), "Topics 'glucose/ward+' may only use the + wildcard as a whole topic level"},
+		{"Dead letter topic", withConfig(func(m *MqttConfig) { m.Topics = "glucose/+/high"; m.DeadLetterTopic = "glucose/dead-letter" }), ""},
+		{"Dead letter wildcard", withConfig(func(m *MqttConfig) { m.DeadLetterTopic = "dead-letter/+" }), "DeadLetterTopic 'dead-letter/+' must not use wildcards"},
+		{"Dead letter subscribed", withConfig(func(m *MqttConfig) { m.Topics = "glucose/+/high"; m.DeadLetterTopic = "glucose/dead-letter/high" }), "DeadLetterTopic 'glucose/dead-letter/high' must not match Topics 'glucose/+/high'"},
+		{"Dead letter under multi-level wildcard", withConfig(func(m *MqttConfig) { m.Topics = "glucose/#"; m.DeadLetterTopic = "glucose" }), "DeadLetterTopic 'glucose' must not match Topics 'glucose/#'"},
+		{"Bad QoS", withConfig(func(m *MqttConfig) { m.Qos = 3 }), "Qos must be 0, 1 or 2"},
+		{"No keepalive", withConfig(func(m *MqttConfig) { m.KeepAliveSeconds = 0 }), "KeepAliveSeconds must be between 1 and 65535"},
+		{"No reconnect interval", withConfig(func(m *MqttConfig) { m.MaxReconnectSeconds = 0 }), "MaxReconnectSeconds must be between 1 and 300"},
+		{"Reconnect interval too long", withConfig(func(m *MqttConfig) { m.MaxReconnectSeconds = 301 }), "MaxReconnectSeconds must be between 1 and 300"},
+		{"Username and password over TLS", withConfig(func(m *MqttConfig) {
+			m.BrokerAddress = "ssl://edgex-mqtt-broker:8883"
+			m.AuthMode = MqttAuthUsernamePassword
+			m.SecretName = "mqtt"
+			m.ServerName = "broker.hospital.local"
+		}), ""},
+		{"Client certificate", withConfig(func(m *MqttConfig) {
+			m.BrokerAddress = "mqtts://broker:8883"
+			m.AuthMode = MqttAuthClientCert
+			m.SecretName = "mqtt"
+		}), ""},
+		{"Bad auth mode", withConfig(func(m *MqttConfig) { m.AuthMode = "token" }), "AuthMode 'token' is not supported"},
+		{"Missing secret name", withConfig(func(m *MqttConfig) { m.BrokerAddress = "ssl://broker:8883"; m.AuthMode = MqttAuthCACert }), "SecretName must be set for AuthMode 'cacert'"},
+		{"Credentials in plaintext", withConfig(func(m *MqttConfig) { m.AuthMode = MqttAuthUsernamePassword; m.SecretName = "mqtt" }), "AuthMode 'usernamepassword' requires a TLS BrokerAddress"},
+		{"Server name without TLS", withConfig(func(m *MqttConfig) { m.ServerName = "broker" }), "ServerName requires a TLS BrokerAddress"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := test.Mqtt.Validate()
+			if test.ExpectedError == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.ExpectedError)
+		})
+	}
+}
+
+func TestMqttConfig_TopicList(t *testing.T) {
+	target := MqttConfig{Topics: "high-glucose, glucose/+/high,,"}
+	assert.Equal(t, []string{"high-glucose", "glucose/+/high"}, target.TopicList())
+}
+
+func validMqttConfig() MqttConfig {
+	return MqttConfig{
+		BrokerAddress:       "tcp://edgex-mqtt-broker:1883",
+		Topics:              "high-glucose",
+		CleanSession:        true,
+		KeepAliveSeconds:    30,
+		MaxReconnectSeconds: 60,
+	}
+}
+
+func validInsulinConfig() InsulinConfig {
+	return InsulinConfig{
+		ActionDurationMinutes:  240,
+		DecayCurve:             DecayCurveExponential,
+		PeakMinutes:            75,
+		TargetGlucose:          110,
+		SensitivityFactor:      50,
+		CarbRatio:              10,
+		MinDoseUnits:           0.05,
+		MaxDoseUnits:           2,
+		PumpRateUnitsPerMinute: 1,
+		MaxOnBoardUnits:        3,
+		MaxHourlyUnits:         4,
+		MaxDailyUnits:          20,
+	}
+}
@@ -0,0 +1,112 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"app-insulin-service/config"
+)
+
+// AlertData is the alert posted to the patient monitoring dashboard.
+type AlertData struct {
+	AssetId    int    `json:"assetId"`
+	EventCode  string `json:"eventCode"`
+	DeviceName string `json:"deviceName"`
+	Value      int    `json:"value"`
+	Message    string `json:"message"`
+	SensorName string `json:"sensorName"`
+	TimeStamp  string `json:"timeStamp"`
+	Source     string `json:"source"`
+}
+
+// NewAlertData creates an insulin alert for the patient identified by asset with the current glucose value, rounded
+// to the nearest whole mg/dL. The message is prefixed with the asset name.
+func NewAlertData(asset config.AssetConfig, glucose float64, message string) AlertData {
+	return AlertData{
+		AssetId:    asset.Id,
+		EventCode:  "NUAGE_SYSTEM_EXCEPTION_ORCH",
+		DeviceName: asset.Name,
+		Value:      int(math.Round(glucose)),
+		Message:    asset.Name + ": " + message,
+		SensorName: "insulin",
+		Source:     "insulin",
+		TimeStamp:  time.Now().Format("2006-01-02T15:04:05Z07:00"),
+	}
+}
+
+// DeviceData is the live insulin delivery state of a patient shown on the patient monitoring dashboard, 1 while the
+// injector is delivering and 0 once it is stopped.
+type DeviceData struct {
+	AssetId    int    `json:"assetId"`
+	DeviceName string `json:"deviceName"`
+	Value      int    `json:"value"`
+	SensorName string `json:"sensorName"`
+}
+
+// NewDeviceData creates the live insulin delivery state of the patient identified by asset.
+func NewDeviceData(asset config.AssetConfig, delivering bool) DeviceData {
+	deviceData := DeviceData{
+		AssetId:    asset.Id,
+		DeviceName: asset.Name,
+		SensorName: "insulin",
+	}
+	if delivering {
+		deviceData.Value = 1
+	}
+	return deviceData
+}
+
+// PostAlertData posts the alert to the patient monitoring dashboard and returns the response body.
+func PostAlertData(alertData AlertData) (string, error) {
+	return postDashboard("http://10.239.80.228:8085/api/alerts/createAppAlert", "alert", alertData)
+}
+
+// PostLiveData posts the live insulin delivery state to the patient monitoring dashboard and returns the response
+// body.
+func PostLiveData(deviceData DeviceData) (string, error) {
+	return postDashboard("http://10.239.80.228:8085/assets/deviceTimeSeriesData", "live data", deviceData)
+}
+
+// postDashboard posts the data, described by kind in errors, as JSON to the dashboard url and returns the response
+// body.
+func postDashboard(url string, kind string, data interface{}) (string, error) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal %s data: %s", kind, err.Error())
+	}
+
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("error occurred during %s http request: %s", kind, err.Error())
+	}
+	defer resp.Body.Close()
+
+	// Read the response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading %s response body: %s", kind, err.Error())
+	}
+
+	return string(body), nil
+}
@@ -0,0 +1,223 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/clients/logger"
+
+	"app-insulin-service/config"
+)
+
+// BolusRequest asks for a specific dose to be delivered by an injector.
+type BolusRequest struct {
+	DeviceName  string  `json:"deviceName"`
+	Units       float64 `json:"units"`
+	RequestedBy string  `json:"requestedBy"`
+	Reason      string  `json:"reason,omitempty"`
+}
+
+// BolusResponse reports whether a requested dose was accepted, and if not why, and whether it was delivered.
+type BolusResponse struct {
+	BolusCheck
+	DeviceName  string `json:"deviceName"`
+	RequestedBy string `json:"requestedBy"`
+	// Accepted is true when the dose passed every check, Reasons lists the checks that failed otherwise
+	Accepted bool `json:"accepted"`
+	// Delivered is true when the injector confirmed the actuation, Error explains why it did not otherwise
+	Delivered bool    `json:"delivered"`
+	Error     string  `json:"error,omitempty"`
+	Glucose   float64 `json:"glucose,omitempty"`
+	// DisplayGlucose is Glucose, which is in mg/dL, in the patient's display units
+	DisplayGlucose string    `json:"displayGlucose,omitempty"`
+	GlucoseDevice  string    `json:"glucoseDevice,omitempty"`
+	GlucoseTime    time.Time `json:"glucoseTime"`
+	Time           time.Time `json:"time"`
+}
+
+// ManualBolus delivers doses requested by a clinician, and doses covering announced meals, after running them
+// through the same safety checks as correction doses: the insulin limits, suspension and a recent, safe, glucose
+// reading that is not predicted to go low.
+type ManualBolus struct {
+	mutex          sync.Mutex
+	config         config.BolusConfig
+	lc             logger.LoggingClient
+	doseCalculator *DoseCalculator
+	insulinOnBoard *InsulinOnBoard
+	suspension     *Suspension
+	scheduler      *StopScheduler
+	history        *GlucoseHistory
+	injector       *InjectorCommander
+	lockout        *Lockout
+	patients       *Patients
+	postAlert      func(AlertData) (string, error)
+}
+
+// NewManualBolus creates a ManualBolus using the given, already validated, configuration and the components shared
+// with the automatic dosing paths. A manual dose is not subject to the lockout, but starts it, a meal dose is subject
+// to it like a correction dose.
+func NewManualBolus(bolus config.BolusConfig, lc logger.LoggingClient, doseCalculator *DoseCalculator, insulinOnBoard *InsulinOnBoard,
+	suspension *Suspension, scheduler *StopScheduler, history *GlucoseHistory, injector *InjectorCommander, lockout *Lockout,
+	patients *Patients) *ManualBolus {
+	return &ManualBolus{
+		config:         bolus,
+		lc:             lc,
+		doseCalculator: doseCalculator,
+		insulinOnBoard: insulinOnBoard,
+		suspension:     suspension,
+		scheduler:      scheduler,
+		history:        history,
+		injector:       injector,
+		lockout:        lockout,
+		patients:       patients,
+		postAlert:      PostAlertData,
+	}
+}
+
+// UpdateConfig replaces the bolus configuration.
+func (m *ManualBolus) UpdateConfig(bolus config.BolusConfig) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.config = bolus
+}
+
+// Request checks the requested dose and delivers it when every check passes. Requests are handled one at a time
+// so concurrent requests cannot each pass the delivery limits.
+func (m *ManualBolus) Request(request BolusRequest, at time.Time) BolusResponse {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// The injector is locked from the checks until the dose is delivered, like the automatic dosing paths. An
+	// unknown injector is rejected below without taking a lock, so requests cannot add locks for any name given.
+	configured := m.injector.IsConfigured(request.DeviceName)
+	if configured {
+		unlock := m.injector.Lock(request.DeviceName)
+		defer unlock()
+	}
+
+	response := BolusResponse{
+		DeviceName:  request.DeviceName,
+		RequestedBy: request.RequestedBy,
+		Time:        at,
+	}
+	// The glucose and delivery limits are those of the patient the injector delivers to
+	patient := m.patients.ForInjector(request.DeviceName)
+	var glucoseReasons []string
+	response.GlucoseDevice, response.GlucoseTime, response.Glucose, glucoseReasons = m.currentGlucose(patient, at)
+	if response.GlucoseDevice != "" {
+		response.DisplayGlucose = patient.FormatGlucose(response.Glucose)
+	}
+	if response.GlucoseDevice != "" && response.Glucose < m.config.MinGlucose {
+		glucoseReasons = append(glucoseReasons, fmt.Sprintf("glucose %s is below the minimum of %s for a manual dose",
+			patient.FormatGlucose(response.Glucose), patient.FormatGlucose(m.config.MinGlucose)))
+	}
+	response.BolusCheck = m.doseCalculator.CheckBolus(response.GlucoseDevice, request.DeviceName, request.Units, at)
+
+	if request.RequestedBy == "" {
+		response.Reasons = append(response.Reasons, "requestedBy must be set")
+	}
+	if !configured {
+		response.Reasons = append(response.Reasons, fmt.Sprintf("injector '%s' is not configured", request.DeviceName))
+	}
+	if m.suspension.IsSuspended(request.DeviceName) {
+		response.Reasons = append(response.Reasons, "insulin delivery is suspended")
+	}
+	response.Reasons = append(response.Reasons, glucoseReasons...)
+
+	if len(response.Reasons) > 0 {
+		m.lc.Warnf("Manual bolus of %.2f units by %s requested by %s rejected: %v",
+			request.Units, request.DeviceName, request.RequestedBy, response.Reasons)
+		return response
+	}
+
+	response.Accepted = true
+	m.lc.Infof("Manual bolus of %.2f units by %s requested by %s accepted: %s",
+		request.Units, request.DeviceName, request.RequestedBy, request.Reason)
+
+	if err := m.deliver(request.DeviceName, request.Units, at); err != nil {
+		m.lc.Errorf("Manual bolus by %s not confirmed, stopping injector: %s", request.DeviceName, err.Error())
+		response.Error = err.Error()
+		return response
+	}
+	response.Delivered = true
+	m.lockout.Actuated(request.DeviceName, at)
+
+	message := fmt.Sprintf("Manual bolus of %.2f units requested by %s, current glucose - %s",
+		request.Units, request.RequestedBy, patient.FormatGlucose(response.Glucose))
+	if _, err := m.postAlert(NewAlertData(patient.Asset, response.Glucose, message)); err != nil {
+		m.lc.Errorf("unable to post manual bolus alert: %s", err.Error())
+	}
+
+	return response
+}
+
+// deliver actuates the injector for the given units. The units are reserved as insulin on board and the stop of a
+// duration actuation is persisted before the injector is started, both are undone in favour of an immediate stop
+// when the actuation is not confirmed. Caller must hold the lock.
+func (m *ManualBolus) deliver(deviceName string, units float64, at time.Time) error {
+	actuation := m.doseCalculator.Actuation(m.patients.ForInjector(deviceName).At(at).Insulin, units)
+	reserved := m.insulinOnBoard.Reserve(deviceName, units, at)
+	stop := func() { _ = m.injector.Stop(deviceName) }
+	m.scheduleStop(deviceName, actuation, stop)
+
+	err := m.injector.Start(deviceName, actuation)
+	if err != nil {
+		m.insulinOnBoard.Release(deviceName, reserved)
+		m.scheduler.Cancel(deviceName)
+		_ = m.injector.Stop(deviceName)
+		return err
+	}
+
+	// Scheduled again so the duration runs from the confirmed start rather than from the command
+	m.scheduleStop(deviceName, actuation, stop)
+	return nil
+}
+
+// scheduleStop schedules the stop of a duration actuation, replacing any stop already scheduled for the injector.
+func (m *ManualBolus) scheduleStop(deviceName string, actuation Actuation, stop func()) {
+	if actuation.StopAfter <= 0 {
+		return
+	}
+	if err := m.scheduler.Schedule(deviceName, actuation.StopAfter, stop); err != nil {
+		m.lc.Errorf("Insulin stop for %s will not survive a restart: %s", deviceName, err.Error())
+	}
+}
+
+// currentGlucose returns the monitor, time and value of the current glucose of the patient and the reasons it does
+// not allow a dose. The current glucose is the latest reading from the patient's monitor, or for the default
+// profile from any monitor without a profile of its own. The monitor is empty when there is no reading.
+func (m *ManualBolus) currentGlucose(patient PatientProfile, at time.Time) (string, time.Time, float64, []string) {
+	deviceName, latest, found := m.history.Latest(func(deviceName string) bool {
+		return m.patients.ForMonitor(deviceName).Name == patient.Name
+	})
+	if !found {
+		return "", time.Time{}, 0, []string{"no glucose reading available"}
+	}
+
+	var reasons []string
+	maxAge := time.Duration(m.config.MaxGlucoseAgeMinutes) * time.Minute
+	if age := at.Sub(latest.Time); age > maxAge {
+		reasons = append(reasons, fmt.Sprintf("latest glucose reading is %s old, older than %s", age.Round(time.Second), maxAge))
+	}
+	if trend := m.history.Trend(deviceName); trend.PredictedLow {
+		reasons = append(reasons, fmt.Sprintf("glucose is projected to fall to %s", patient.FormatGlucose(trend.Projected)))
+	}
+
+	return deviceName, latest.Time, latest.Value, reasons
+}
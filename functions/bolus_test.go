@@ -0,0 +1,155 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/clients/interfaces/mocks"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/clients/logger"
+	dtoCommon "github.com/edgexfoundry/go-mod-core-contracts/v3/dtos/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"app-insulin-service/config"
+)
+
+func newTestManualBolus(client *mocks.CommandClient) (*ManualBolus, *InsulinOnBoard, *Suspension, *GlucoseHistory) {
+	insulin := testInsulinConfig(config.DecayCurveLinear)
+	injector, _, _ := newTestInjectorCommander(client)
+	insulinOnBoard := NewInsulinOnBoard(insulin)
+	patients := newTestPatients(nil)
+	doseCalculator := NewDoseCalculator(testInjectorConfig(), logger.NewMockClient(), insulinOnBoard, patients)
+	suspension := NewSuspension(90)
+	history := NewGlucoseHistory(testSuspendConfig(config.ActionSuspend))
+	target := NewManualBolus(config.BolusConfig{MinGlucose: 120, MaxGlucoseAgeMinutes: 15}, logger.NewMockClient(),
+		doseCalculator, insulinOnBoard, suspension, NewStopScheduler(""), history, injector, NewLockout(config.LockoutConfig{Minutes: 15}), patients)
+	target.postAlert = func(AlertData) (string, error) { return "", nil }
+	return target, insulinOnBoard, suspension, history
+}
+
+func TestManualBolus_Request(t *testing.T) {
+	client := &mocks.CommandClient{}
+	client.On("IssueSetCommandByName", mock.Anything, "injector", "WriteBoolValue", mock.Anything).
+		Return(dtoCommon.NewBaseResponse("", "", 200), nil)
+	client.On("IssueGetCommandByName", mock.Anything, "injector", "Bool", false, true).
+		Return(readBackResponse("Bool", "true"), nil)
+	target, insulinOnBoard, _, history := newTestManualBolus(client)
+
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	history.Add("monitor", 180, now.Add(-5*time.Minute))
+
+	actual := target.Request(BolusRequest{DeviceName: "injector", Units: 1.5, RequestedBy: "nurse", Reason: "meal"}, now)
+	assert.True(t, actual.Accepted)
+	assert.True(t, actual.Delivered)
+	assert.Empty(t, actual.Reasons)
+	assert.Equal(t, 180.0, actual.Glucose)
+	assert.Equal(t, "monitor", actual.GlucoseDevice)
+	assert.InDelta(t, 1.5, insulinOnBoard.Active("injector", now), 0.001)
+	client.AssertCalled(t, "IssueSetCommandByName", mock.Anything, "injector", "WriteBoolValue", mock.Anything)
+
+	// The first dose now counts towards insulin on board
+	actual = target.Request(BolusRequest{DeviceName: "injector", Units: 2, RequestedBy: "nurse"}, now.Add(time.Minute))
+	assert.False(t, actual.Accepted)
+	assert.False(t, actual.Delivered)
+	assert.Contains(t, actual.Reasons[0], "insulin on board")
+}
+
+func TestManualBolus_Request_Rejected(t *testing.T) {
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		Name            string
+		Request         BolusRequest
+		Readings        []float64
+		ReadingsAgo     time.Duration
+		Suspended       bool
+		ExpectedReasons []string
+	}{
+		{"No glucose", BolusRequest{DeviceName: "injector", Units: 1, RequestedBy: "nurse"}, nil, 0, false,
+			[]string{"no glucose reading available"}},
+		{"Stale glucose", BolusRequest{DeviceName: "injector", Units: 1, RequestedBy: "nurse"}, []float64{180}, 20 * time.Minute, false,
+			[]string{"latest glucose reading is 20m0s old, older than 15m0s"}},
+		{"Low glucose", BolusRequest{DeviceName: "injector", Units: 1, RequestedBy: "nurse"}, []float64{110}, 0, false,
+			[]string{"glucose 110 mg/dL is below the minimum of 120 mg/dL for a manual dose"}},
+		{"Predicted low", BolusRequest{DeviceName: "injector", Units: 1, RequestedBy: "nurse"}, []float64{170, 155, 140}, 0, false,
+			[]string{"glucose is projected to fall to 50 mg/dL"}},
+		{"Suspended", BolusRequest{DeviceName: "injector", Units: 1, RequestedBy: "nurse"}, []float64{180}, 0, true,
+			[]string{"insulin delivery is suspended"}},
+		{"Invalid request", BolusRequest{DeviceName: "pump", Units: 5}, []float64{180}, 0, false,
+			[]string{"dose exceeds the maximum dose of 2.00 units", "dose would raise insulin on board to 5.00 units, above the maximum of 3.00 units",
+				"dose would raise delivery in the last hour to 5.00 units, above the maximum of 4.00 units",
+				"requestedBy must be set", "injector 'pump' is not configured"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			client := &mocks.CommandClient{}
+			target, insulinOnBoard, suspension, history := newTestManualBolus(client)
+			for index, value := range test.Readings {
+				at := now.Add(-test.ReadingsAgo).Add(time.Duration(index-len(test.Readings)+1) * 5 * time.Minute)
+				history.Add("monitor", value, at)
+			}
+			if test.Suspended {
+				suspension.Latch("injector", "emergency stop", "nurse", now)
+			}
+
+			actual := target.Request(test.Request, now)
+			require.False(t, actual.Accepted)
+			assert.False(t, actual.Delivered)
+			assert.Equal(t, test.ExpectedReasons, actual.Reasons)
+			assert.Zero(t, insulinOnBoard.Active(test.Request.DeviceName, now))
+			client.AssertNotCalled(t, "IssueSetCommandByName", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+			if !target.injector.IsConfigured(test.Request.DeviceName) {
+				assert.NotContains(t, target.injector.locks, test.Request.DeviceName, "no lock is taken for an unknown injector")
+			}
+		})
+	}
+}
+
+func TestManualBolus_Request_ReservedBeforeStart(t *testing.T) {
+	client := &mocks.CommandClient{}
+	target, insulinOnBoard, _, history := newTestManualBolus(client)
+	var pendingAtStart []bool
+	var reservedAtStart []float64
+	client.On("IssueSetCommandByName", mock.Anything, "injector", "WriteBoolValue", mock.MatchedBy(func(settings map[string]string) bool {
+		return settings["Bool"] == "true"
+	})).Run(func(mock.Arguments) {
+		pendingAtStart = append(pendingAtStart, target.scheduler.Pending("injector"))
+		reservedAtStart = append(reservedAtStart, insulinOnBoard.Active("injector", time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)))
+	}).Return(dtoCommon.NewBaseResponse("", "device locked", 423), nil)
+	client.On("IssueSetCommandByName", mock.Anything, "injector", "WriteBoolValue", mock.Anything).
+		Return(dtoCommon.NewBaseResponse("", "", 200), nil)
+	client.On("IssueGetCommandByName", mock.Anything, "injector", "Bool", false, true).
+		Return(readBackResponse("Bool", "false"), nil)
+
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	history.Add("monitor", 180, now)
+
+	actual := target.Request(BolusRequest{DeviceName: "injector", Units: 1.5, RequestedBy: "nurse"}, now)
+	assert.True(t, actual.Accepted)
+	assert.False(t, actual.Delivered)
+	require.NotEmpty(t, pendingAtStart)
+	assert.True(t, pendingAtStart[0], "stop scheduled before the injector is started")
+	assert.False(t, target.scheduler.Pending("injector"), "stop cancelled when the start is not confirmed")
+	require.NotEmpty(t, reservedAtStart)
+	assert.InDelta(t, 1.5, reservedAtStart[0], 0.001, "dose reserved before the injector is started")
+	assert.Zero(t, insulinOnBoard.Active("injector", now), "reservation released when the start is not confirmed")
+	assert.Zero(t, target.lockout.Remaining("injector", now), "no lockout when the start is not confirmed")
+}
@@ -0,0 +1,141 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"app-insulin-service/config"
+)
+
+// ControllerInput is what a controller knows about a glucose reading when asked how much insulin to deliver.
+type ControllerInput struct {
+	Glucose        float64
+	At             time.Time
+	InsulinOnBoard float64
+	// Insulin is the patient's insulin configuration, with the active schedule segment applied
+	Insulin config.InsulinConfig
+}
+
+// Controller calculates the insulin to deliver for each glucose reading from a monitor, before the dose limits are
+// applied. A stateful controller must be used for the readings of a single monitor only.
+type Controller interface {
+	// Name returns the controller type, as configured
+	Name() string
+	// Observe updates the controller with a reading accepted from the monitor. Every reading is observed, whether or
+	// not insulin is then dosed on it, so a stateful controller follows glucose continuously.
+	Observe(input ControllerInput)
+	// Units returns the insulin requested for the reading and, when none is requested, why not. It is asked only when
+	// the reading may be dosed on, and does not change the controller's state.
+	Units(input ControllerInput) (float64, string)
+}
+
+// CorrectionController requests the insulin needed to bring glucose down to target using the insulin sensitivity
+// factor, less the insulin still on board.
+type CorrectionController struct{}
+
+// Name returns the controller type.
+func (CorrectionController) Name() string {
+	return config.ControllerCorrection
+}
+
+// Observe does nothing, the correction depends on the current reading only.
+func (CorrectionController) Observe(ControllerInput) {}
+
+// Units returns the correction less the insulin on board.
+func (CorrectionController) Units(input ControllerInput) (float64, string) {
+	correction := (input.Glucose - input.Insulin.TargetGlucose) / input.Insulin.SensitivityFactor
+	if correction <= 0 {
+		return 0, "glucose is at or below target"
+	}
+
+	units := correction - input.InsulinOnBoard
+	if units <= 0 {
+		return 0, "insulin on board covers the correction"
+	}
+
+	return units, ""
+}
+
+// PIDController requests the output of a PID controller acting on the glucose error above target, less the
+// configured fraction of the insulin on board (insulin feedback). The integral and derivative terms follow every
+// observed reading, in range or not. The integral term is bounded so it cannot wind up while glucose stays high, and
+// the controller is reset after a gap in readings. No insulin is requested at or below target, however the terms
+// add up.
+type PIDController struct {
+	mutex      sync.Mutex
+	config     config.ControllerConfig
+	integral   float64
+	derivative float64
+	// lastError and lastTime are those of the last observed reading, lastTime is zero before the first reading
+	lastError float64
+	lastTime  time.Time
+}
+
+// NewPIDController creates a PIDController using the given, already validated, configuration.
+func NewPIDController(controller config.ControllerConfig) *PIDController {
+	return &PIDController{config: controller}
+}
+
+// Name returns the controller type.
+func (c *PIDController) Name() string {
+	return config.ControllerPID
+}
+
+// Observe integrates and differentiates the glucose error of the reading since the last observed reading.
+func (c *PIDController) Observe(input ControllerInput) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	glucoseError := input.Glucose - input.Insulin.TargetGlucose
+	minutes := input.At.Sub(c.lastTime).Minutes()
+	if c.lastTime.IsZero() || minutes <= 0 || minutes > config.MaxGlucoseAgeMinutes {
+		// Nothing to integrate or differentiate over, start again from this reading
+		c.integral = 0
+		minutes = 0
+	}
+
+	c.derivative = 0
+	if minutes > 0 {
+		c.derivative = (glucoseError - c.lastError) / minutes
+	}
+	c.integral += c.config.Ki * glucoseError * minutes
+	c.integral = math.Max(-c.config.IntegralLimit, math.Min(c.config.IntegralLimit, c.integral))
+	c.lastError = glucoseError
+	c.lastTime = input.At
+}
+
+// Units returns the PID output for the reading, with the integral and derivative terms as of the last observed
+// reading, less insulin feedback.
+func (c *PIDController) Units(input ControllerInput) (float64, string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	glucoseError := input.Glucose - input.Insulin.TargetGlucose
+	if glucoseError <= 0 {
+		return 0, "glucose is at or below target"
+	}
+
+	units := c.config.Kp*glucoseError + c.integral + c.config.Kd*c.derivative - c.config.InsulinFeedback*input.InsulinOnBoard
+	if units <= 0 {
+		return 0, "controller requests no insulin"
+	}
+
+	return units, ""
+}
@@ -0,0 +1,119 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"app-insulin-service/config"
+)
+
+func TestPIDController_Units(t *testing.T) {
+	insulin := testInsulinConfig(config.DecayCurveLinear)
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	input := func(glucose float64, minutes int, onBoard float64) ControllerInput {
+		return ControllerInput{Glucose: glucose, At: start.Add(time.Duration(minutes) * time.Minute), InsulinOnBoard: onBoard, Insulin: insulin}
+	}
+	// step observes the reading, as every accepted reading is, then asks for a dose on it
+	step := func(target *PIDController, input ControllerInput) (float64, string) {
+		target.Observe(input)
+		return target.Units(input)
+	}
+
+	t.Run("Proportional", func(t *testing.T) {
+		target := NewPIDController(config.ControllerConfig{Type: config.ControllerPID, Kp: 0.01, IntegralLimit: 1})
+		units, reason := step(target, input(210, 0, 0))
+		assert.InDelta(t, 1, units, 0.0001)
+		assert.Empty(t, reason)
+	})
+
+	t.Run("Integral windup limit", func(t *testing.T) {
+		target := NewPIDController(config.ControllerConfig{Type: config.ControllerPID, Ki: 0.001, IntegralLimit: 0.5})
+		units, _ := step(target, input(210, 0, 0))
+		assert.Zero(t, units, "nothing integrated on the first reading")
+		units, _ = step(target, input(210, 5, 0))
+		assert.InDelta(t, 0.5, units, 0.0001)
+		units, _ = step(target, input(210, 10, 0))
+		assert.InDelta(t, 0.5, units, 0.0001, "bounded by IntegralLimit")
+	})
+
+	t.Run("Derivative", func(t *testing.T) {
+		target := NewPIDController(config.ControllerConfig{Type: config.ControllerPID, Kd: 0.1, IntegralLimit: 1})
+		step(target, input(150, 0, 0))
+		units, _ := step(target, input(160, 5, 0))
+		assert.InDelta(t, 0.2, units, 0.0001)
+		units, reason := step(target, input(155, 10, 0))
+		assert.Zero(t, units)
+		assert.Equal(t, "controller requests no insulin", reason)
+	})
+
+	t.Run("Insulin feedback", func(t *testing.T) {
+		target := NewPIDController(config.ControllerConfig{Type: config.ControllerPID, Kp: 0.01, IntegralLimit: 1, InsulinFeedback: 0.5})
+		units, _ := step(target, input(210, 0, 1))
+		assert.InDelta(t, 0.5, units, 0.0001)
+	})
+
+	t.Run("At target", func(t *testing.T) {
+		target := NewPIDController(config.ControllerConfig{Type: config.ControllerPID, Kp: 0.01, Ki: 0.001, IntegralLimit: 1})
+		step(target, input(210, 0, 0))
+		step(target, input(210, 5, 0))
+		units, reason := step(target, input(110, 10, 0))
+		assert.Zero(t, units)
+		assert.Equal(t, "glucose is at or below target", reason)
+	})
+
+	t.Run("Reset after gap", func(t *testing.T) {
+		target := NewPIDController(config.ControllerConfig{Type: config.ControllerPID, Ki: 0.001, IntegralLimit: 1})
+		step(target, input(210, 0, 0))
+		units, _ := step(target, input(210, 5, 0))
+		assert.InDelta(t, 0.5, units, 0.0001)
+		units, _ = step(target, input(210, 60, 0))
+		assert.Zero(t, units)
+	})
+
+	t.Run("Units does not change state", func(t *testing.T) {
+		target := NewPIDController(config.ControllerConfig{Type: config.ControllerPID, Ki: 0.001, IntegralLimit: 1})
+		step(target, input(210, 0, 0))
+		units, _ := step(target, input(210, 5, 0))
+		assert.InDelta(t, 0.5, units, 0.0001)
+		units, _ = target.Units(input(210, 5, 0))
+		assert.InDelta(t, 0.5, units, 0.0001, "asking again integrates nothing more")
+	})
+
+	t.Run("Readings not dosed on", func(t *testing.T) {
+		target := NewPIDController(config.ControllerConfig{Type: config.ControllerPID, Ki: 0.001, IntegralLimit: 1})
+		step(target, input(210, 0, 0))
+		target.Observe(input(150, 5, 0))
+		units, _ := step(target, input(210, 10, 0))
+		assert.InDelta(t, 0.7, units, 0.0001, "the in range reading is integrated")
+	})
+}
+
+func TestCorrectionController_Units(t *testing.T) {
+	insulin := testInsulinConfig(config.DecayCurveLinear)
+
+	units, reason := CorrectionController{}.Units(ControllerInput{Glucose: 170, InsulinOnBoard: 0.2, Insulin: insulin})
+	assert.InDelta(t, 1, units, 0.0001)
+	assert.Empty(t, reason)
+
+	units, reason = CorrectionController{}.Units(ControllerInput{Glucose: 170, InsulinOnBoard: 2, Insulin: insulin})
+	assert.Zero(t, units)
+	assert.Equal(t, "insulin on board covers the correction", reason)
+}
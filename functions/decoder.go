@@ -0,0 +1,99 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/common"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/dtos"
+
+	"app-insulin-service/config"
+)
+
+// ReadingDecoder decodes glucose from the readings of EdgeX events. It resolves the resource a reading is matched
+// against the rules as, and decodes the value of any numeric EdgeX value type. Resources can be replaced at any
+// time, e.g. when the writable configuration changes.
+type ReadingDecoder struct {
+	mutex sync.RWMutex
+	// resources maps device profile names to the name of the resource carrying glucose in the profile
+	resources map[string]string
+}
+
+// NewReadingDecoder creates a ReadingDecoder for the given, already validated, glucose resources.
+func NewReadingDecoder(resources map[string]string) *ReadingDecoder {
+	decoder := &ReadingDecoder{}
+	decoder.UpdateConfig(resources)
+	return decoder
+}
+
+// UpdateConfig replaces the glucose resource of each device profile.
+func (d *ReadingDecoder) UpdateConfig(resources map[string]string) {
+	copied := make(map[string]string, len(resources))
+	for profile, resource := range resources {
+		copied[profile] = strings.TrimSpace(resource)
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.resources = copied
+}
+
+// ResourceName returns the resource name the reading is matched against the rules as. A reading of the glucose
+// resource configured for its device profile is matched as the Glucose resource, any other by its own name.
+func (d *ReadingDecoder) ResourceName(reading dtos.BaseReading) string {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if resource, ok := d.resources[reading.ProfileName]; ok && resource == reading.ResourceName {
+		return config.GlucoseResource
+	}
+	return reading.ResourceName
+}
+
+// DecodeGlucose returns the glucose in mg/dL of a reading of any numeric EdgeX value type, in the reading's units.
+// Integer values must be whole numbers within the range of their type.
+func DecodeGlucose(reading dtos.BaseReading) (float64, error) {
+	value := strings.TrimSpace(reading.Value)
+
+	var err error
+	switch reading.ValueType {
+	case common.ValueTypeUint8, common.ValueTypeUint16, common.ValueTypeUint32, common.ValueTypeUint64:
+		_, err = strconv.ParseUint(value, 10, bitSize(reading.ValueType))
+	case common.ValueTypeInt8, common.ValueTypeInt16, common.ValueTypeInt32, common.ValueTypeInt64:
+		_, err = strconv.ParseInt(value, 10, bitSize(reading.ValueType))
+	case common.ValueTypeFloat32, common.ValueTypeFloat64:
+	case "":
+		// Readings built without a value type, e.g. by older device services, are decoded as any number
+	default:
+		return 0, fmt.Errorf("value type '%s' is not numeric", reading.ValueType)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("value '%s' is not a valid %s", reading.Value, reading.ValueType)
+	}
+
+	return ParseGlucose(value, reading.Units)
+}
+
+// bitSize returns the size in bits of an integer EdgeX value type.
+func bitSize(valueType string) int {
+	size, _ := strconv.Atoi(strings.TrimLeft(valueType, "UintI"))
+	return size
+}
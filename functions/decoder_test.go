@@ -0,0 +1,83 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"testing"
+
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/common"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/dtos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"app-insulin-service/config"
+)
+
+func TestReadingDecoder_ResourceName(t *testing.T) {
+	target := NewReadingDecoder(map[string]string{"Dexcom-CGM": "GlucoseValue"})
+
+	glucose := dtos.BaseReading{ProfileName: "Dexcom-CGM", ResourceName: "GlucoseValue"}
+	other := dtos.BaseReading{ProfileName: "Dexcom-CGM", ResourceName: "Battery"}
+	unmapped := dtos.BaseReading{ProfileName: "Random-Integer-Device", ResourceName: "Uint16"}
+
+	assert.Equal(t, config.GlucoseResource, target.ResourceName(glucose))
+	assert.Equal(t, "Battery", target.ResourceName(other))
+	assert.Equal(t, "Uint16", target.ResourceName(unmapped))
+
+	target.UpdateConfig(nil)
+	assert.Equal(t, "GlucoseValue", target.ResourceName(glucose))
+}
+
+func TestDecodeGlucose(t *testing.T) {
+	reading := func(valueType string, value string, units string) dtos.BaseReading {
+		return dtos.BaseReading{ValueType: valueType, Units: units, SimpleReading: dtos.SimpleReading{Value: value}}
+	}
+
+	tests := []struct {
+		Name          string
+		Reading       dtos.BaseReading
+		Expected      float64
+		ExpectedError string
+	}{
+		{"Uint8", reading(common.ValueTypeUint8, "145", ""), 145, ""},
+		{"Uint16", reading(common.ValueTypeUint16, "145", ""), 145, ""},
+		{"Uint64", reading(common.ValueTypeUint64, "145", config.UnitsMgDl), 145, ""},
+		{"Int32", reading(common.ValueTypeInt32, "145", ""), 145, ""},
+		{"Float32", reading(common.ValueTypeFloat32, "1.455000e+02", ""), 145.5, ""},
+		{"Float64 mmol/L", reading(common.ValueTypeFloat64, "8.1", config.UnitsMmolL), 145.94742, ""},
+		{"No value type", reading("", "145.5", ""), 145.5, ""},
+		{"Uint8 out of range", reading(common.ValueTypeUint8, "300", ""), 0, "value '300' is not a valid Uint8"},
+		{"Int16 not whole", reading(common.ValueTypeInt16, "145.5", ""), 0, "value '145.5' is not a valid Int16"},
+		{"Negative unsigned", reading(common.ValueTypeUint32, "-1", ""), 0, "value '-1' is not a valid Uint32"},
+		{"Not numeric", reading(common.ValueTypeString, "145", ""), 0, "value type 'String' is not numeric"},
+		{"Bad float", reading(common.ValueTypeFloat64, "high", ""), 0, "glucose value 'high' is not a number"},
+		{"Bad units", reading(common.ValueTypeUint16, "145", "g/L"), 0, "glucose units 'g/L' are not supported"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			actual, err := DecodeGlucose(test.Reading)
+			if test.ExpectedError != "" {
+				require.EqualError(t, err, test.ExpectedError)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.InDelta(t, test.Expected, actual, 0.0001)
+		})
+	}
+}
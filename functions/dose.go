@@ -0,0 +1,404 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/clients/logger"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/dtos"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/models"
+
+	"app-insulin-service/config"
+)
+
+// LimitReachedCategory is the notification category used when a correction dose is refused at a delivery limit
+const LimitReachedCategory = "INSULIN-LIMIT-REACHED"
+
+// DoseCalculation records the inputs and result of a correction dose calculation.
+type DoseCalculation struct {
+	Glucose           float64 `json:"glucose"`
+	TargetGlucose     float64 `json:"targetGlucose"`
+	SensitivityFactor float64 `json:"sensitivityFactor"`
+	InsulinOnBoard    float64 `json:"insulinOnBoard"`
+	// HourlyUnits and DailyUnits are the insulin delivered in the last hour and last 24 hours, before this dose
+	HourlyUnits float64 `json:"hourlyUnits"`
+	DailyUnits  float64 `json:"dailyUnits"`
+	// CorrectionUnits is the insulin needed to bring glucose down to target, before insulin on board and limits
+	CorrectionUnits float64 `json:"correctionUnits"`
+	// Units is the dose to deliver, zero when no dose should be delivered
+	Units float64 `json:"units"`
+	// Reason explains why Units was reduced or skipped, empty when the full correction is delivered
+	Reason string `json:"reason,omitempty"`
+	// LimitReached is true when a dose was needed but the hourly or daily delivery limit has been reached
+	LimitReached bool `json:"limitReached,omitempty"`
+	// LimitAlert is true the first time LimitReached is set for an injector, the limit reached alert is raised then
+	LimitAlert bool `json:"limitAlert,omitempty"`
+	// Segment is the patient's schedule segment the target and sensitivity were taken from, if any
+	Segment string `json:"segment,omitempty"`
+	// Controller is the controller that requested the dose, empty for meal doses
+	Controller string `json:"controller,omitempty"`
+	// Carbs, CarbRatio and MealUnits describe the insulin covering an announced meal, zero for correction doses
+	Carbs     float64 `json:"carbs,omitempty"`
+	CarbRatio float64 `json:"carbRatio,omitempty"`
+	MealUnits float64 `json:"mealUnits,omitempty"`
+}
+
+// CalculateCorrectionDose calculates the insulin needed to bring glucose down to the configured target using the
+// insulin sensitivity factor, less the insulin still on board. The result is limited to the maximum single dose,
+// to the headroom left below the maximum insulin on board and below the hourly and daily delivery limits, and is
+// skipped when smaller than the minimum dose.
+func CalculateCorrectionDose(glucose float64, insulin config.InsulinConfig, onBoard float64, hourly float64, daily float64) DoseCalculation {
+	return CalculateDose(CorrectionController{}, ControllerInput{Glucose: glucose, InsulinOnBoard: onBoard, Insulin: insulin}, hourly, daily)
+}
+
+// CalculateDose calculates the insulin requested by the controller for the reading, limited like a correction dose.
+func CalculateDose(controller Controller, input ControllerInput, hourly float64, daily float64) DoseCalculation {
+	insulin := input.Insulin
+	dose := DoseCalculation{
+		Glucose:           input.Glucose,
+		TargetGlucose:     insulin.TargetGlucose,
+		SensitivityFactor: insulin.SensitivityFactor,
+		InsulinOnBoard:    input.InsulinOnBoard,
+		HourlyUnits:       hourly,
+		DailyUnits:        daily,
+		CorrectionUnits:   (input.Glucose - insulin.TargetGlucose) / insulin.SensitivityFactor,
+		Controller:        controller.Name(),
+	}
+
+	units, reason := controller.Units(input)
+	if units <= 0 {
+		dose.Reason = reason
+		return dose
+	}
+
+	return limitDose(dose, units, insulin, input.InsulinOnBoard, hourly, daily)
+}
+
+// CalculateMealDose calculates the insulin covering a meal of the given grams of carbohydrate using the carb
+// ratio, plus the correction needed to bring glucose down to target less the insulin still on board. Glucose
+// below target reduces the meal dose. The result is limited like a correction dose.
+func CalculateMealDose(carbs float64, glucose float64, insulin config.InsulinConfig, onBoard float64, hourly float64, daily float64) DoseCalculation {
+	dose := DoseCalculation{
+		Glucose:           glucose,
+		TargetGlucose:     insulin.TargetGlucose,
+		SensitivityFactor: insulin.SensitivityFactor,
+		InsulinOnBoard:    onBoard,
+		HourlyUnits:       hourly,
+		DailyUnits:        daily,
+		CorrectionUnits:   (glucose - insulin.TargetGlucose) / insulin.SensitivityFactor,
+		Carbs:             carbs,
+		CarbRatio:         insulin.CarbRatio,
+	}
+
+	if insulin.CarbRatio <= 0 {
+		dose.Reason = "no carb ratio is configured"
+		return dose
+	}
+	dose.MealUnits = carbs / insulin.CarbRatio
+
+	// Insulin on board offsets the correction only, it was not delivered for this meal
+	correction := dose.CorrectionUnits
+	if correction > 0 {
+		correction = math.Max(correction-onBoard, 0)
+	}
+
+	units := dose.MealUnits + correction
+	if units <= 0 {
+		dose.Reason = "glucose below target covers the meal"
+		return dose
+	}
+
+	return limitDose(dose, units, insulin, onBoard, hourly, daily)
+}
+
+// limitDose limits the units of a dose to the maximum single dose, to the headroom left below the maximum insulin
+// on board and below the hourly and daily delivery limits, rounds it down to what the injector can deliver and
+// skips it when smaller than the minimum dose.
+func limitDose(dose DoseCalculation, units float64, insulin config.InsulinConfig, onBoard float64, hourly float64, daily float64) DoseCalculation {
+	if units > insulin.MaxDoseUnits {
+		units = insulin.MaxDoseUnits
+		dose.Reason = "limited to maximum dose"
+	}
+
+	if headroom := insulin.MaxOnBoardUnits - onBoard; units > headroom {
+		units = math.Max(headroom, 0)
+		dose.Reason = "limited by maximum insulin on board"
+	}
+
+	limit := ""
+	if headroom := insulin.MaxHourlyUnits - hourly; units > headroom {
+		units = math.Max(headroom, 0)
+		limit = "hourly"
+	}
+	if headroom := insulin.MaxDailyUnits - daily; units > headroom {
+		units = math.Max(headroom, 0)
+		limit = "daily"
+	}
+	if limit != "" {
+		dose.Reason = "limited by " + limit + " delivery limit"
+	}
+
+	// Injectors deliver in hundredths of a unit, never round up beyond floating point error
+	units = math.Floor(units*100+1e-9) / 100
+	if units <= 0 || units < insulin.MinDoseUnits {
+		dose.Reason = "dose is below the minimum deliverable dose"
+		if limit != "" {
+			dose.Reason = limit + " delivery limit reached"
+			dose.LimitReached = true
+		}
+		return dose
+	}
+
+	dose.Units = units
+	return dose
+}
+
+// BolusCheck records the deliveries a manually requested dose was checked against and why it was rejected.
+type BolusCheck struct {
+	Units          float64 `json:"units"`
+	InsulinOnBoard float64 `json:"insulinOnBoard"`
+	// HourlyUnits and DailyUnits are the insulin delivered in the last hour and last 24 hours, before this dose
+	HourlyUnits float64 `json:"hourlyUnits"`
+	DailyUnits  float64 `json:"dailyUnits"`
+	// Reasons lists every limit the dose breaks, empty when it may be delivered
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// CheckBolus checks a manually requested dose against the same limits applied to correction doses, the single
+// dose limits and maximum insulin on board, and against the hourly and daily delivery limits.
+func CheckBolus(units float64, insulin config.InsulinConfig, onBoard float64, hourly float64, daily float64) BolusCheck {
+	check := BolusCheck{
+		Units:          units,
+		InsulinOnBoard: onBoard,
+		HourlyUnits:    hourly,
+		DailyUnits:     daily,
+	}
+
+	if units <= 0 {
+		check.Reasons = append(check.Reasons, "dose must be greater than zero")
+		return check
+	}
+
+	// Injectors deliver in hundredths of a unit
+	if hundredths := units * 100; math.Abs(hundredths-math.Round(hundredths)) > 1e-9 {
+		check.Reasons = append(check.Reasons, "dose must be in hundredths of a unit")
+	}
+	if units < insulin.MinDoseUnits {
+		check.Reasons = append(check.Reasons, fmt.Sprintf("dose is below the minimum deliverable dose of %.2f units", insulin.MinDoseUnits))
+	}
+	if units > insulin.MaxDoseUnits {
+		check.Reasons = append(check.Reasons, fmt.Sprintf("dose exceeds the maximum dose of %.2f units", insulin.MaxDoseUnits))
+	}
+	if onBoard+units > insulin.MaxOnBoardUnits+1e-9 {
+		check.Reasons = append(check.Reasons, fmt.Sprintf("dose would raise insulin on board to %.2f units, above the maximum of %.2f units",
+			onBoard+units, insulin.MaxOnBoardUnits))
+	}
+	if hourly+units > insulin.MaxHourlyUnits+1e-9 {
+		check.Reasons = append(check.Reasons, fmt.Sprintf("dose would raise delivery in the last hour to %.2f units, above the maximum of %.2f units",
+			hourly+units, insulin.MaxHourlyUnits))
+	}
+	if daily+units > insulin.MaxDailyUnits+1e-9 {
+		check.Reasons = append(check.Reasons, fmt.Sprintf("dose would raise delivery in the last 24 hours to %.2f units, above the maximum of %.2f units",
+			daily+units, insulin.MaxDailyUnits))
+	}
+
+	return check
+}
+
+// Actuation is the injector command that delivers a dose.
+type Actuation struct {
+	CommandName string
+	Settings    map[string]string
+	// StopAfter is how long until the injector must be switched off again, zero when the injector meters the dose itself
+	StopAfter time.Duration
+}
+
+// NewActuation translates a dose in units into the command for the configured injector delivery mode.
+func NewActuation(injector config.InjectorConfig, insulin config.InsulinConfig, units float64) Actuation {
+	if injector.DeliveryMode == config.DeliveryModeDose {
+		return Actuation{
+			CommandName: injector.DoseCommand,
+			Settings: map[string]string{
+				injector.DoseResource: strconv.FormatFloat(units, 'f', 2, 64),
+			},
+		}
+	}
+
+	return Actuation{
+		CommandName: "WriteBoolValue",
+		Settings: map[string]string{
+			"Bool":                     "true",
+			"EnableRandomization_Bool": "false",
+		},
+		StopAfter: insulin.ActuationDuration(units),
+	}
+}
+
+// DoseCalculator calculates correction doses from the current glucose and the shared insulin on board, and
+// translates them into injector commands. Therapy settings and delivery limits are those of the patient wearing the
+// glucose monitor.
+// The limit reached alert is raised once when an injector is first held at a delivery limit, and again only after
+// a dose has been allowed since. It is shared by every path that actuates an injector.
+type DoseCalculator struct {
+	mutex          sync.Mutex
+	injector       config.InjectorConfig
+	insulinOnBoard *InsulinOnBoard
+	patients       *Patients
+	limited        map[string]bool
+	// pids holds the PID controller of each monitor dosed by one, recreated when its configuration changes
+	pids map[string]*PIDController
+	lc   logger.LoggingClient
+	// alert is replaced in tests to avoid sending notifications
+	alert func(monitorDevice string, deviceName string, dose DoseCalculation)
+}
+
+// NewDoseCalculator creates a DoseCalculator using the given, already validated, configuration.
+func NewDoseCalculator(injector config.InjectorConfig, lc logger.LoggingClient, insulinOnBoard *InsulinOnBoard,
+	patients *Patients) *DoseCalculator {
+	calculator := &DoseCalculator{
+		injector:       injector,
+		insulinOnBoard: insulinOnBoard,
+		patients:       patients,
+		limited:        make(map[string]bool),
+		pids:           make(map[string]*PIDController),
+		lc:             lc,
+	}
+	calculator.alert = calculator.raiseLimitAlert
+	return calculator
+}
+
+// UpdateConfig replaces the injector configuration. The insulin configuration is that of each patient's profile.
+func (d *DoseCalculator) UpdateConfig(injector config.InjectorConfig) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.injector = injector
+}
+
+// Calculate returns the correction dose for the named injector given the current glucose from the named monitor,
+// raising the limit reached alert when the injector is first held at a delivery limit.
+func (d *DoseCalculator) Calculate(monitorDevice string, deviceName string, glucose float64, at time.Time) DoseCalculation {
+	dose := d.calculate(monitorDevice, deviceName, glucose, at)
+	if dose.LimitAlert {
+		d.alert(monitorDevice, deviceName, dose)
+	}
+	return dose
+}
+
+// Observe updates the controller dosing the named monitor's readings with a reading accepted from it, whether or
+// not insulin is then dosed on it.
+func (d *DoseCalculator) Observe(monitorDevice string, glucose float64, at time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	patient := d.patients.ForMonitor(monitorDevice).At(at)
+	d.controllerFor(patient).Observe(ControllerInput{Glucose: glucose, At: at, Insulin: patient.Insulin})
+}
+
+func (d *DoseCalculator) calculate(monitorDevice string, deviceName string, glucose float64, at time.Time) DoseCalculation {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	patient := d.patients.ForMonitor(monitorDevice).At(at)
+	input := ControllerInput{Glucose: glucose, At: at, InsulinOnBoard: d.insulinOnBoard.Active(deviceName, at), Insulin: patient.Insulin}
+	dose := CalculateDose(d.controllerFor(patient), input,
+		d.insulinOnBoard.Delivered(deviceName, time.Hour, at), d.insulinOnBoard.Delivered(deviceName, 24*time.Hour, at))
+	dose.Segment = patient.Segment
+
+	dose.LimitAlert = dose.LimitReached && !d.limited[deviceName]
+	if dose.LimitReached {
+		d.limited[deviceName] = true
+	} else if dose.Units > 0 {
+		delete(d.limited, deviceName)
+	}
+
+	return dose
+}
+
+// controllerFor returns the controller dosing readings from the patient's monitor. Caller must hold the lock.
+func (d *DoseCalculator) controllerFor(patient PatientProfile) Controller {
+	if patient.Controller.Type != config.ControllerPID {
+		delete(d.pids, patient.MonitorDevice)
+		return CorrectionController{}
+	}
+
+	pid, exists := d.pids[patient.MonitorDevice]
+	if !exists || pid.config != patient.Controller {
+		pid = NewPIDController(patient.Controller)
+		d.pids[patient.MonitorDevice] = pid
+	}
+	return pid
+}
+
+// CalculateMeal returns the dose for the named injector covering a meal of the given grams of carbohydrate, given
+// the current glucose from the named monitor. Reaching a delivery limit does not raise the limit reached alert,
+// the meal is refused to whoever announced it.
+func (d *DoseCalculator) CalculateMeal(monitorDevice string, deviceName string, carbs float64, glucose float64, at time.Time) DoseCalculation {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	patient := d.patients.ForMonitor(monitorDevice).At(at)
+	dose := CalculateMealDose(carbs, glucose, patient.Insulin, d.insulinOnBoard.Active(deviceName, at),
+		d.insulinOnBoard.Delivered(deviceName, time.Hour, at), d.insulinOnBoard.Delivered(deviceName, 24*time.Hour, at))
+	dose.Segment = patient.Segment
+	return dose
+}
+
+// CheckBolus checks a manually requested dose for the named injector against the insulin limits of the patient
+// wearing the named monitor.
+func (d *DoseCalculator) CheckBolus(monitorDevice string, deviceName string, units float64, at time.Time) BolusCheck {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return CheckBolus(units, d.patients.ForMonitor(monitorDevice).At(at).Insulin, d.insulinOnBoard.Active(deviceName, at),
+		d.insulinOnBoard.Delivered(deviceName, time.Hour, at), d.insulinOnBoard.Delivered(deviceName, 24*time.Hour, at))
+}
+
+// Actuation returns the injector command that delivers the given units at the pump rate of the given insulin
+// configuration, which is that of the patient the injector delivers to.
+func (d *DoseCalculator) Actuation(insulin config.InsulinConfig, units float64) Actuation {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return NewActuation(d.injector, insulin, units)
+}
+
+// raiseLimitAlert alerts that the automatic correction dose was refused because a delivery limit has been reached.
+func (d *DoseCalculator) raiseLimitAlert(monitorDevice string, deviceName string, dose DoseCalculation) {
+	d.lc.Warnf("Insulin actuation by %s refused, %s (%.2f units in the last hour, %.2f units in 24 hours)",
+		deviceName, dose.Reason, dose.HourlyUnits, dose.DailyUnits)
+
+	patient := d.patients.ForMonitor(monitorDevice)
+	sendNotification(d.lc, dtos.Notification{
+		Sender:   "Insulin-Injector-Device",
+		Category: LimitReachedCategory,
+		Severity: models.Critical,
+		Content: fmt.Sprintf("Insulin delivery by %s refused, %s - glucose %s", deviceName, dose.Reason,
+			patient.FormatGlucose(dose.Glucose)),
+		Labels:      patient.Labels("insulin", deviceName, monitorDevice),
+		Status:      "NEW",
+		ContentType: "json",
+		Description: "Insulin injector '" + deviceName + "' delivery limit reached",
+	})
+
+	message := fmt.Sprintf("Insulin not delivered, %s, current glucose - %s", dose.Reason, patient.FormatGlucose(dose.Glucose))
+	if _, err := PostAlertData(NewAlertData(patient.Asset, dose.Glucose, message)); err != nil {
+		d.lc.Errorf("unable to post delivery limit alert: %s", err.Error())
+	}
+}
@@ -0,0 +1,282 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/clients/logger"
+	"github.com/stretchr/testify/assert"
+
+	"app-insulin-service/config"
+)
+
+func TestCalculateCorrectionDose(t *testing.T) {
+	insulin := testInsulinConfig(config.DecayCurveLinear)
+
+	tests := []struct {
+		Name            string
+		Glucose         float64
+		OnBoard         float64
+		Hourly          float64
+		Daily           float64
+		ExpectedUnits   float64
+		ExpectedReason  string
+		ExpectedCorrect float64
+		ExpectedLimit   bool
+	}{
+		{"Full correction", 170, 0, 0, 0, 1.2, "", 1.2, false},
+		{"Reduced by insulin on board", 170, 0.5, 0, 0, 0.7, "", 1.2, false},
+		{"Covered by insulin on board", 170, 1.5, 0, 0, 0, "insulin on board covers the correction", 1.2, false},
+		{"At target", 110, 0, 0, 0, 0, "glucose is at or below target", 0, false},
+		{"Below target", 80, 0, 0, 0, 0, "glucose is at or below target", -0.6, false},
+		{"Limited to maximum dose", 310, 0, 0, 0, 2, "limited to maximum dose", 4, false},
+		{"Limited by maximum on board", 310, 1.5, 0, 0, 1.5, "limited by maximum insulin on board", 4, false},
+		{"Below minimum dose", 112, 0, 0, 0, 0, "dose is below the minimum deliverable dose", 0.04, false},
+		{"Rounded down", 111.9, 0, 0, 0, 0, "dose is below the minimum deliverable dose", 0.038, false},
+		{"Limited by hourly limit", 170, 0, 3.5, 3.5, 0.5, "limited by hourly delivery limit", 1.2, false},
+		{"Limited by daily limit", 170, 0, 0, 19.3, 0.7, "limited by daily delivery limit", 1.2, false},
+		{"Hourly limit reached", 170, 0, 4, 4, 0, "hourly delivery limit reached", 1.2, true},
+		{"Daily limit reached", 170, 0, 0, 19.98, 0, "daily delivery limit reached", 1.2, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			actual := CalculateCorrectionDose(test.Glucose, insulin, test.OnBoard, test.Hourly, test.Daily)
+			assert.InDelta(t, test.ExpectedUnits, actual.Units, 0.0001)
+			assert.InDelta(t, test.ExpectedCorrect, actual.CorrectionUnits, 0.0001)
+			assert.Equal(t, test.ExpectedReason, actual.Reason)
+			assert.Equal(t, test.ExpectedLimit, actual.LimitReached)
+			assert.Equal(t, test.OnBoard, actual.InsulinOnBoard)
+			assert.Equal(t, test.Hourly, actual.HourlyUnits)
+			assert.Equal(t, test.Daily, actual.DailyUnits)
+		})
+	}
+}
+
+func TestCalculateMealDose(t *testing.T) {
+	insulin := testInsulinConfig(config.DecayCurveLinear)
+
+	tests := []struct {
+		Name           string
+		Carbs          float64
+		Glucose        float64
+		OnBoard        float64
+		ExpectedUnits  float64
+		ExpectedMeal   float64
+		ExpectedReason string
+	}{
+		{"Meal at target", 15, 110, 0, 1.5, 1.5, ""},
+		{"Meal with correction", 10, 160, 0, 2, 1, ""},
+		{"On board offsets the correction only", 10, 160, 1.5, 1, 1, ""},
+		{"Below target reduces the meal", 10, 85, 0, 0.5, 1, ""},
+		{"Below target covers the meal", 5, 60, 0, 0, 0.5, "glucose below target covers the meal"},
+		{"Limited to maximum dose", 50, 110, 0, 2, 5, "limited to maximum dose"},
+		{"Limited by maximum on board", 15, 110, 2, 1, 1.5, "limited by maximum insulin on board"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			actual := CalculateMealDose(test.Carbs, test.Glucose, insulin, test.OnBoard, 0, 0)
+			assert.InDelta(t, test.ExpectedUnits, actual.Units, 0.0001)
+			assert.InDelta(t, test.ExpectedMeal, actual.MealUnits, 0.0001)
+			assert.Equal(t, test.ExpectedReason, actual.Reason)
+			assert.Equal(t, test.Carbs, actual.Carbs)
+			assert.Equal(t, insulin.CarbRatio, actual.CarbRatio)
+		})
+	}
+
+	insulin.CarbRatio = 0
+	actual := CalculateMealDose(30, 180, insulin, 0, 0, 0)
+	assert.Zero(t, actual.Units)
+	assert.Equal(t, "no carb ratio is configured", actual.Reason)
+}
+
+func TestCheckBolus(t *testing.T) {
+	insulin := testInsulinConfig(config.DecayCurveLinear)
+
+	tests := []struct {
+		Name            string
+		Units           float64
+		OnBoard         float64
+		Hourly          float64
+		Daily           float64
+		ExpectedReasons []string
+	}{
+		{"Within limits", 1, 1, 1, 5, nil},
+		{"Up to every limit", 2, 1, 2, 18, nil},
+		{"Zero", 0, 0, 0, 0, []string{"dose must be greater than zero"}},
+		{"Thousandths", 0.125, 0, 0, 0, []string{"dose must be in hundredths of a unit"}},
+		{"Below minimum", 0.01, 0, 0, 0, []string{"dose is below the minimum deliverable dose of 0.05 units"}},
+		{"Above maximum", 2.5, 0, 0, 0, []string{"dose exceeds the maximum dose of 2.00 units"}},
+		{"Insulin on board", 1, 2.5, 0, 0, []string{"dose would raise insulin on board to 3.50 units, above the maximum of 3.00 units"}},
+		{"Hourly and daily", 1, 0, 3.5, 19.5, []string{
+			"dose would raise delivery in the last hour to 4.50 units, above the maximum of 4.00 units",
+			"dose would raise delivery in the last 24 hours to 20.50 units, above the maximum of 20.00 units",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			actual := CheckBolus(test.Units, insulin, test.OnBoard, test.Hourly, test.Daily)
+			assert.Equal(t, test.ExpectedReasons, actual.Reasons)
+			assert.Equal(t, BolusCheck{Units: test.Units, InsulinOnBoard: test.OnBoard, HourlyUnits: test.Hourly, DailyUnits: test.Daily, Reasons: actual.Reasons}, actual)
+		})
+	}
+}
+
+func TestNewActuation(t *testing.T) {
+	insulin := testInsulinConfig(config.DecayCurveLinear)
+
+	actual := NewActuation(config.InjectorConfig{DeliveryMode: config.DeliveryModeDuration}, insulin, 1.5)
+	assert.Equal(t, "WriteBoolValue", actual.CommandName)
+	assert.Equal(t, "true", actual.Settings["Bool"])
+	assert.Equal(t, 90*time.Second, actual.StopAfter)
+
+	actual = NewActuation(config.InjectorConfig{DeliveryMode: config.DeliveryModeDose, DoseCommand: "WriteFloat32Value", DoseResource: "Float32"}, insulin, 1.5)
+	assert.Equal(t, "WriteFloat32Value", actual.CommandName)
+	assert.Equal(t, map[string]string{"Float32": "1.50"}, actual.Settings)
+	assert.Zero(t, actual.StopAfter)
+}
+
+func TestDoseCalculator_Actuation(t *testing.T) {
+	patients := newTestPatients(map[string]config.PatientConfig{
+		"patient": {MonitorDevice: "patient-monitor", InjectorDevice: "slow-injector", PumpRateUnitsPerMinute: 0.5},
+	})
+	target := NewDoseCalculator(config.InjectorConfig{DeliveryMode: config.DeliveryModeDuration},
+		logger.NewMockClient(), NewInsulinOnBoard(testInsulinConfig(config.DecayCurveLinear)), patients)
+
+	assert.Equal(t, 90*time.Second, target.Actuation(patients.ForInjector("injector").Insulin, 1.5).StopAfter)
+	assert.Equal(t, 3*time.Minute, target.Actuation(patients.ForInjector("slow-injector").Insulin, 1.5).StopAfter,
+		"delivered at the pump rate of the patient's injector")
+}
+
+func TestDoseCalculator_Calculate(t *testing.T) {
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	insulinOnBoard := NewInsulinOnBoard(testInsulinConfig(config.DecayCurveLinear))
+	target := NewDoseCalculator(config.InjectorConfig{DeliveryMode: config.DeliveryModeDuration},
+		logger.NewMockClient(), insulinOnBoard, newTestPatients(nil))
+
+	assert.InDelta(t, 1.2, target.Calculate("monitor", "injector", 170, start).Units, 0.0001)
+
+	insulinOnBoard.Record("injector", 1, start)
+	assert.InDelta(t, 0.2, target.Calculate("monitor", "injector", 170, start).Units, 0.0001)
+	assert.InDelta(t, 1.2, target.Calculate("monitor", "other-injector", 170, start).Units, 0.0001)
+}
+
+func TestDoseCalculator_CalculateLimits(t *testing.T) {
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	insulinOnBoard := NewInsulinOnBoard(testInsulinConfig(config.DecayCurveLinear))
+	patients := newTestPatients(map[string]config.PatientConfig{
+		"patient": {MonitorDevice: "patient-monitor", InjectorDevice: "injector-1", MaxHourlyUnits: 1, MaxDailyUnits: 2},
+	})
+	target := NewDoseCalculator(config.InjectorConfig{DeliveryMode: config.DeliveryModeDuration},
+		logger.NewMockClient(), insulinOnBoard, patients)
+	var alerts []string
+	target.alert = func(monitorDevice string, deviceName string, dose DoseCalculation) {
+		alerts = append(alerts, monitorDevice+" "+deviceName+" "+dose.Reason)
+	}
+
+	// Delivered 5 hours ago so no longer on board, but within the last 24 hours
+	insulinOnBoard.Record("injector-1", 1.5, start.Add(-5*time.Hour))
+
+	// The patient's own daily limit leaves 0.5 units, the default limits allow the full correction
+	dose := target.Calculate("patient-monitor", "injector-1", 170, start)
+	assert.InDelta(t, 0.5, dose.Units, 0.0001)
+	assert.Equal(t, "limited by daily delivery limit", dose.Reason)
+	assert.InDelta(t, 1.2, target.Calculate("other-monitor", "injector", 170, start).Units, 0.0001)
+	assert.Empty(t, alerts)
+
+	insulinOnBoard.Record("injector-1", 0.5, start)
+	dose = target.Calculate("patient-monitor", "injector-1", 170, start)
+	assert.Zero(t, dose.Units)
+	assert.True(t, dose.LimitReached)
+	assert.True(t, dose.LimitAlert)
+	assert.Equal(t, []string{"patient-monitor injector-1 daily delivery limit reached"}, alerts)
+
+	// Alerted once while the limit holds
+	dose = target.Calculate("patient-monitor", "injector-1", 170, start.Add(time.Minute))
+	assert.True(t, dose.LimitReached)
+	assert.False(t, dose.LimitAlert)
+	assert.Len(t, alerts, 1)
+
+	// Alerted again once a dose has been allowed since
+	later := start.Add(25 * time.Hour)
+	dose = target.Calculate("patient-monitor", "injector-1", 170, later)
+	assert.InDelta(t, 1, dose.Units, 0.0001)
+	assert.Equal(t, "limited by hourly delivery limit", dose.Reason)
+	insulinOnBoard.Record("injector-1", dose.Units, later)
+	assert.True(t, target.Calculate("patient-monitor", "injector-1", 250, later).LimitAlert)
+	assert.Equal(t, "patient-monitor injector-1 hourly delivery limit reached", alerts[1])
+}
+
+func TestDoseCalculator_CalculateSchedule(t *testing.T) {
+	insulinOnBoard := NewInsulinOnBoard(testInsulinConfig(config.DecayCurveLinear))
+	patients := newTestPatients(map[string]config.PatientConfig{
+		"patient": {MonitorDevice: "patient-monitor", InjectorDevice: "injector-1", Schedule: config.Schedule{
+			"night": {Start: "22:00", End: "06:00", TargetGlucose: 150},
+		}},
+	})
+	target := NewDoseCalculator(config.InjectorConfig{DeliveryMode: config.DeliveryModeDuration},
+		logger.NewMockClient(), insulinOnBoard, patients)
+
+	day := target.Calculate("patient-monitor", "injector-1", 170, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	assert.InDelta(t, 1.2, day.Units, 0.0001)
+	assert.Empty(t, day.Segment)
+
+	night := target.Calculate("patient-monitor", "injector-1", 170, time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC))
+	assert.InDelta(t, 0.4, night.Units, 0.0001)
+	assert.Equal(t, 150.0, night.TargetGlucose)
+	assert.Equal(t, "night", night.Segment)
+}
+
+func TestDoseCalculator_CalculateController(t *testing.T) {
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	insulinOnBoard := NewInsulinOnBoard(testInsulinConfig(config.DecayCurveLinear))
+	pid := config.ControllerConfig{Type: config.ControllerPID, Kp: 0.01, Ki: 0.001, IntegralLimit: 1}
+	patients := newTestPatients(map[string]config.PatientConfig{
+		"patient": {MonitorDevice: "pid-monitor", InjectorDevice: "injector-1", Controller: pid},
+	})
+	target := NewDoseCalculator(config.InjectorConfig{DeliveryMode: config.DeliveryModeDuration},
+		logger.NewMockClient(), insulinOnBoard, patients)
+
+	target.Observe("pid-monitor", 160, start)
+	dose := target.Calculate("pid-monitor", "injector-1", 160, start)
+	assert.Equal(t, config.ControllerPID, dose.Controller)
+	assert.InDelta(t, 0.5, dose.Units, 0.0001)
+	target.Observe("pid-monitor", 160, start.Add(5*time.Minute))
+	dose = target.Calculate("pid-monitor", "injector-1", 160, start.Add(5*time.Minute))
+	assert.InDelta(t, 0.75, dose.Units, 0.0001, "integral accumulates across readings")
+	dose = target.Calculate("pid-monitor", "injector-1", 160, start.Add(5*time.Minute))
+	assert.InDelta(t, 0.75, dose.Units, 0.0001, "only observing a reading integrates it")
+
+	dose = target.Calculate("other-monitor", "injector-2", 160, start)
+	assert.Equal(t, config.ControllerCorrection, dose.Controller)
+	assert.InDelta(t, 1, dose.Units, 0.0001)
+
+	// A configuration change starts a new controller
+	pid.Ki = 0.002
+	patients.UpdateConfig(config.AppCustomConfig{
+		Insulin:  testInsulinConfig(config.DecayCurveLinear),
+		Injector: testInjectorConfig(),
+		Patients: map[string]config.PatientConfig{"patient": {MonitorDevice: "pid-monitor", InjectorDevice: "injector-1", Controller: pid}},
+	})
+	target.Observe("pid-monitor", 160, start.Add(10*time.Minute))
+	dose = target.Calculate("pid-monitor", "injector-1", 160, start.Add(10*time.Minute))
+	assert.InDelta(t, 0.5, dose.Units, 0.0001)
+}
@@ -0,0 +1,197 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/clients/logger"
+)
+
+// Emergency stop actions recorded in the audit log
+const (
+	EmergencyStopActionStop    = "stop"
+	EmergencyStopActionRelease = "release"
+)
+
+// maxEmergencyStopEvents is how many emergency stop events are kept in the audit log
+const maxEmergencyStopEvents = 100
+
+// EmergencyStopRequest asks for one, or when DeviceName is empty all, injectors to be stopped or released.
+type EmergencyStopRequest struct {
+	DeviceName  string `json:"deviceName,omitempty"`
+	RequestedBy string `json:"requestedBy"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// EmergencyStopResult is the outcome of an emergency stop or release for a single injector.
+type EmergencyStopResult struct {
+	DeviceName string `json:"deviceName"`
+	// Confirmed is true when the injector was confirmed stopped, or for a release when it was released
+	Confirmed bool   `json:"confirmed"`
+	Error     string `json:"error,omitempty"`
+}
+
+// EmergencyStopEvent records who stopped or released which injectors, and the outcome.
+type EmergencyStopEvent struct {
+	Action        string                `json:"action"`
+	RequestedBy   string                `json:"requestedBy"`
+	Reason        string                `json:"reason,omitempty"`
+	RemoteAddress string                `json:"remoteAddress,omitempty"`
+	Time          time.Time             `json:"time"`
+	Results       []EmergencyStopResult `json:"results"`
+}
+
+// EmergencyStop halts insulin delivery on request of an operator. Stopped injectors are latched suspended, so no
+// path actuates them again until an operator releases them, and every stop and release is kept in an audit log.
+type EmergencyStop struct {
+	mutex      sync.Mutex
+	lc         logger.LoggingClient
+	injector   *InjectorCommander
+	scheduler  *StopScheduler
+	suspension *Suspension
+	patients   *Patients
+	events     []EmergencyStopEvent
+	postAlert  func(AlertData) (string, error)
+}
+
+// NewEmergencyStop creates an EmergencyStop for the injectors commanded by the given injector commander.
+func NewEmergencyStop(lc logger.LoggingClient, injector *InjectorCommander, scheduler *StopScheduler, suspension *Suspension,
+	patients *Patients) *EmergencyStop {
+	return &EmergencyStop{
+		lc:         lc,
+		injector:   injector,
+		scheduler:  scheduler,
+		suspension: suspension,
+		patients:   patients,
+		postAlert:  PostAlertData,
+	}
+}
+
+// Stop latches the requested injectors suspended, cancels their scheduled stops and stops them. An error is
+// returned if the request is invalid, otherwise the event records whether each injector was confirmed stopped.
+func (e *EmergencyStop) Stop(request EmergencyStopRequest, remoteAddress string, at time.Time) (EmergencyStopEvent, error) {
+	deviceNames, err := e.deviceNames(request)
+	if err != nil {
+		return EmergencyStopEvent{}, err
+	}
+
+	reason := "emergency stop"
+	if request.Reason != "" {
+		reason = "emergency stop, " + request.Reason
+	}
+
+	event := e.newEvent(EmergencyStopActionStop, request, remoteAddress, at)
+	for _, deviceName := range deviceNames {
+		e.lc.Warnf("Emergency stop of %s requested by %s from %s: %s", deviceName, request.RequestedBy, remoteAddress, request.Reason)
+
+		// Latch first so no path decides to actuate the injector from now on, then wait for any actuation already
+		// under way so it cannot start the injector after it is stopped
+		e.suspension.Latch(deviceName, reason, request.RequestedBy, at)
+		unlock := e.injector.Lock(deviceName)
+		e.scheduler.Cancel(deviceName)
+
+		result := EmergencyStopResult{DeviceName: deviceName, Confirmed: true}
+		if err := e.injector.Stop(deviceName); err != nil {
+			result.Confirmed = false
+			result.Error = err.Error()
+		}
+		unlock()
+		event.Results = append(event.Results, result)
+
+		message := fmt.Sprintf("Insulin emergency stop of %s by %s - %s", deviceName, request.RequestedBy, request.Reason)
+		if _, err := e.postAlert(NewAlertData(e.patients.ForInjector(deviceName).Asset, 0, message)); err != nil {
+			e.lc.Errorf("unable to post emergency stop alert: %s", err.Error())
+		}
+	}
+
+	e.record(event)
+	return event, nil
+}
+
+// Release ends the emergency stop of the requested injectors, they resume normal dosing with the next reading unless
+// still suspended for low glucose.
+func (e *EmergencyStop) Release(request EmergencyStopRequest, remoteAddress string, at time.Time) (EmergencyStopEvent, error) {
+	deviceNames, err := e.deviceNames(request)
+	if err != nil {
+		return EmergencyStopEvent{}, err
+	}
+
+	event := e.newEvent(EmergencyStopActionRelease, request, remoteAddress, at)
+	for _, deviceName := range deviceNames {
+		result := EmergencyStopResult{DeviceName: deviceName, Confirmed: e.suspension.Release(deviceName)}
+		if result.Confirmed {
+			e.lc.Warnf("Emergency stop of %s released by %s from %s", deviceName, request.RequestedBy, remoteAddress)
+		} else {
+			result.Error = "injector was not emergency stopped"
+		}
+		event.Results = append(event.Results, result)
+	}
+
+	e.record(event)
+	return event, nil
+}
+
+// Events returns the audit log of emergency stops and releases, oldest first.
+func (e *EmergencyStop) Events() []EmergencyStopEvent {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]EmergencyStopEvent(nil), e.events...)
+}
+
+// deviceNames validates the request and returns the injectors it applies to.
+func (e *EmergencyStop) deviceNames(request EmergencyStopRequest) ([]string, error) {
+	if request.RequestedBy == "" {
+		return nil, errors.New("requestedBy must be set")
+	}
+
+	configured := e.injector.DeviceNames()
+	if request.DeviceName == "" {
+		return configured, nil
+	}
+
+	for _, deviceName := range configured {
+		if deviceName == request.DeviceName {
+			return []string{deviceName}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("injector '%s' is not configured", request.DeviceName)
+}
+
+func (e *EmergencyStop) newEvent(action string, request EmergencyStopRequest, remoteAddress string, at time.Time) EmergencyStopEvent {
+	return EmergencyStopEvent{
+		Action:        action,
+		RequestedBy:   request.RequestedBy,
+		Reason:        request.Reason,
+		RemoteAddress: remoteAddress,
+		Time:          at,
+	}
+}
+
+func (e *EmergencyStop) record(event EmergencyStopEvent) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.events = append(e.events, event)
+	if len(e.events) > maxEmergencyStopEvents {
+		e.events = e.events[len(e.events)-maxEmergencyStopEvents:]
+	}
+}
@@ -0,0 +1,158 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/clients/interfaces/mocks"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/clients/logger"
+	dtoCommon "github.com/edgexfoundry/go-mod-core-contracts/v3/dtos/common"
+	edgexErrors "github.com/edgexfoundry/go-mod-core-contracts/v3/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestEmergencyStop(client *mocks.CommandClient) (*EmergencyStop, *StopScheduler, *Suspension, *[]string) {
+	injector, _, escalated := newTestInjectorCommander(client)
+	scheduler := NewStopScheduler("")
+	suspension := NewSuspension(90)
+	target := NewEmergencyStop(logger.NewMockClient(), injector, scheduler, suspension, newTestPatients(nil))
+	target.postAlert = func(AlertData) (string, error) { return "", nil }
+	return target, scheduler, suspension, escalated
+}
+
+func TestEmergencyStop_Stop(t *testing.T) {
+	client := &mocks.CommandClient{}
+	client.On("IssueSetCommandByName", mock.Anything, "injector", "WriteBoolValue", mock.Anything).
+		Return(dtoCommon.NewBaseResponse("", "", 200), nil)
+	client.On("IssueGetCommandByName", mock.Anything, "injector", "Bool", false, true).
+		Return(readBackResponse("Bool", "false"), nil)
+	target, scheduler, suspension, _ := newTestEmergencyStop(client)
+
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	require.NoError(t, scheduler.Schedule("injector", time.Hour, func() {}))
+
+	event, err := target.Stop(EmergencyStopRequest{RequestedBy: "nurse", Reason: "patient unwell"}, "10.0.0.5", now)
+	require.NoError(t, err)
+	assert.Equal(t, EmergencyStopEvent{
+		Action:        EmergencyStopActionStop,
+		RequestedBy:   "nurse",
+		Reason:        "patient unwell",
+		RemoteAddress: "10.0.0.5",
+		Time:          now,
+		Results:       []EmergencyStopResult{{DeviceName: "injector", Confirmed: true}},
+	}, event)
+
+	assert.False(t, scheduler.Pending("injector"), "scheduled stop cancelled")
+	assert.True(t, suspension.IsSuspended("injector"))
+	assert.False(t, suspension.Observe("injector", 200), "stays latched when glucose is high")
+
+	event, err = target.Release(EmergencyStopRequest{DeviceName: "injector", RequestedBy: "doctor"}, "10.0.0.6", now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []EmergencyStopResult{{DeviceName: "injector", Confirmed: true}}, event.Results)
+	assert.False(t, suspension.IsSuspended("injector"))
+
+	events := target.Events()
+	require.Len(t, events, 2)
+	assert.Equal(t, EmergencyStopActionStop, events[0].Action)
+	assert.Equal(t, EmergencyStopActionRelease, events[1].Action)
+	assert.Equal(t, "doctor", events[1].RequestedBy)
+}
+
+func TestEmergencyStop_Stop_NotConfirmed(t *testing.T) {
+	client := &mocks.CommandClient{}
+	client.On("IssueSetCommandByName", mock.Anything, "injector", "WriteBoolValue", mock.Anything).
+		Return(dtoCommon.BaseResponse{}, edgexErrors.NewCommonEdgeXWrapper(errors.New("device unreachable")))
+	target, _, suspension, escalated := newTestEmergencyStop(client)
+
+	event, err := target.Stop(EmergencyStopRequest{DeviceName: "injector", RequestedBy: "nurse"}, "", time.Now())
+	require.NoError(t, err)
+	require.Len(t, event.Results, 1)
+	assert.False(t, event.Results[0].Confirmed)
+	assert.Contains(t, event.Results[0].Error, "device unreachable")
+	assert.Equal(t, []string{"injector"}, *escalated)
+	assert.True(t, suspension.IsSuspended("injector"), "latched even when the stop is not confirmed")
+}
+
+func TestEmergencyStop_InvalidRequest(t *testing.T) {
+	target, _, _, _ := newTestEmergencyStop(&mocks.CommandClient{})
+
+	_, err := target.Stop(EmergencyStopRequest{}, "", time.Now())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "requestedBy must be set")
+
+	_, err = target.Stop(EmergencyStopRequest{DeviceName: "pump", RequestedBy: "nurse"}, "", time.Now())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "injector 'pump' is not configured")
+
+	event, err := target.Release(EmergencyStopRequest{RequestedBy: "nurse"}, "", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, []EmergencyStopResult{{DeviceName: "injector", Error: "injector was not emergency stopped"}}, event.Results)
+	assert.Len(t, target.Events(), 1, "invalid requests are not recorded")
+}
+
+func TestEmergencyStop_Stop_DuringActuation(t *testing.T) {
+	starting := make(chan struct{})
+	proceed := make(chan struct{})
+	injector := &fakeInjector{starting: func() {
+		close(starting)
+		<-proceed
+	}}
+	bolus, _, suspension, history := newTestManualBolus(injector.client())
+	target := NewEmergencyStop(logger.NewMockClient(), bolus.injector, bolus.scheduler, suspension, bolus.patients)
+	target.postAlert = func(AlertData) (string, error) { return "", nil }
+
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	history.Add("monitor", 180, now)
+
+	delivered := make(chan BolusResponse)
+	go func() {
+		delivered <- bolus.Request(BolusRequest{DeviceName: "injector", Units: 1, RequestedBy: "nurse"}, now)
+	}()
+	<-starting
+
+	stopped := make(chan EmergencyStopEvent)
+	go func() {
+		event, _ := target.Stop(EmergencyStopRequest{RequestedBy: "nurse"}, "", now)
+		stopped <- event
+	}()
+
+	// Latched at once, but the stop waits for the actuation already under way
+	assert.Eventually(t, func() bool { return suspension.IsSuspended("injector") }, time.Second, time.Millisecond)
+	select {
+	case <-stopped:
+		t.Fatal("emergency stop did not wait for the actuation under way")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(proceed)
+
+	assert.True(t, (<-delivered).Delivered)
+	event := <-stopped
+	assert.Equal(t, []EmergencyStopResult{{DeviceName: "injector", Confirmed: true}}, event.Results)
+
+	on, commands := injector.state()
+	assert.False(t, on, "injector left stopped")
+	assert.Equal(t, []string{"start", "stop"}, commands)
+	assert.False(t, bolus.scheduler.Pending("injector"), "stop scheduled by the actuation cancelled")
+
+	response := bolus.Request(BolusRequest{DeviceName: "injector", Units: 1, RequestedBy: "nurse"}, now.Add(time.Hour))
+	assert.Contains(t, response.Reasons, "insulin delivery is suspended")
+}
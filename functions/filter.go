@@ -0,0 +1,159 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	gometrics "github.com/rcrowley/go-metrics"
+
+	"app-insulin-service/config"
+)
+
+// GlucoseReadingsRejectedName is the name of the metric counting glucose readings rejected as outliers
+const GlucoseReadingsRejectedName = "GlucoseReadingsRejected"
+
+// FilteredReading is a glucose reading after filtering. Value is acted on in place of the Raw reading.
+type FilteredReading struct {
+	Raw   float64 `json:"raw"`
+	Value float64 `json:"value"`
+	// Rejected is true when the reading was rejected as an outlier, Reason explains why
+	Rejected bool   `json:"rejected,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// filterState is the filter state of a single monitor.
+type filterState struct {
+	// window holds the most recent accepted raw readings, used by the median filter
+	window []float64
+	// estimate and variance are the Kalman filter state
+	estimate float64
+	variance float64
+	// value and time are those of the last accepted reading after filtering
+	value float64
+	time  time.Time
+	// rejected counts the consecutive readings rejected as outliers
+	rejected int
+}
+
+// GlucoseFilter filters each monitor's glucose readings before they are acted on and rejects readings changing
+// implausibly fast, so a single spurious reading cannot trigger a dose. It is shared by every path that reads glucose.
+type GlucoseFilter struct {
+	mutex    sync.Mutex
+	config   config.FilterConfig
+	states   map[string]*filterState
+	rejected gometrics.Counter
+}
+
+// NewGlucoseFilter creates a GlucoseFilter using the given, already validated, configuration.
+func NewGlucoseFilter(filter config.FilterConfig) *GlucoseFilter {
+	return &GlucoseFilter{
+		config:   filter,
+		states:   make(map[string]*filterState),
+		rejected: gometrics.NewCounter(),
+	}
+}
+
+// UpdateConfig replaces the filter configuration, restarting every monitor's filter when it changed.
+func (f *GlucoseFilter) UpdateConfig(filter config.FilterConfig) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if filter != f.config {
+		f.states = make(map[string]*filterState)
+	}
+	f.config = filter
+}
+
+// Metric returns the counter of readings rejected as outliers, for registration with the metrics manager.
+func (f *GlucoseFilter) Metric() gometrics.Counter {
+	return f.rejected
+}
+
+// Filter filters a glucose reading from the named monitor. A reading differing from the filtered glucose faster
+// than MaxRatePerMinute is rejected, unless MaxRejected readings in a row already were, in which case it is taken
+// as a real change and the filter restarts from it. The filter also restarts after a gap in readings.
+func (f *GlucoseFilter) Filter(deviceName string, raw float64, at time.Time) FilteredReading {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	reading := FilteredReading{Raw: raw}
+	state, exists := f.states[deviceName]
+	if !exists || at.Sub(state.time) > config.MaxGlucoseAgeMinutes*time.Minute {
+		state = &filterState{}
+		f.states[deviceName] = state
+	}
+
+	if !state.time.IsZero() && f.config.MaxRatePerMinute > 0 {
+		minutes := math.Max(at.Sub(state.time).Minutes(), 1)
+		if rate := math.Abs(raw-state.value) / minutes; rate > f.config.MaxRatePerMinute {
+			if state.rejected < f.config.MaxRejected {
+				state.rejected++
+				f.rejected.Inc(1)
+				reading.Rejected = true
+				reading.Reason = fmt.Sprintf("changed %.1f mg/dL per minute from %.0f, more than %v",
+					rate, state.value, f.config.MaxRatePerMinute)
+				return reading
+			}
+			// Persistently different readings are a real change, start again from this reading
+			*state = filterState{}
+		}
+	}
+	state.rejected = 0
+
+	switch f.config.Type {
+	case config.FilterMedian:
+		state.window = append(state.window, raw)
+		if len(state.window) > f.config.WindowSize {
+			state.window = state.window[len(state.window)-f.config.WindowSize:]
+		}
+		reading.Value = median(state.window)
+	case config.FilterKalman:
+		if state.time.IsZero() {
+			state.estimate = raw
+			state.variance = f.config.MeasurementNoise
+		} else {
+			state.variance += f.config.ProcessNoise * math.Max(at.Sub(state.time).Minutes(), 0)
+			gain := state.variance / (state.variance + f.config.MeasurementNoise)
+			state.estimate += gain * (raw - state.estimate)
+			state.variance *= 1 - gain
+		}
+		reading.Value = state.estimate
+	default:
+		reading.Value = raw
+	}
+
+	state.value = reading.Value
+	state.time = at
+	return reading
+}
+
+// median returns the median of the values.
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
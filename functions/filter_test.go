@@ -0,0 +1,78 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"app-insulin-service/config"
+)
+
+func TestGlucoseFilter_Filter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		Name             string
+		Config           config.FilterConfig
+		Raw              []float64
+		ExpectedValues   []float64
+		ExpectedRejected []bool
+	}{
+		{"None", config.FilterConfig{Type: config.FilterNone}, []float64{100, 250, 110}, []float64{100, 250, 110}, []bool{false, false, false}},
+		{"Median", config.FilterConfig{Type: config.FilterMedian, WindowSize: 3}, []float64{100, 250, 110, 120}, []float64{100, 175, 110, 120}, []bool{false, false, false, false}},
+		{"Kalman", config.FilterConfig{Type: config.FilterKalman, ProcessNoise: 1, MeasurementNoise: 10}, []float64{100, 110}, []float64{100, 106}, []bool{false, false}},
+		{"Spike rejected", config.FilterConfig{MaxRatePerMinute: 5, MaxRejected: 2}, []float64{100, 250, 105}, []float64{100, 0, 105}, []bool{false, true, false}},
+		{"Persistent change accepted", config.FilterConfig{MaxRatePerMinute: 5, MaxRejected: 2}, []float64{100, 250, 252, 255, 257}, []float64{100, 0, 0, 255, 257}, []bool{false, true, true, false, false}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			target := NewGlucoseFilter(test.Config)
+			for index, raw := range test.Raw {
+				actual := target.Filter("monitor", raw, start.Add(time.Duration(index)*5*time.Minute))
+				assert.Equal(t, raw, actual.Raw)
+				assert.InDelta(t, test.ExpectedValues[index], actual.Value, 0.0001, "reading %d", index)
+				assert.Equal(t, test.ExpectedRejected[index], actual.Rejected, "reading %d", index)
+			}
+			// Other monitors are filtered separately
+			assert.Equal(t, 300.0, target.Filter("other-monitor", 300, start).Value)
+		})
+	}
+}
+
+func TestGlucoseFilter_Reset(t *testing.T) {
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	target := NewGlucoseFilter(config.FilterConfig{Type: config.FilterMedian, WindowSize: 3, MaxRatePerMinute: 5, MaxRejected: 1})
+
+	target.Filter("monitor", 100, start)
+	actual := target.Filter("monitor", 200, start.Add(5*time.Minute))
+	assert.True(t, actual.Rejected)
+	assert.Equal(t, "changed 20.0 mg/dL per minute from 100, more than 5", actual.Reason)
+	assert.Equal(t, int64(1), target.Metric().Count())
+
+	// A gap in readings restarts the filter
+	actual = target.Filter("monitor", 200, start.Add(time.Hour))
+	assert.False(t, actual.Rejected)
+	assert.Equal(t, 200.0, actual.Value)
+
+	// As does a configuration change
+	target.UpdateConfig(config.FilterConfig{Type: config.FilterMedian, WindowSize: 5})
+	assert.Equal(t, 100.0, target.Filter("monitor", 100, start.Add(time.Hour+5*time.Minute)).Value)
+}
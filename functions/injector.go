@@ -0,0 +1,245 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	clientInterfaces "github.com/edgexfoundry/go-mod-core-contracts/v3/clients/interfaces"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/clients/logger"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/dtos"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/models"
+
+	"app-insulin-service/config"
+)
+
+// InjectorFaultCategory is the notification category used when an injector cannot be confirmed stopped
+const InjectorFaultCategory = "INJECTOR-FAULT"
+
+// randomizationPrefix marks the settings that configure the virtual device rather than the injector state
+const randomizationPrefix = "EnableRandomization_"
+
+// InjectorCommander sends commands to insulin injectors and confirms each one took effect by reading back the
+// injector state, retrying with bounded backoff when it did not. An alert is escalated when an injector cannot be
+// confirmed stopped. It is shared by every path that actuates an injector.
+type InjectorCommander struct {
+	mutex         sync.RWMutex
+	config        config.InjectorConfig
+	locks         map[string]*sync.Mutex
+	lc            logger.LoggingClient
+	commandClient clientInterfaces.CommandClient
+	patients      *Patients
+	sleep         func(time.Duration)
+	escalate      func(deviceName string, err error)
+}
+
+// NewInjectorCommander creates an InjectorCommander using the given, already validated, injector configuration for
+// the injectors of the given patients.
+func NewInjectorCommander(injector config.InjectorConfig, lc logger.LoggingClient, commandClient clientInterfaces.CommandClient,
+	patients *Patients) *InjectorCommander {
+	commander := &InjectorCommander{
+		config:        injector,
+		lc:            lc,
+		commandClient: commandClient,
+		patients:      patients,
+		locks:         make(map[string]*sync.Mutex),
+		sleep:         time.Sleep,
+	}
+	commander.escalate = commander.raiseFault
+	return commander
+}
+
+// UpdateConfig replaces the injector configuration.
+func (c *InjectorCommander) UpdateConfig(injector config.InjectorConfig) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.config = injector
+}
+
+// DeviceName returns the name of the default injector.
+func (c *InjectorCommander) DeviceName() string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.config.DeviceName
+}
+
+// DeviceNames returns the names of every configured injector, the default injector first.
+func (c *InjectorCommander) DeviceNames() []string {
+	return c.patients.Injectors()
+}
+
+// IsConfigured reports whether the named injector is configured.
+func (c *InjectorCommander) IsConfigured(deviceName string) bool {
+	for _, configured := range c.DeviceNames() {
+		if configured == deviceName {
+			return true
+		}
+	}
+	return false
+}
+
+// Lock takes the lock of the named injector and returns the function that releases it. Paths that actuate an
+// injector hold its lock from the checks that allow the actuation until the actuation is complete, paths that stop
+// an injector for safety suspend it first and then take the lock, so an actuation already under way when the
+// injector is suspended is always followed by the stop. A lock is kept for every name locked, so only configured
+// injectors are locked.
+func (c *InjectorCommander) Lock(deviceName string) func() {
+	c.mutex.Lock()
+	lock, exists := c.locks[deviceName]
+	if !exists {
+		lock = &sync.Mutex{}
+		c.locks[deviceName] = lock
+	}
+	c.mutex.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// Start sends the actuation command to the named injector and confirms the injector accepted it.
+func (c *InjectorCommander) Start(deviceName string, actuation Actuation) error {
+	return c.issue(deviceName, actuation.CommandName, actuation.Settings)
+}
+
+// Stop switches the named injector off and confirms it stopped. An alert is escalated if it cannot be confirmed.
+func (c *InjectorCommander) Stop(deviceName string) error {
+	c.lc.Infof("Sending Insulin stop command to %s...", deviceName)
+
+	settings := map[string]string{
+		"Bool":                     "false",
+		"EnableRandomization_Bool": "false",
+	}
+	if err := c.issue(deviceName, "WriteBoolValue", settings); err != nil {
+		c.escalate(deviceName, err)
+		return err
+	}
+
+	return nil
+}
+
+// issue sends the command and reads back the injector state, retrying with doubling backoff, up to the maximum,
+// until the injector state matches the settings or the attempts are used up.
+func (c *InjectorCommander) issue(deviceName string, commandName string, settings map[string]string) error {
+	c.mutex.RLock()
+	attempts := c.config.CommandAttempts
+	backoff := time.Duration(c.config.RetryBackoffMillis) * time.Millisecond
+	maxBackoff := time.Duration(c.config.MaxRetryBackoffMillis) * time.Millisecond
+	c.mutex.RUnlock()
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = c.issueOnce(deviceName, commandName, settings); err == nil {
+			return nil
+		}
+
+		if attempt == attempts {
+			break
+		}
+
+		c.lc.Warnf("Command %s to %s not confirmed (attempt %d of %d), retrying in %s: %s",
+			commandName, deviceName, attempt, attempts, backoff, err.Error())
+		c.sleep(backoff)
+		backoff = min(backoff*2, maxBackoff)
+	}
+
+	return fmt.Errorf("command %s to %s not confirmed after %d attempts: %s", commandName, deviceName, attempts, err.Error())
+}
+
+// issueOnce sends the command, checks the response and reads back every injector resource that was set.
+func (c *InjectorCommander) issueOnce(deviceName string, commandName string, settings map[string]string) error {
+	response, err := c.commandClient.IssueSetCommandByName(context.Background(), deviceName, commandName, settings)
+	if err != nil {
+		return fmt.Errorf("set command failed: %s", err.Error())
+	}
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("set command returned status %d: %s", response.StatusCode, response.Message)
+	}
+
+	for resourceName, expected := range settings {
+		if strings.HasPrefix(resourceName, randomizationPrefix) {
+			continue
+		}
+
+		actual, err := c.readBack(deviceName, resourceName)
+		if err != nil {
+			return err
+		}
+		if !sameValue(expected, actual) {
+			return fmt.Errorf("read back %s is '%s', expected '%s'", resourceName, actual, expected)
+		}
+	}
+
+	return nil
+}
+
+// readBack returns the current value of the named injector resource.
+func (c *InjectorCommander) readBack(deviceName string, resourceName string) (string, error) {
+	response, err := c.commandClient.IssueGetCommandByName(context.Background(), deviceName, resourceName, false, true)
+	if err != nil {
+		return "", fmt.Errorf("read back of %s failed: %s", resourceName, err.Error())
+	}
+	if response == nil {
+		return "", fmt.Errorf("read back of %s returned no event", resourceName)
+	}
+
+	for _, reading := range response.Event.Readings {
+		if reading.ResourceName == resourceName {
+			return reading.Value, nil
+		}
+	}
+
+	return "", fmt.Errorf("read back of %s returned no %s reading", resourceName, resourceName)
+}
+
+// raiseFault alerts that the injector cannot be confirmed stopped and may still be delivering insulin.
+func (c *InjectorCommander) raiseFault(deviceName string, err error) {
+	c.lc.Errorf("Insulin injector %s could not be confirmed stopped: %s", deviceName, err.Error())
+
+	patient := c.patients.ForInjector(deviceName)
+	sendNotification(c.lc, dtos.Notification{
+		Sender:      "Insulin-Injector-Device",
+		Category:    InjectorFaultCategory,
+		Severity:    models.Critical,
+		Content:     "Insulin injector " + deviceName + " could not be confirmed stopped - " + err.Error(),
+		Labels:      patient.Labels("insulin", deviceName),
+		Status:      "NEW",
+		ContentType: "json",
+		Description: "Insulin injector '" + deviceName + "' fault",
+	})
+
+	message := fmt.Sprintf("Insulin injector %s could not be confirmed stopped, check the patient", deviceName)
+	if _, err := PostAlertData(NewAlertData(patient.Asset, 0, message)); err != nil {
+		c.lc.Errorf("unable to post injector fault alert: %s", err.Error())
+	}
+}
+
+// sameValue compares a commanded and read back value, numerically when both are numbers since devices may format
+// them differently, e.g. "1.50" and "1.500000e+00".
+func sameValue(expected string, actual string) bool {
+	expectedNumber, expectedErr := strconv.ParseFloat(expected, 64)
+	actualNumber, actualErr := strconv.ParseFloat(actual, 64)
+	if expectedErr == nil && actualErr == nil {
+		return float32(expectedNumber) == float32(actualNumber)
+	}
+
+	return strings.EqualFold(expected, actual)
+}
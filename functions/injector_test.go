@@ -0,0 +1,171 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/clients/interfaces/mocks"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/clients/logger"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/dtos"
+	dtoCommon "github.com/edgexfoundry/go-mod-core-contracts/v3/dtos/common"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/dtos/responses"
+	edgexErrors "github.com/edgexfoundry/go-mod-core-contracts/v3/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"app-insulin-service/config"
+)
+
+func testInjectorConfig() config.InjectorConfig {
+	return config.InjectorConfig{
+		DeviceName:            "injector",
+		DeliveryMode:          config.DeliveryModeDuration,
+		PendingStopsFile:      "stops.json",
+		CommandAttempts:       3,
+		RetryBackoffMillis:    100,
+		MaxRetryBackoffMillis: 150,
+	}
+}
+
+// newTestInjectorCommander returns a commander that records its backoff waits and escalations instead of
+// sleeping and alerting.
+func newTestInjectorCommander(client *mocks.CommandClient) (*InjectorCommander, *[]time.Duration, *[]string) {
+	var waits []time.Duration
+	var escalated []string
+	target := NewInjectorCommander(testInjectorConfig(), logger.NewMockClient(), client, newTestPatients(nil))
+	target.sleep = func(wait time.Duration) { waits = append(waits, wait) }
+	target.escalate = func(deviceName string, _ error) { escalated = append(escalated, deviceName) }
+	return target, &waits, &escalated
+}
+
+func readBackResponse(resourceName string, value string) *responses.EventResponse {
+	event := dtos.Event{Readings: []dtos.BaseReading{{ResourceName: resourceName, SimpleReading: dtos.SimpleReading{Value: value}}}}
+	response := responses.NewEventResponse("", "", 200, event)
+	return &response
+}
+
+// fakeInjector is an injector that switches on and off as commanded, recording the commands it receives.
+type fakeInjector struct {
+	mutex    sync.Mutex
+	on       bool
+	commands []string
+	// starting, when set, is called as each start command is received, before the injector switches on
+	starting func()
+}
+
+// client returns a command client commanding the fake injector.
+func (f *fakeInjector) client() *mocks.CommandClient {
+	client := &mocks.CommandClient{}
+	client.On("IssueSetCommandByName", mock.Anything, mock.Anything, "WriteBoolValue", mock.Anything).
+		Return(func(_ context.Context, _ string, _ string, settings map[string]string) dtoCommon.BaseResponse {
+			on := settings["Bool"] == "true"
+			if on && f.starting != nil {
+				f.starting()
+			}
+
+			f.mutex.Lock()
+			defer f.mutex.Unlock()
+			f.on = on
+			if on {
+				f.commands = append(f.commands, "start")
+			} else {
+				f.commands = append(f.commands, "stop")
+			}
+			return dtoCommon.NewBaseResponse("", "", 200)
+		}, nil)
+	client.On("IssueGetCommandByName", mock.Anything, mock.Anything, "Bool", false, true).
+		Return(func(context.Context, string, string, bool, bool) *responses.EventResponse {
+			f.mutex.Lock()
+			defer f.mutex.Unlock()
+			return readBackResponse("Bool", strconv.FormatBool(f.on))
+		}, nil)
+	return client
+}
+
+// state returns whether the fake injector is on and the commands it has received.
+func (f *fakeInjector) state() (bool, []string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.on, append([]string(nil), f.commands...)
+}
+
+func TestInjectorCommander_Start(t *testing.T) {
+	client := &mocks.CommandClient{}
+	client.On("IssueSetCommandByName", mock.Anything, "injector", "WriteFloat32Value", map[string]string{"Float32": "1.50"}).
+		Return(dtoCommon.NewBaseResponse("", "", 200), nil)
+	client.On("IssueGetCommandByName", mock.Anything, "injector", "Float32", false, true).
+		Return(readBackResponse("Float32", "1.500000e+00"), nil)
+	target, waits, escalated := newTestInjectorCommander(client)
+
+	actuation := NewActuation(config.InjectorConfig{DeliveryMode: config.DeliveryModeDose, DoseCommand: "WriteFloat32Value", DoseResource: "Float32"},
+		config.InsulinConfig{}, 1.5)
+	require.NoError(t, target.Start("injector", actuation))
+	assert.Empty(t, *waits)
+	assert.Empty(t, *escalated)
+	client.AssertNumberOfCalls(t, "IssueSetCommandByName", 1)
+}
+
+func TestInjectorCommander_Stop_Retried(t *testing.T) {
+	client := &mocks.CommandClient{}
+	client.On("IssueSetCommandByName", mock.Anything, "injector", "WriteBoolValue", mock.Anything).
+		Return(dtoCommon.NewBaseResponse("", "", 200), nil)
+	client.On("IssueGetCommandByName", mock.Anything, "injector", "Bool", false, true).
+		Return(readBackResponse("Bool", "true"), nil).Once()
+	client.On("IssueGetCommandByName", mock.Anything, "injector", "Bool", false, true).
+		Return(readBackResponse("Bool", "false"), nil).Once()
+	target, waits, escalated := newTestInjectorCommander(client)
+
+	require.NoError(t, target.Stop("injector"))
+	assert.Equal(t, []time.Duration{100 * time.Millisecond}, *waits)
+	assert.Empty(t, *escalated)
+	client.AssertNumberOfCalls(t, "IssueSetCommandByName", 2)
+}
+
+func TestInjectorCommander_Stop_Escalated(t *testing.T) {
+	client := &mocks.CommandClient{}
+	client.On("IssueSetCommandByName", mock.Anything, "injector", "WriteBoolValue", mock.Anything).
+		Return(dtoCommon.BaseResponse{}, edgexErrors.NewCommonEdgeXWrapper(errors.New("device unreachable")))
+	target, waits, escalated := newTestInjectorCommander(client)
+
+	err := target.Stop("injector")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not confirmed after 3 attempts")
+	assert.Contains(t, err.Error(), "device unreachable")
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 150 * time.Millisecond}, *waits, "backoff doubles up to the maximum")
+	assert.Equal(t, []string{"injector"}, *escalated)
+	client.AssertNotCalled(t, "IssueGetCommandByName", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestInjectorCommander_Start_Rejected(t *testing.T) {
+	client := &mocks.CommandClient{}
+	client.On("IssueSetCommandByName", mock.Anything, "injector", "WriteBoolValue", mock.Anything).
+		Return(dtoCommon.NewBaseResponse("", "device locked", 423), nil)
+	target, _, escalated := newTestInjectorCommander(client)
+	target.UpdateConfig(config.InjectorConfig{CommandAttempts: 1, RetryBackoffMillis: 100, MaxRetryBackoffMillis: 100})
+
+	err := target.Start("injector", NewActuation(testInjectorConfig(), testInsulinConfig(config.DecayCurveLinear), 1))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "set command returned status 423: device locked")
+	assert.Empty(t, *escalated, "only an unconfirmed stop is escalated")
+}
@@ -0,0 +1,210 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"app-insulin-service/config"
+)
+
+// Dose is a single delivery of insulin by an injector.
+type Dose struct {
+	Units float64   `json:"units"`
+	Time  time.Time `json:"time"`
+}
+
+// InsulinOnBoardStatus reports the insulin still active for an injector.
+type InsulinOnBoardStatus struct {
+	DeviceName  string  `json:"deviceName"`
+	ActiveUnits float64 `json:"activeUnits"`
+	Doses       []Dose  `json:"doses"`
+}
+
+// deliveryHistory is how long doses are kept once no longer active, so delivery totals can be checked against limits
+const deliveryHistory = 24 * time.Hour
+
+// InsulinOnBoard records every insulin delivery per injector and models how much of it is still active,
+// so new doses can be reduced or suppressed rather than stacked on top of insulin already delivered.
+// It also reports the insulin delivered over recent periods for checking delivery limits.
+// It is shared by every path that actuates an injector.
+type InsulinOnBoard struct {
+	mutex  sync.Mutex
+	config config.InsulinConfig
+	doses  map[string][]Dose
+}
+
+// NewInsulinOnBoard creates an InsulinOnBoard tracker using the given, already validated, insulin configuration.
+func NewInsulinOnBoard(insulin config.InsulinConfig) *InsulinOnBoard {
+	return &InsulinOnBoard{
+		config: insulin,
+		doses:  make(map[string][]Dose),
+	}
+}
+
+// UpdateConfig replaces the insulin configuration. Recorded doses are kept.
+func (i *InsulinOnBoard) UpdateConfig(insulin config.InsulinConfig) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.config = insulin
+}
+
+// Record adds a dose delivered by the named injector at the given time.
+func (i *InsulinOnBoard) Record(deviceName string, units float64, at time.Time) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.doses[deviceName] = append(i.doses[deviceName], Dose{Units: units, Time: at})
+}
+
+// Reserve records a dose the named injector is about to deliver, so it counts against the delivery limits of every
+// dose calculated while the injector is being actuated. A reservation whose actuation fails is released.
+func (i *InsulinOnBoard) Reserve(deviceName string, units float64, at time.Time) Dose {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	dose := Dose{Units: units, Time: at}
+	i.doses[deviceName] = append(i.doses[deviceName], dose)
+	return dose
+}
+
+// Release removes a dose reserved for the named injector whose actuation failed.
+func (i *InsulinOnBoard) Release(deviceName string, dose Dose) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	doses := i.doses[deviceName]
+	for index := len(doses) - 1; index >= 0; index-- {
+		if doses[index] == dose {
+			i.doses[deviceName] = append(doses[:index:index], doses[index+1:]...)
+			return
+		}
+	}
+}
+
+// Active returns the insulin units still active for the named injector at the given time.
+func (i *InsulinOnBoard) Active(deviceName string, at time.Time) float64 {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.active(deviceName, at)
+}
+
+// Delivered returns the insulin units delivered by the named injector in the period up to the given time.
+// Doses are only kept for 24 hours, so longer periods are not supported.
+func (i *InsulinOnBoard) Delivered(deviceName string, period time.Duration, at time.Time) float64 {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	var total float64
+	for _, dose := range i.doses[deviceName] {
+		if at.Sub(dose.Time) < period {
+			total += dose.Units
+		}
+	}
+
+	return total
+}
+
+// Status returns the insulin on board for every injector with active doses, ordered by injector name.
+func (i *InsulinOnBoard) Status(at time.Time) []InsulinOnBoardStatus {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	names := make([]string, 0, len(i.doses))
+	for name := range i.doses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	statuses := make([]InsulinOnBoardStatus, 0, len(names))
+	duration := i.config.ActionDuration()
+	for _, name := range names {
+		active := i.active(name, at)
+
+		var doses []Dose
+		for _, dose := range i.doses[name] {
+			if at.Sub(dose.Time) < duration {
+				doses = append(doses, dose)
+			}
+		}
+		if len(doses) == 0 {
+			continue
+		}
+
+		statuses = append(statuses, InsulinOnBoardStatus{
+			DeviceName:  name,
+			ActiveUnits: active,
+			Doses:       doses,
+		})
+	}
+
+	return statuses
+}
+
+// active sums the remaining activity of each dose, dropping doses older than both the insulin action duration
+// and the delivery history. Caller must hold the lock.
+func (i *InsulinOnBoard) active(deviceName string, at time.Time) float64 {
+	duration := i.config.ActionDuration()
+	var total float64
+	var current []Dose
+	for _, dose := range i.doses[deviceName] {
+		elapsed := at.Sub(dose.Time)
+		if elapsed >= duration && elapsed >= deliveryHistory {
+			continue
+		}
+
+		current = append(current, dose)
+		if elapsed < duration {
+			total += dose.Units * i.remainingFraction(elapsed)
+		}
+	}
+
+	if len(current) == 0 {
+		delete(i.doses, deviceName)
+	} else {
+		i.doses[deviceName] = current
+	}
+
+	return total
+}
+
+// remainingFraction returns the fraction of a dose still active after the elapsed time, following the
+// configured decay curve. Caller must hold the lock.
+func (i *InsulinOnBoard) remainingFraction(elapsed time.Duration) float64 {
+	t := elapsed.Minutes()
+	duration := float64(i.config.ActionDurationMinutes)
+	if t <= 0 {
+		return 1
+	}
+	if t >= duration {
+		return 0
+	}
+
+	switch i.config.DecayCurve {
+	case config.DecayCurveExponential:
+		// Exponential insulin activity curve with a configurable peak as used by common open source
+		// artificial pancreas systems. See https://github.com/LoopKit/Loop/issues/388
+		peak := float64(i.config.PeakMinutes)
+		tau := peak * (1 - peak/duration) / (1 - 2*peak/duration)
+		a := 2 * tau / duration
+		s := 1 / (1 - a + (1+a)*math.Exp(-duration/tau))
+		return 1 - s*(1-a)*((t*t/(tau*duration*(1-a))-t/tau-1)*math.Exp(-t/tau)+1)
+	default:
+		return 1 - t/duration
+	}
+}
@@ -0,0 +1,143 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"app-insulin-service/config"
+)
+
+func TestInsulinOnBoard_Active(t *testing.T) {
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		Name     string
+		Curve    string
+		Elapsed  time.Duration
+		Expected float64
+	}{
+		{"Linear just delivered", config.DecayCurveLinear, 0, 2},
+		{"Linear half way", config.DecayCurveLinear, 2 * time.Hour, 1},
+		{"Linear expired", config.DecayCurveLinear, 4 * time.Hour, 0},
+		{"Exponential just delivered", config.DecayCurveExponential, 0, 2},
+		{"Exponential expired", config.DecayCurveExponential, 4 * time.Hour, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			target := NewInsulinOnBoard(testInsulinConfig(test.Curve))
+			target.Record("injector", 2, start)
+			assert.InDelta(t, test.Expected, target.Active("injector", start.Add(test.Elapsed)), 0.001)
+			assert.Zero(t, target.Active("other-injector", start.Add(test.Elapsed)))
+		})
+	}
+}
+
+func TestInsulinOnBoard_ReserveRelease(t *testing.T) {
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	target := NewInsulinOnBoard(testInsulinConfig(config.DecayCurveLinear))
+	target.Record("injector", 1, start)
+
+	first := target.Reserve("injector", 0.5, start.Add(time.Minute))
+	second := target.Reserve("injector", 0.5, start.Add(2*time.Minute))
+	assert.InDelta(t, 2, target.Delivered("injector", time.Hour, start.Add(2*time.Minute)), 0.001,
+		"reserved doses count against the limits")
+
+	target.Release("injector", first)
+	target.Release("injector", first)
+	assert.InDelta(t, 1.5, target.Delivered("injector", time.Hour, start.Add(2*time.Minute)), 0.001,
+		"only the released reservation is removed")
+	target.Release("injector", second)
+	assert.InDelta(t, 1, target.Delivered("injector", time.Hour, start.Add(2*time.Minute)), 0.001)
+}
+
+func TestInsulinOnBoard_ExponentialDecay(t *testing.T) {
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	target := NewInsulinOnBoard(testInsulinConfig(config.DecayCurveExponential))
+	target.Record("injector", 1, start)
+
+	previous := 1.0
+	for elapsed := 15 * time.Minute; elapsed < 4*time.Hour; elapsed += 15 * time.Minute {
+		active := target.Active("injector", start.Add(elapsed))
+		assert.Less(t, active, previous, "insulin on board must decrease over time")
+		assert.Greater(t, active, 0.0)
+		previous = active
+	}
+
+	// Exponential insulin activity is slow to start, so more remains early on than with the linear curve
+	assert.Greater(t, target.Active("injector", start.Add(30*time.Minute)), 0.875)
+}
+
+func TestInsulinOnBoard_Status(t *testing.T) {
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	target := NewInsulinOnBoard(testInsulinConfig(config.DecayCurveLinear))
+	target.Record("injector", 1, start)
+	target.Record("injector", 2, start.Add(time.Hour))
+
+	status := target.Status(start.Add(2 * time.Hour))
+	require.Len(t, status, 1)
+	assert.Equal(t, "injector", status[0].DeviceName)
+	assert.InDelta(t, 0.5+1.5, status[0].ActiveUnits, 0.001)
+	assert.Len(t, status[0].Doses, 2)
+
+	status = target.Status(start.Add(4*time.Hour + time.Minute))
+	require.Len(t, status, 1)
+	assert.Len(t, status[0].Doses, 1, "expired doses are dropped")
+
+	assert.Empty(t, target.Status(start.Add(6*time.Hour)))
+}
+
+func TestInsulinOnBoard_Delivered(t *testing.T) {
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	target := NewInsulinOnBoard(testInsulinConfig(config.DecayCurveLinear))
+	target.Record("injector", 1, start)
+	target.Record("injector", 2, start.Add(5*time.Hour+15*time.Minute))
+	target.Record("injector", 0.5, start.Add(5*time.Hour+30*time.Minute))
+
+	at := start.Add(6 * time.Hour)
+	assert.InDelta(t, 2.5, target.Delivered("injector", time.Hour, at), 0.001)
+	assert.InDelta(t, 3.5, target.Delivered("injector", 24*time.Hour, at), 0.001, "inactive doses still count towards delivery")
+	assert.Zero(t, target.Delivered("other-injector", 24*time.Hour, at))
+
+	// Pruning expired doses while calculating insulin on board keeps the last day of deliveries
+	assert.InDelta(t, 2*(1-45.0/240)+0.5*(1-30.0/240), target.Active("injector", at), 0.001)
+	assert.InDelta(t, 3.5, target.Delivered("injector", 24*time.Hour, at), 0.001)
+	target.Active("injector", start.Add(24*time.Hour+time.Minute))
+	assert.InDelta(t, 2.5, target.Delivered("injector", 24*time.Hour, start.Add(24*time.Hour+time.Minute)), 0.001)
+}
+
+func testInsulinConfig(curve string) config.InsulinConfig {
+	return config.InsulinConfig{
+		ActionDurationMinutes:  240,
+		DecayCurve:             curve,
+		PeakMinutes:            75,
+		TargetGlucose:          110,
+		SensitivityFactor:      50,
+		CarbRatio:              10,
+		MinDoseUnits:           0.05,
+		MaxDoseUnits:           2,
+		PumpRateUnitsPerMinute: 1,
+		MaxOnBoardUnits:        3,
+		MaxHourlyUnits:         4,
+		MaxDailyUnits:          20,
+	}
+}
@@ -0,0 +1,223 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/clients/logger"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/dtos"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/models"
+
+	"app-insulin-service/config"
+)
+
+// Notification categories raised when a glucose monitor goes stale and when it recovers
+const (
+	SensorStaleCategory     = "SENSOR-STALE"
+	SensorRecoveredCategory = "SENSOR-RECOVERED"
+)
+
+// livenessCheckInterval is how often Run checks for stale monitors
+const livenessCheckInterval = 30 * time.Second
+
+// SensorFreshness describes how recently a glucose monitor last published a reading.
+type SensorFreshness struct {
+	DeviceName string `json:"deviceName"`
+	Patient    string `json:"patient,omitempty"`
+	// LastReading is nil when no reading has been received since startup
+	LastReading *time.Time `json:"lastReading,omitempty"`
+	// AgeSeconds is the age of the last reading, or the time since startup when there is none
+	AgeSeconds   float64 `json:"ageSeconds"`
+	StaleMinutes float64 `json:"staleMinutes"`
+	// Stale is never set for monitors whose liveness is not tracked
+	Stale bool `json:"stale"`
+}
+
+// SensorLiveness tracks the latest reading from each glucose monitor and alerts when a monitor stops publishing. The
+// stale alert is raised once when a monitor goes stale and a recovery notice is sent once readings resume. It is
+// shared by every path that handles glucose readings.
+type SensorLiveness struct {
+	mutex       sync.Mutex
+	config      config.LivenessConfig
+	lc          logger.LoggingClient
+	patients    *Patients
+	started     time.Time
+	lastReading map[string]time.Time
+	stale       map[string]bool
+	// alert is replaced in tests to avoid sending notifications
+	alert func(freshness SensorFreshness)
+}
+
+// NewSensorLiveness creates a SensorLiveness using the given, already validated, configuration. Monitors that have
+// not published since it was created are stale once their stale interval has passed.
+func NewSensorLiveness(liveness config.LivenessConfig, lc logger.LoggingClient, patients *Patients) *SensorLiveness {
+	sensors := &SensorLiveness{
+		config:      liveness,
+		lc:          lc,
+		patients:    patients,
+		started:     time.Now(),
+		lastReading: make(map[string]time.Time),
+		stale:       make(map[string]bool),
+	}
+	sensors.alert = sensors.raiseStaleAlert
+	return sensors
+}
+
+// UpdateConfig replaces the liveness configuration, which applies from the next check.
+func (s *SensorLiveness) UpdateConfig(liveness config.LivenessConfig) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.config = liveness
+}
+
+// Received records a reading from the named monitor taken at the given time. A reading older than one already
+// received does not make the monitor any fresher.
+func (s *SensorLiveness) Received(deviceName string, at time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if at.After(s.lastReading[deviceName]) {
+		s.lastReading[deviceName] = at
+	}
+}
+
+// Stale returns the age of a reading from the named monitor taken at readingTime, and whether it is older than the
+// monitor's stale interval. Automatic doses are not delivered on stale readings.
+func (s *SensorLiveness) Stale(deviceName string, readingTime time.Time, at time.Time) (time.Duration, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	age := at.Sub(readingTime)
+	interval := s.config.Interval(deviceName)
+	return age, interval > 0 && age > interval
+}
+
+// Check alerts for each monitor that has gone stale, or recovered, since the last check.
+func (s *SensorLiveness) Check(at time.Time) {
+	var changed []SensorFreshness
+
+	s.mutex.Lock()
+	for _, freshness := range s.status(at) {
+		if freshness.Stale != s.stale[freshness.DeviceName] {
+			s.stale[freshness.DeviceName] = freshness.Stale
+			changed = append(changed, freshness)
+		}
+	}
+	s.mutex.Unlock()
+
+	// Alerts are sent without holding the lock, readings continue to be received meanwhile
+	for _, freshness := range changed {
+		s.alert(freshness)
+	}
+}
+
+// Run checks for stale monitors until the context is cancelled.
+func (s *SensorLiveness) Run(ctx context.Context) {
+	ticker := time.NewTicker(livenessCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.Check(now)
+		}
+	}
+}
+
+// Status returns the freshness of every configured monitor and every monitor a reading has been received from,
+// ordered by monitor name.
+func (s *SensorLiveness) Status(at time.Time) []SensorFreshness {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.status(at)
+}
+
+// status returns the freshness of every known monitor. Caller must hold the lock.
+func (s *SensorLiveness) status(at time.Time) []SensorFreshness {
+	devices := make(map[string]bool, len(s.lastReading))
+	for _, deviceName := range s.patients.Monitors() {
+		devices[deviceName] = true
+	}
+	for deviceName := range s.lastReading {
+		devices[deviceName] = true
+	}
+
+	statuses := make([]SensorFreshness, 0, len(devices))
+	for deviceName := range devices {
+		freshness := SensorFreshness{
+			DeviceName: deviceName,
+			Patient:    s.patients.ForMonitor(deviceName).Name,
+		}
+
+		since := s.started
+		if last, exists := s.lastReading[deviceName]; exists {
+			freshness.LastReading = &last
+			since = last
+		}
+		age := at.Sub(since)
+		interval := s.config.Interval(deviceName)
+		freshness.AgeSeconds = age.Seconds()
+		freshness.StaleMinutes = interval.Minutes()
+		freshness.Stale = interval > 0 && age > interval
+
+		statuses = append(statuses, freshness)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].DeviceName < statuses[j].DeviceName })
+
+	return statuses
+}
+
+// raiseStaleAlert alerts that a glucose monitor has stopped publishing readings, or that it has resumed.
+func (s *SensorLiveness) raiseStaleAlert(freshness SensorFreshness) {
+	patient := s.patients.ForMonitor(freshness.DeviceName)
+	age := (time.Duration(freshness.AgeSeconds) * time.Second).Round(time.Second)
+
+	notification := dtos.Notification{
+		Sender:      "Glucose-Monitor-Device",
+		Category:    SensorRecoveredCategory,
+		Severity:    models.Normal,
+		Content:     fmt.Sprintf("Glucose monitor %s is publishing readings again", freshness.DeviceName),
+		Labels:      patient.Labels("glucose", "sensor", freshness.DeviceName),
+		Status:      "NEW",
+		ContentType: "json",
+		Description: "Glucose monitor '" + freshness.DeviceName + "' recovered",
+	}
+	message := "Glucose monitor is publishing readings again, automatic insulin delivery resumed"
+	if freshness.Stale {
+		s.lc.Warnf("No glucose reading from %s for %s, automatic insulin delivery is blocked", freshness.DeviceName, age)
+		notification.Category = SensorStaleCategory
+		notification.Severity = models.Critical
+		notification.Content = fmt.Sprintf("No glucose reading from %s for %s", freshness.DeviceName, age)
+		notification.Description = "Glucose monitor '" + freshness.DeviceName + "' stale"
+		message = fmt.Sprintf("No glucose reading for %s, automatic insulin delivery is blocked", age)
+	} else {
+		s.lc.Infof("Glucose monitor %s is publishing readings again", freshness.DeviceName)
+	}
+
+	sendNotification(s.lc, notification)
+
+	if _, err := PostAlertData(NewAlertData(patient.Asset, 0, message)); err != nil {
+		s.lc.Errorf("unable to post glucose monitor alert: %s", err.Error())
+	}
+}
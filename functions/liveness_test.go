@@ -0,0 +1,115 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/clients/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"app-insulin-service/config"
+)
+
+func newTestSensorLiveness(liveness config.LivenessConfig, started time.Time) (*SensorLiveness, *[]SensorFreshness) {
+	patients := newTestPatients(map[string]config.PatientConfig{
+		"alice": {MonitorDevice: "monitor-1", InjectorDevice: "injector-1", Asset: testAsset},
+	})
+	target := NewSensorLiveness(liveness, logger.NewMockClient(), patients)
+	target.started = started
+	alerts := &[]SensorFreshness{}
+	target.alert = func(freshness SensorFreshness) { *alerts = append(*alerts, freshness) }
+	return target, alerts
+}
+
+func TestSensorLiveness_Check(t *testing.T) {
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	target, alerts := newTestSensorLiveness(config.LivenessConfig{StaleMinutes: 10, Devices: map[string]int{"mqtt-monitor": 0}}, now)
+
+	target.Received("monitor-1", now.Add(time.Minute))
+	target.Check(now.Add(5 * time.Minute))
+	assert.Empty(t, *alerts)
+
+	// Stale is alerted once, however often it is checked
+	target.Check(now.Add(12 * time.Minute))
+	target.Check(now.Add(13 * time.Minute))
+	require.Len(t, *alerts, 1)
+	assert.Equal(t, "monitor-1", (*alerts)[0].DeviceName)
+	assert.Equal(t, "alice", (*alerts)[0].Patient)
+	assert.True(t, (*alerts)[0].Stale)
+	assert.Equal(t, 660.0, (*alerts)[0].AgeSeconds)
+
+	// An older reading arriving late does not make the monitor fresh
+	target.Received("monitor-1", now)
+	target.Check(now.Add(14 * time.Minute))
+	require.Len(t, *alerts, 1)
+
+	target.Received("monitor-1", now.Add(15*time.Minute))
+	target.Check(now.Add(15 * time.Minute))
+	require.Len(t, *alerts, 2)
+	assert.False(t, (*alerts)[1].Stale, "recovered")
+
+	// The untracked MQTT monitor is never stale, even though it has never published
+	for _, freshness := range target.Status(now.Add(time.Hour)) {
+		if freshness.DeviceName == "mqtt-monitor" {
+			assert.False(t, freshness.Stale)
+		}
+	}
+}
+
+func TestSensorLiveness_Status(t *testing.T) {
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	target, _ := newTestSensorLiveness(config.LivenessConfig{StaleMinutes: 10}, now)
+
+	target.Received("monitor-1", now.Add(5*time.Minute))
+	target.Received("unknown", now.Add(5*time.Minute))
+
+	status := target.Status(now.Add(12 * time.Minute))
+	require.Len(t, status, 3)
+	assert.Equal(t, "monitor-1", status[0].DeviceName)
+	assert.Equal(t, "alice", status[0].Patient)
+	require.NotNil(t, status[0].LastReading)
+	assert.Equal(t, now.Add(5*time.Minute), *status[0].LastReading)
+	assert.Equal(t, 420.0, status[0].AgeSeconds)
+	assert.Equal(t, 10.0, status[0].StaleMinutes)
+	assert.False(t, status[0].Stale)
+
+	// A configured monitor that has never published is aged from startup
+	assert.Equal(t, SensorFreshness{DeviceName: "mqtt-monitor", AgeSeconds: 720, StaleMinutes: 10, Stale: true}, status[1])
+	assert.Equal(t, "unknown", status[2].DeviceName)
+
+	target.UpdateConfig(config.LivenessConfig{})
+	assert.False(t, target.Status(now.Add(12 * time.Minute))[1].Stale, "liveness tracking disabled")
+}
+
+func TestSensorLiveness_Stale(t *testing.T) {
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	target, _ := newTestSensorLiveness(config.LivenessConfig{StaleMinutes: 10, Devices: map[string]int{"untracked": 0}}, now)
+
+	age, stale := target.Stale("monitor-1", now.Add(-5*time.Minute), now)
+	assert.Equal(t, 5*time.Minute, age)
+	assert.False(t, stale)
+
+	age, stale = target.Stale("monitor-1", now.Add(-11*time.Minute), now)
+	assert.Equal(t, 11*time.Minute, age)
+	assert.True(t, stale)
+
+	_, stale = target.Stale("untracked", now.Add(-time.Hour), now)
+	assert.False(t, stale)
+}
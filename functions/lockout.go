@@ -0,0 +1,175 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	gometrics "github.com/rcrowley/go-metrics"
+
+	"app-insulin-service/config"
+)
+
+// ActuationsLockedOutName is the name of the metric counting actuations skipped during a lockout
+const ActuationsLockedOutName = "ActuationsLockedOut"
+
+// LockoutState describes the lockout of an injector following its last actuation.
+type LockoutState struct {
+	DeviceName     string    `json:"deviceName"`
+	LastActuation  time.Time `json:"lastActuation"`
+	LockoutMinutes float64   `json:"lockoutMinutes"`
+	Until          time.Time `json:"until"`
+	// RemainingSeconds is zero once the lockout has elapsed
+	RemainingSeconds float64 `json:"remainingSeconds"`
+	// Skipped counts the actuations skipped during the current lockout
+	Skipped int `json:"skipped"`
+}
+
+// Lockout enforces a refractory period after each actuation of an injector, during which readings do not actuate
+// it again so the delivered insulin has time to act. It is shared by every path that actuates an injector.
+type Lockout struct {
+	mutex    sync.Mutex
+	config   config.LockoutConfig
+	actuated map[string]time.Time
+	// previous holds the lockout replaced by each acquired lockout, restored if it is rolled back
+	previous  map[string]time.Time
+	skipped   map[string]int
+	lockedOut gometrics.Counter
+}
+
+// NewLockout creates a Lockout using the given, already validated, configuration.
+func NewLockout(lockout config.LockoutConfig) *Lockout {
+	return &Lockout{
+		config:    lockout,
+		actuated:  make(map[string]time.Time),
+		previous:  make(map[string]time.Time),
+		skipped:   make(map[string]int),
+		lockedOut: gometrics.NewCounter(),
+	}
+}
+
+// UpdateConfig replaces the lockout configuration, which applies to lockouts already in progress.
+func (l *Lockout) UpdateConfig(lockout config.LockoutConfig) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.config = lockout
+}
+
+// Actuated starts the lockout of the named injector.
+func (l *Lockout) Actuated(deviceName string, at time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.actuated[deviceName] = at
+	delete(l.previous, deviceName)
+	delete(l.skipped, deviceName)
+}
+
+// TryAcquire starts the lockout of the named injector unless it is already locked out, in which case it returns how
+// long it remains locked out and false. Checking and starting the lockout is a single step, so concurrent paths
+// cannot both go on to actuate the injector. The lockout is rolled back if the actuation does not go ahead.
+func (l *Lockout) TryAcquire(deviceName string, at time.Time) (time.Duration, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if remaining := l.remaining(deviceName, at); remaining > 0 {
+		return remaining, false
+	}
+
+	if previous, exists := l.actuated[deviceName]; exists {
+		l.previous[deviceName] = previous
+	} else {
+		delete(l.previous, deviceName)
+	}
+	l.actuated[deviceName] = at
+	delete(l.skipped, deviceName)
+	return 0, true
+}
+
+// Rollback ends the lockout of the named injector acquired at the given time, restoring the lockout it replaced,
+// when the actuation it was acquired for did not go ahead.
+func (l *Lockout) Rollback(deviceName string, at time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if actuated, exists := l.actuated[deviceName]; !exists || !actuated.Equal(at) {
+		return
+	}
+
+	if previous, exists := l.previous[deviceName]; exists {
+		l.actuated[deviceName] = previous
+	} else {
+		delete(l.actuated, deviceName)
+	}
+	delete(l.previous, deviceName)
+}
+
+// Remaining returns how long the named injector remains locked out, zero when it may be actuated.
+func (l *Lockout) Remaining(deviceName string, at time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.remaining(deviceName, at)
+}
+
+// Skip records that an actuation of the named injector was skipped because it is locked out.
+func (l *Lockout) Skip(deviceName string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.skipped[deviceName]++
+	l.lockedOut.Inc(1)
+}
+
+// Metric returns the counter of actuations skipped during a lockout, for registration with the metrics manager.
+func (l *Lockout) Metric() gometrics.Counter {
+	return l.lockedOut
+}
+
+// Status returns the lockout of every injector actuated since startup, ordered by injector name.
+func (l *Lockout) Status(at time.Time) []LockoutState {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	states := make([]LockoutState, 0, len(l.actuated))
+	for deviceName, actuated := range l.actuated {
+		lockout := l.config.Duration(deviceName)
+		states = append(states, LockoutState{
+			DeviceName:       deviceName,
+			LastActuation:    actuated,
+			LockoutMinutes:   lockout.Minutes(),
+			Until:            actuated.Add(lockout),
+			RemainingSeconds: l.remaining(deviceName, at).Seconds(),
+			Skipped:          l.skipped[deviceName],
+		})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].DeviceName < states[j].DeviceName })
+
+	return states
+}
+
+// remaining returns how long the named injector remains locked out. Caller must hold the lock.
+func (l *Lockout) remaining(deviceName string, at time.Time) time.Duration {
+	actuated, exists := l.actuated[deviceName]
+	if !exists {
+		return 0
+	}
+
+	if remaining := actuated.Add(l.config.Duration(deviceName)).Sub(at); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
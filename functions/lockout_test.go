@@ -0,0 +1,112 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"app-insulin-service/config"
+)
+
+func TestLockout(t *testing.T) {
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	target := NewLockout(config.LockoutConfig{Minutes: 15, Devices: map[string]int{"slow-injector": 30}})
+
+	assert.Zero(t, target.Remaining("injector", now), "never actuated")
+	assert.Empty(t, target.Status(now))
+
+	target.Actuated("injector", now)
+	target.Actuated("slow-injector", now)
+	assert.Equal(t, 10*time.Minute, target.Remaining("injector", now.Add(5*time.Minute)))
+	assert.Equal(t, 25*time.Minute, target.Remaining("slow-injector", now.Add(5*time.Minute)))
+
+	target.Skip("injector")
+	target.Skip("injector")
+	assert.Equal(t, int64(2), target.Metric().Count())
+
+	status := target.Status(now.Add(5 * time.Minute))
+	require.Len(t, status, 2)
+	assert.Equal(t, LockoutState{DeviceName: "injector", LastActuation: now, LockoutMinutes: 15, Until: now.Add(15 * time.Minute),
+		RemainingSeconds: 600, Skipped: 2}, status[0])
+	assert.Equal(t, "slow-injector", status[1].DeviceName)
+
+	assert.Zero(t, target.Remaining("injector", now.Add(15*time.Minute)), "lockout elapsed")
+	assert.Zero(t, target.Status(now.Add(20 * time.Minute))[0].RemainingSeconds)
+
+	// A new actuation restarts the lockout and its skip count, the metric keeps counting
+	target.Actuated("injector", now.Add(20*time.Minute))
+	assert.Equal(t, 15*time.Minute, target.Remaining("injector", now.Add(20*time.Minute)))
+	assert.Zero(t, target.Status(now.Add(20 * time.Minute))[0].Skipped)
+	assert.Equal(t, int64(2), target.Metric().Count())
+
+	target.UpdateConfig(config.LockoutConfig{})
+	assert.Zero(t, target.Remaining("injector", now.Add(20*time.Minute)), "lockout disabled")
+}
+
+func TestLockout_TryAcquire(t *testing.T) {
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	target := NewLockout(config.LockoutConfig{Minutes: 15})
+
+	remaining, acquired := target.TryAcquire("injector", now)
+	assert.True(t, acquired)
+	assert.Zero(t, remaining)
+
+	remaining, acquired = target.TryAcquire("injector", now.Add(5*time.Minute))
+	assert.False(t, acquired, "already locked out")
+	assert.Equal(t, 10*time.Minute, remaining)
+
+	// Rolling back the first lockout leaves the injector as if never actuated
+	target.Rollback("injector", now)
+	assert.Zero(t, target.Remaining("injector", now.Add(5*time.Minute)))
+	assert.Empty(t, target.Status(now))
+
+	// Rolling back a later lockout restores the one it replaced
+	target.Actuated("injector", now)
+	_, acquired = target.TryAcquire("injector", now.Add(20*time.Minute))
+	require.True(t, acquired)
+	target.Rollback("injector", now.Add(20*time.Minute))
+	assert.Equal(t, now, target.Status(now.Add(20 * time.Minute))[0].LastActuation)
+
+	// Only the lockout acquired at the given time is rolled back
+	target.Rollback("injector", now.Add(time.Minute))
+	assert.Equal(t, 14*time.Minute, target.Remaining("injector", now.Add(time.Minute)))
+}
+
+func TestLockout_TryAcquire_Concurrent(t *testing.T) {
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	target := NewLockout(config.LockoutConfig{Minutes: 15})
+
+	results := make(chan bool)
+	for index := 0; index < 10; index++ {
+		go func() {
+			_, acquired := target.TryAcquire("injector", now)
+			results <- acquired
+		}()
+	}
+
+	var acquired int
+	for index := 0; index < 10; index++ {
+		if <-results {
+			acquired++
+		}
+	}
+	assert.Equal(t, 1, acquired, "only one of the concurrent paths may actuate")
+}
@@ -0,0 +1,140 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"fmt"
+	"time"
+
+	"app-insulin-service/config"
+)
+
+// MealRequest announces that the patient the injector delivers to is eating Carbs grams of carbohydrate.
+type MealRequest struct {
+	DeviceName  string  `json:"deviceName"`
+	Carbs       float64 `json:"carbs"`
+	RequestedBy string  `json:"requestedBy"`
+}
+
+// MealResponse reports the dose calculated for an announced meal, whether it was accepted, and if not why, and
+// whether it was delivered.
+type MealResponse struct {
+	DoseCalculation
+	DeviceName  string `json:"deviceName"`
+	RequestedBy string `json:"requestedBy"`
+	// Accepted is true when the dose passed every check, Reasons lists the checks that failed otherwise
+	Accepted bool     `json:"accepted"`
+	Reasons  []string `json:"reasons,omitempty"`
+	// Delivered is true when the injector confirmed the actuation, Error explains why it did not otherwise
+	Delivered bool   `json:"delivered"`
+	Error     string `json:"error,omitempty"`
+	// DisplayGlucose is the current glucose, which is in mg/dL, in the patient's display units
+	DisplayGlucose string    `json:"displayGlucose,omitempty"`
+	GlucoseDevice  string    `json:"glucoseDevice,omitempty"`
+	GlucoseTime    time.Time `json:"glucoseTime"`
+	Time           time.Time `json:"time"`
+}
+
+// Meal calculates the dose covering an announced meal from the patient's carb ratio, current glucose and insulin
+// on board, and delivers it when it passes the same checks as correction doses: suspension, the lockout, a recent
+// glucose reading that is not predicted to go low, and the insulin limits. Meals are handled one at a time along
+// with manual doses so concurrent requests cannot each pass the delivery limits.
+func (m *ManualBolus) Meal(request MealRequest, at time.Time) MealResponse {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// The injector is locked from the checks until the dose is delivered, like the automatic dosing paths. An
+	// unknown injector is rejected below without taking a lock, so requests cannot add locks for any name given.
+	configured := m.injector.IsConfigured(request.DeviceName)
+	if configured {
+		unlock := m.injector.Lock(request.DeviceName)
+		defer unlock()
+	}
+
+	response := MealResponse{
+		DeviceName:  request.DeviceName,
+		RequestedBy: request.RequestedBy,
+		Time:        at,
+	}
+	// The glucose, carb ratio and delivery limits are those of the patient the injector delivers to
+	patient := m.patients.ForInjector(request.DeviceName)
+	var glucose float64
+	var glucoseReasons []string
+	response.GlucoseDevice, response.GlucoseTime, glucose, glucoseReasons = m.currentGlucose(patient, at)
+	response.Glucose = glucose
+	response.Carbs = request.Carbs
+	if response.GlucoseDevice != "" {
+		response.DisplayGlucose = patient.FormatGlucose(glucose)
+	}
+
+	if request.Carbs <= 0 || request.Carbs > config.MaxMealCarbs {
+		response.Reasons = append(response.Reasons, fmt.Sprintf("carbs must be greater than zero and no more than %d grams", config.MaxMealCarbs))
+	}
+	if request.RequestedBy == "" {
+		response.Reasons = append(response.Reasons, "requestedBy must be set")
+	}
+	if !configured {
+		response.Reasons = append(response.Reasons, fmt.Sprintf("injector '%s' is not configured", request.DeviceName))
+	}
+	if m.suspension.IsSuspended(request.DeviceName) {
+		response.Reasons = append(response.Reasons, "insulin delivery is suspended")
+	}
+	response.Reasons = append(response.Reasons, glucoseReasons...)
+	// The lockout is acquired last, only when nothing else rejects the meal
+	if len(response.Reasons) == 0 {
+		if remaining, acquired := m.lockout.TryAcquire(request.DeviceName, at); !acquired {
+			response.Reasons = append(response.Reasons, fmt.Sprintf("injector is locked out for another %s", remaining.Round(time.Second)))
+		}
+	}
+
+	if len(response.Reasons) == 0 {
+		response.DoseCalculation = m.doseCalculator.CalculateMeal(response.GlucoseDevice, request.DeviceName, request.Carbs, glucose, at)
+		if response.Units <= 0 {
+			response.Reasons = append(response.Reasons, response.Reason)
+			m.lockout.Rollback(request.DeviceName, at)
+		}
+	}
+
+	if len(response.Reasons) > 0 {
+		m.lc.Warnf("Meal of %.0f g carbohydrate for %s announced by %s rejected: %v",
+			request.Carbs, request.DeviceName, request.RequestedBy, response.Reasons)
+		return response
+	}
+
+	response.Accepted = true
+	m.lc.Infof("Meal of %.0f g carbohydrate for %s announced by %s accepted, delivering %.2f units (%.2f for the meal, correction %.2f units, %.2f units on board)",
+		request.Carbs, request.DeviceName, request.RequestedBy, response.Units, response.MealUnits, response.CorrectionUnits,
+		response.InsulinOnBoard)
+	if response.Reason != "" {
+		m.lc.Warnf("Meal dose for %s %s", request.DeviceName, response.Reason)
+	}
+
+	if err := m.deliver(request.DeviceName, response.Units, at); err != nil {
+		m.lc.Errorf("Meal bolus by %s not confirmed, stopping injector: %s", request.DeviceName, err.Error())
+		response.Error = err.Error()
+		m.lockout.Rollback(request.DeviceName, at)
+		return response
+	}
+	response.Delivered = true
+
+	message := fmt.Sprintf("Meal bolus of %.2f units for %.0f g carbohydrate announced by %s, current glucose - %s",
+		response.Units, request.Carbs, request.RequestedBy, patient.FormatGlucose(glucose))
+	if _, err := m.postAlert(NewAlertData(patient.Asset, glucose, message)); err != nil {
+		m.lc.Errorf("unable to post meal bolus alert: %s", err.Error())
+	}
+
+	return response
+}
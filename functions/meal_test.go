@@ -0,0 +1,104 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/clients/interfaces/mocks"
+	dtoCommon "github.com/edgexfoundry/go-mod-core-contracts/v3/dtos/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManualBolus_Meal(t *testing.T) {
+	client := &mocks.CommandClient{}
+	client.On("IssueSetCommandByName", mock.Anything, "injector", "WriteBoolValue", mock.Anything).
+		Return(dtoCommon.NewBaseResponse("", "", 200), nil)
+	client.On("IssueGetCommandByName", mock.Anything, "injector", "Bool", false, true).
+		Return(readBackResponse("Bool", "true"), nil)
+	target, insulinOnBoard, _, history := newTestManualBolus(client)
+
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	history.Add("monitor", 135, now.Add(-5*time.Minute))
+
+	actual := target.Meal(MealRequest{DeviceName: "injector", Carbs: 12, RequestedBy: "patient"}, now)
+	require.True(t, actual.Accepted, actual.Reasons)
+	assert.True(t, actual.Delivered)
+	assert.InDelta(t, 1.7, actual.Units, 0.0001)
+	assert.InDelta(t, 1.2, actual.MealUnits, 0.0001)
+	assert.InDelta(t, 0.5, actual.CorrectionUnits, 0.0001)
+	assert.Equal(t, "monitor", actual.GlucoseDevice)
+	assert.InDelta(t, 1.7, insulinOnBoard.Active("injector", now), 0.001)
+
+	// The meal dose starts the lockout, which further meals are subject to
+	actual = target.Meal(MealRequest{DeviceName: "injector", Carbs: 12, RequestedBy: "patient"}, now.Add(time.Minute))
+	assert.False(t, actual.Accepted)
+	assert.Equal(t, []string{"injector is locked out for another 14m0s"}, actual.Reasons)
+}
+
+func TestManualBolus_Meal_Rejected(t *testing.T) {
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		Name            string
+		Request         MealRequest
+		Readings        []float64
+		ReadingsAgo     time.Duration
+		Suspended       bool
+		ExpectedReasons []string
+	}{
+		{"No glucose", MealRequest{DeviceName: "injector", Carbs: 30, RequestedBy: "patient"}, nil, 0, false,
+			[]string{"no glucose reading available"}},
+		{"Stale glucose", MealRequest{DeviceName: "injector", Carbs: 30, RequestedBy: "patient"}, []float64{180}, 20 * time.Minute, false,
+			[]string{"latest glucose reading is 20m0s old, older than 15m0s"}},
+		{"Predicted low", MealRequest{DeviceName: "injector", Carbs: 30, RequestedBy: "patient"}, []float64{170, 155, 140}, 0, false,
+			[]string{"glucose is projected to fall to 50 mg/dL"}},
+		{"Suspended", MealRequest{DeviceName: "injector", Carbs: 30, RequestedBy: "patient"}, []float64{180}, 0, true,
+			[]string{"insulin delivery is suspended"}},
+		{"Covered by low glucose", MealRequest{DeviceName: "injector", Carbs: 5, RequestedBy: "patient"}, []float64{60}, 0, false,
+			[]string{"glucose below target covers the meal"}},
+		{"Invalid request", MealRequest{DeviceName: "pump", Carbs: 300}, []float64{180}, 0, false,
+			[]string{"carbs must be greater than zero and no more than 250 grams", "requestedBy must be set", "injector 'pump' is not configured"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			client := &mocks.CommandClient{}
+			target, insulinOnBoard, suspension, history := newTestManualBolus(client)
+			for index, value := range test.Readings {
+				at := now.Add(-test.ReadingsAgo).Add(time.Duration(index-len(test.Readings)+1) * 5 * time.Minute)
+				history.Add("monitor", value, at)
+			}
+			if test.Suspended {
+				suspension.Latch("injector", "emergency stop", "nurse", now)
+			}
+
+			actual := target.Meal(test.Request, now)
+			require.False(t, actual.Accepted)
+			assert.False(t, actual.Delivered)
+			assert.Equal(t, test.ExpectedReasons, actual.Reasons)
+			assert.Zero(t, insulinOnBoard.Active(test.Request.DeviceName, now))
+			client.AssertNotCalled(t, "IssueSetCommandByName", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+			if !target.injector.IsConfigured(test.Request.DeviceName) {
+				assert.NotContains(t, target.injector.locks, test.Request.DeviceName, "no lock is taken for an unknown injector")
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"app-insulin-service/config"
+)
+
+// PatientProfile is the therapy profile of a patient with the defaults applied for anything the patient's
+// configuration does not set. The default profile, used for glucose monitors without a profile, has no Name.
+type PatientProfile struct {
+	Name           string               `json:"name,omitempty"`
+	MonitorDevice  string               `json:"monitorDevice"`
+	InjectorDevice string               `json:"injectorDevice"`
+	Asset          config.AssetConfig   `json:"asset"`
+	Insulin        config.InsulinConfig `json:"insulin"`
+	Recipients     []string             `json:"recipients,omitempty"`
+	Schedule       config.Schedule      `json:"schedule,omitempty"`
+	// Controller calculates the patient's automatic doses
+	Controller config.ControllerConfig `json:"controller"`
+	// DisplayUnits are the glucose units used in the patient's alerts and reports
+	DisplayUnits string `json:"displayUnits"`
+	// Segment is the name of the schedule segment applied to Insulin, empty outside of every segment
+	Segment string `json:"segment,omitempty"`
+}
+
+// At returns the profile with the schedule segment active at the given time applied.
+func (p PatientProfile) At(at time.Time) PatientProfile {
+	name, segment, active := p.Schedule.Active(at)
+	if !active {
+		return p
+	}
+
+	p.Segment = name
+	p.Insulin = segment.ApplyTo(p.Insulin)
+	return p
+}
+
+// FormatGlucose formats glucose in mg/dL for display in the patient's units.
+func (p PatientProfile) FormatGlucose(glucose float64) string {
+	return FormatGlucose(glucose, p.DisplayUnits)
+}
+
+// Labels returns the labels added to notifications about the patient, so subscriptions can route them to the
+// patient's recipients.
+func (p PatientProfile) Labels(labels ...string) []string {
+	if p.Name != "" {
+		labels = append(labels, p.Name)
+	}
+	return append(labels, p.Recipients...)
+}
+
+// Patients maps glucose monitors and insulin injectors to the profile of the patient wearing them. It is shared by
+// every path that handles glucose readings or actuates an injector.
+type Patients struct {
+	mutex       sync.RWMutex
+	defaults    PatientProfile
+	mqttMonitor string
+	monitors    map[string]PatientProfile
+	injectors   map[string]PatientProfile
+}
+
+// NewPatients creates Patients using the given, already validated, configuration.
+func NewPatients(appCustom config.AppCustomConfig) *Patients {
+	patients := &Patients{}
+	patients.UpdateConfig(appCustom)
+	return patients
+}
+
+// UpdateConfig replaces the patient profiles and the defaults applied to them.
+func (p *Patients) UpdateConfig(appCustom config.AppCustomConfig) {
+	defaults := PatientProfile{
+		InjectorDevice: appCustom.Injector.DeviceName,
+		Asset:          appCustom.Asset,
+		Insulin:        appCustom.Insulin,
+		Controller:     appCustom.Controller,
+	}
+	// Units are validated, anything unsupported displays in mg/dL
+	defaults.DisplayUnits, _ = config.NormalizeUnits(appCustom.DisplayUnits)
+
+	monitors := make(map[string]PatientProfile, len(appCustom.Patients))
+	injectors := make(map[string]PatientProfile, len(appCustom.Patients))
+	for name, patient := range appCustom.Patients {
+		profile := PatientProfile{
+			Name:           name,
+			MonitorDevice:  patient.MonitorDevice,
+			InjectorDevice: patient.InjectorDevice,
+			Asset:          patient.Asset,
+			Insulin:        patient.ApplyTo(appCustom.Insulin),
+			Recipients:     patient.RecipientList(),
+			Schedule:       patient.Schedule,
+			Controller:     patient.Controller,
+		}
+		if profile.Controller.Type == "" {
+			profile.Controller = defaults.Controller
+		}
+		profile.DisplayUnits = defaults.DisplayUnits
+		if patient.DisplayUnits != "" {
+			profile.DisplayUnits, _ = config.NormalizeUnits(patient.DisplayUnits)
+		}
+		injectors[profile.InjectorDevice] = profile
+		monitors[profile.MonitorDevice] = profile
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.defaults = defaults
+	p.mqttMonitor = appCustom.MqttMonitorDevice
+	p.monitors = monitors
+	p.injectors = injectors
+}
+
+// ForMonitor returns the profile of the patient wearing the named glucose monitor, or the default profile.
+func (p *Patients) ForMonitor(monitorDevice string) PatientProfile {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if profile, ok := p.monitors[monitorDevice]; ok {
+		return profile
+	}
+	profile := p.defaults
+	profile.MonitorDevice = monitorDevice
+	return profile
+}
+
+// ForInjector returns the profile of the patient the named injector delivers to, or the default profile for the
+// default injector, which delivers to monitors without a profile.
+func (p *Patients) ForInjector(injectorDevice string) PatientProfile {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if profile, ok := p.injectors[injectorDevice]; ok {
+		return profile
+	}
+	profile := p.defaults
+	profile.InjectorDevice = injectorDevice
+	return profile
+}
+
+// MqttMonitor returns the glucose monitor without a patient profile whose readings are published on the MQTT topics.
+func (p *Patients) MqttMonitor() string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.mqttMonitor
+}
+
+// Injectors returns the names of every configured injector, the default injector first.
+func (p *Patients) Injectors() []string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	var others []string
+	for deviceName := range p.injectors {
+		if deviceName != p.defaults.InjectorDevice {
+			others = append(others, deviceName)
+		}
+	}
+	sort.Strings(others)
+
+	return append([]string{p.defaults.InjectorDevice}, others...)
+}
+
+// Monitors returns the names of every configured glucose monitor, including the MQTT monitor, ordered by name.
+func (p *Patients) Monitors() []string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	var monitors []string
+	if p.mqttMonitor != "" {
+		monitors = append(monitors, p.mqttMonitor)
+	}
+	for deviceName := range p.monitors {
+		if deviceName != p.mqttMonitor {
+			monitors = append(monitors, deviceName)
+		}
+	}
+	sort.Strings(monitors)
+
+	return monitors
+}
+
+// IsMonitor reports whether the named device is a configured glucose monitor, including the MQTT monitor.
+func (p *Patients) IsMonitor(deviceName string) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	_, configured := p.monitors[deviceName]
+	return configured || (deviceName != "" && deviceName == p.mqttMonitor)
+}
+
+// Profiles returns every patient profile with the schedule segment active at the given time applied, ordered by
+// patient name.
+func (p *Patients) Profiles(at time.Time) []PatientProfile {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	profiles := make([]PatientProfile, 0, len(p.monitors))
+	for _, profile := range p.monitors {
+		profiles = append(profiles, profile.At(at))
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+
+	return profiles
+}
@@ -0,0 +1,139 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"app-insulin-service/config"
+)
+
+var testAsset = config.AssetConfig{Id: 34, Name: "Patient_Monitor_19524"}
+
+// newTestPatients returns the given patient profiles with the test insulin and injector configuration as defaults.
+func newTestPatients(patients map[string]config.PatientConfig) *Patients {
+	return NewPatients(config.AppCustomConfig{
+		Asset:             testAsset,
+		MqttMonitorDevice: "mqtt-monitor",
+		Patients:          patients,
+		Insulin:           testInsulinConfig(config.DecayCurveLinear),
+		Injector:          testInjectorConfig(),
+	})
+}
+
+func TestPatients(t *testing.T) {
+	target := newTestPatients(map[string]config.PatientConfig{
+		"alice": {
+			MonitorDevice:  "monitor-1",
+			InjectorDevice: "injector-1",
+			Asset:          config.AssetConfig{Id: 35, Name: "Patient_Monitor_1"},
+			Recipients:     "ward-3, dr-smith",
+			TargetGlucose:  120,
+			DisplayUnits:   "mmol/l",
+		},
+		"bob": {
+			MonitorDevice:  "monitor-2",
+			InjectorDevice: "injector-2",
+			Asset:          config.AssetConfig{Id: 36, Name: "Patient_Monitor_2"},
+		},
+	})
+
+	alice := target.ForMonitor("monitor-1")
+	assert.Equal(t, "alice", alice.Name)
+	assert.Equal(t, "injector-1", alice.InjectorDevice)
+	assert.Equal(t, 35, alice.Asset.Id)
+	assert.Equal(t, 120.0, alice.Insulin.TargetGlucose)
+	assert.Equal(t, testInsulinConfig(config.DecayCurveLinear).SensitivityFactor, alice.Insulin.SensitivityFactor)
+	assert.Equal(t, []string{"glucose", "high", "alice", "ward-3", "dr-smith"}, alice.Labels("glucose", "high"))
+	assert.Equal(t, alice, target.ForInjector("injector-1"))
+	assert.Equal(t, config.UnitsMmolL, alice.DisplayUnits)
+	assert.Equal(t, "6.7 mmol/L", alice.FormatGlucose(120))
+
+	bob := target.ForMonitor("monitor-2")
+	assert.Equal(t, "injector-2", bob.InjectorDevice)
+	assert.Equal(t, bob, target.ForInjector("injector-2"))
+	assert.Nil(t, bob.Recipients)
+	assert.Equal(t, config.UnitsMgDl, bob.DisplayUnits, "default display units")
+	assert.Equal(t, "120 mg/dL", bob.FormatGlucose(120))
+
+	unknown := target.ForMonitor("monitor-3")
+	assert.Empty(t, unknown.Name)
+	assert.Equal(t, "monitor-3", unknown.MonitorDevice)
+	assert.Equal(t, "injector", unknown.InjectorDevice)
+	assert.Equal(t, testAsset, unknown.Asset)
+	assert.Equal(t, testInsulinConfig(config.DecayCurveLinear), unknown.Insulin)
+	assert.Equal(t, []string{"glucose"}, unknown.Labels("glucose"))
+
+	// The default injector delivers to monitors without a profile
+	assert.Empty(t, target.ForInjector("injector").Name)
+	assert.Equal(t, testAsset, target.ForInjector("injector").Asset)
+
+	assert.Equal(t, []string{"injector", "injector-1", "injector-2"}, target.Injectors())
+	assert.Equal(t, "mqtt-monitor", target.MqttMonitor())
+	assert.Equal(t, []string{"monitor-1", "monitor-2", "mqtt-monitor"}, target.Monitors())
+	assert.True(t, target.IsMonitor("monitor-1"))
+	assert.True(t, target.IsMonitor("mqtt-monitor"))
+	assert.False(t, target.IsMonitor("monitor-3"))
+
+	profiles := target.Profiles(time.Now())
+	require.Len(t, profiles, 2)
+	assert.Equal(t, "alice", profiles[0].Name)
+	assert.Equal(t, "bob", profiles[1].Name)
+
+	target.UpdateConfig(config.AppCustomConfig{Asset: testAsset, Injector: testInjectorConfig()})
+	assert.Empty(t, target.ForMonitor("monitor-1").Name)
+	assert.Equal(t, []string{"injector"}, target.Injectors())
+	assert.Empty(t, target.Monitors())
+	assert.False(t, target.IsMonitor(""))
+	assert.Empty(t, target.Profiles(time.Now()))
+}
+
+func TestPatientProfile_At(t *testing.T) {
+	target := newTestPatients(map[string]config.PatientConfig{
+		"alice": {
+			MonitorDevice:  "monitor-1",
+			InjectorDevice: "injector-1",
+			TargetGlucose:  120,
+			Schedule: config.Schedule{
+				"night":   {Start: "22:00", End: "06:00", TargetGlucose: 140},
+				"weekend": {Days: "Sat,Sun", Start: "08:00", End: "20:00", SensitivityFactor: 40},
+			},
+		},
+	})
+	alice := target.ForMonitor("monitor-1")
+
+	night := alice.At(time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC))
+	assert.Equal(t, "night", night.Segment)
+	assert.Equal(t, 140.0, night.Insulin.TargetGlucose)
+
+	weekend := alice.At(time.Date(2024, 1, 6, 12, 0, 0, 0, time.UTC))
+	assert.Equal(t, "weekend", weekend.Segment)
+	assert.Equal(t, 120.0, weekend.Insulin.TargetGlucose)
+	assert.Equal(t, 40.0, weekend.Insulin.SensitivityFactor)
+
+	weekday := alice.At(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	assert.Empty(t, weekday.Segment)
+	assert.Equal(t, alice, weekday)
+
+	profiles := target.Profiles(time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC))
+	require.Len(t, profiles, 1)
+	assert.Equal(t, "night", profiles[0].Segment)
+}
@@ -0,0 +1,139 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"app-insulin-service/config"
+)
+
+// RuleEngine holds the active glucose response bands and matches readings against them. Readings from a
+// patient's monitor are matched against the bands of the patient's active schedule segment, or the patient's own
+// bands, all others against the default bands. Rules can be replaced at any time, e.g. when the writable
+// configuration changes.
+type RuleEngine struct {
+	mutex    sync.RWMutex
+	defaults ruleSet
+	monitors map[string]patientRules
+}
+
+// patientRules are a patient's own bands and those of the schedule segments which replace them.
+type patientRules struct {
+	rules    ruleSet
+	schedule config.Schedule
+	segments map[string]ruleSet
+}
+
+// ruleSet is a set of non-overlapping rules kept in a stable evaluation order.
+type ruleSet struct {
+	names []string
+	rules map[string]config.GlucoseRule
+}
+
+func newRuleSet(rules map[string]config.GlucoseRule) ruleSet {
+	set := ruleSet{
+		names: make([]string, 0, len(rules)),
+		rules: make(map[string]config.GlucoseRule, len(rules)),
+	}
+	for name, rule := range rules {
+		set.rules[name] = rule
+		set.names = append(set.names, name)
+	}
+	sort.Strings(set.names)
+	return set
+}
+
+// NewRuleEngine creates a RuleEngine for the given, already validated, default rules and patient overrides.
+func NewRuleEngine(rules map[string]config.GlucoseRule, patients map[string]config.PatientConfig) *RuleEngine {
+	engine := &RuleEngine{}
+	engine.Update(rules, patients)
+	return engine
+}
+
+// Update replaces the active rules.
+func (e *RuleEngine) Update(rules map[string]config.GlucoseRule, patients map[string]config.PatientConfig) {
+	defaults := newRuleSet(rules)
+	monitors := make(map[string]patientRules, len(patients))
+	for _, patient := range patients {
+		profile := patientRules{
+			rules:    newRuleSet(patient.GlucoseRules),
+			schedule: patient.Schedule,
+			segments: make(map[string]ruleSet),
+		}
+		for name, segment := range patient.Schedule {
+			if len(segment.GlucoseRules) > 0 {
+				profile.segments[name] = newRuleSet(segment.GlucoseRules)
+			}
+		}
+		monitors[patient.MonitorDevice] = profile
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.defaults = defaults
+	e.monitors = monitors
+}
+
+// rulesFor returns the rules that apply at the given time to readings from the named device. Caller must hold the
+// lock.
+func (e *RuleEngine) rulesFor(deviceName string, at time.Time) ruleSet {
+	patient, ok := e.monitors[deviceName]
+	if !ok {
+		return e.defaults
+	}
+
+	if name, _, active := patient.schedule.Active(at); active {
+		if set, ok := patient.segments[name]; ok {
+			return set
+		}
+	}
+	return patient.rules
+}
+
+// HasResource reports whether any rule applies at the given time to readings from the named device resource.
+func (e *RuleEngine) HasResource(deviceName string, resourceName string, at time.Time) bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	for _, rule := range e.rulesFor(deviceName, at).rules {
+		if rule.ResourceName == resourceName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Match returns the name of the rule matching the value read at the given time from the named device resource.
+// Rules are validated to not overlap, so at most one rule can match.
+func (e *RuleEngine) Match(deviceName string, resourceName string, value float64, at time.Time) (string, config.GlucoseRule, bool) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	set := e.rulesFor(deviceName, at)
+	for _, name := range set.names {
+		rule := set.rules[name]
+		if rule.ResourceName == resourceName && rule.Matches(value) {
+			return name, rule, true
+		}
+	}
+
+	return "", config.GlucoseRule{}, false
+}
@@ -0,0 +1,110 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"app-insulin-service/config"
+)
+
+func TestRuleEngine_Match(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	target := NewRuleEngine(map[string]config.GlucoseRule{
+		"high": {ResourceName: "Uint16", Comparison: config.ComparisonGreater, Threshold: 120, Units: config.UnitsMgDl, Action: config.ActionActuate},
+		"low":  {ResourceName: "Uint16", Comparison: config.ComparisonLess, Threshold: 70, Units: config.UnitsMgDl, Action: config.ActionNotify},
+	}, map[string]config.PatientConfig{
+		"patient-1": {
+			MonitorDevice: "monitor-1",
+			GlucoseRules: map[string]config.GlucoseRule{
+				"normal":   {ResourceName: "Uint16", Comparison: config.ComparisonBetween, Threshold: 70, UpperThreshold: 180, Units: config.UnitsMgDl, Action: config.ActionNone},
+				"elevated": {ResourceName: "Uint16", Comparison: config.ComparisonGreaterOrEqual, Threshold: 180, Units: config.UnitsMgDl, Action: config.ActionActuate},
+			},
+		},
+	})
+
+	tests := []struct {
+		Name          string
+		Device        string
+		Resource      string
+		Value         float64
+		ExpectedMatch bool
+		ExpectedRule  string
+	}{
+		{"High", "monitor", "Uint16", 121, true, "high"},
+		{"At threshold", "monitor", "Uint16", 120, false, ""},
+		{"In range", "monitor", "Uint16", 100, false, ""},
+		{"Low", "monitor", "Uint16", 60, true, "low"},
+		{"Other resource", "monitor", "Float32", 200, false, ""},
+		{"Patient in range", "monitor-1", "Uint16", 150, true, "normal"},
+		{"Patient elevated", "monitor-1", "Uint16", 180, true, "elevated"},
+		{"Patient no band", "monitor-1", "Uint16", 60, false, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			name, _, matched := target.Match(test.Device, test.Resource, test.Value, now)
+			assert.Equal(t, test.ExpectedMatch, matched)
+			assert.Equal(t, test.ExpectedRule, name)
+		})
+	}
+
+	assert.True(t, target.HasResource("monitor", "Uint16", now))
+	assert.False(t, target.HasResource("monitor", "Float32", now))
+
+	target.Update(map[string]config.GlucoseRule{
+		"high": {ResourceName: "Float32", Comparison: config.ComparisonGreaterOrEqual, Threshold: 180, Units: config.UnitsMgDl, Action: config.ActionActuate},
+	}, nil)
+	assert.False(t, target.HasResource("monitor-1", "Uint16", now))
+	name, _, matched := target.Match("monitor-1", "Float32", 180, now)
+	assert.True(t, matched)
+	assert.Equal(t, "high", name)
+}
+
+func TestRuleEngine_MatchSchedule(t *testing.T) {
+	target := NewRuleEngine(nil, map[string]config.PatientConfig{
+		"patient-1": {
+			MonitorDevice: "monitor-1",
+			GlucoseRules: map[string]config.GlucoseRule{
+				"high": {ResourceName: "Uint16", Comparison: config.ComparisonGreater, Threshold: 150, Units: config.UnitsMgDl, Action: config.ActionActuate},
+			},
+			Schedule: config.Schedule{
+				"night": {Start: "22:00", End: "06:00", GlucoseRules: map[string]config.GlucoseRule{
+					"high": {ResourceName: "Uint16", Comparison: config.ComparisonGreater, Threshold: 200, Units: config.UnitsMgDl, Action: config.ActionActuate},
+				}},
+				"evening": {Start: "18:00", End: "22:00", TargetGlucose: 130},
+			},
+		},
+	})
+
+	day := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	evening := time.Date(2024, 1, 1, 19, 0, 0, 0, time.UTC)
+	night := time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)
+
+	_, _, matched := target.Match("monitor-1", "Uint16", 180, day)
+	assert.True(t, matched)
+	_, _, matched = target.Match("monitor-1", "Uint16", 180, evening)
+	assert.True(t, matched, "segment without bands keeps the patient's bands")
+	_, _, matched = target.Match("monitor-1", "Uint16", 180, night)
+	assert.False(t, matched)
+	_, rule, matched := target.Match("monitor-1", "Uint16", 210, night)
+	assert.True(t, matched)
+	assert.Equal(t, 200.0, rule.Threshold)
+}
@@ -0,0 +1,250 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PendingStop is a stop scheduled for an injector, as persisted to the pending stops file.
+type PendingStop struct {
+	DeviceName string    `json:"deviceName"`
+	StopAt     time.Time `json:"stopAt"`
+}
+
+// StopScheduler schedules the command that switches an injector off once a dose has been delivered. Scheduled
+// stops can be cancelled, e.g. when delivery is suspended and the injector is stopped immediately instead.
+// Pending stops are persisted to a file so they can be replayed if the service restarts before they run.
+// It is shared by every path that actuates an injector.
+type StopScheduler struct {
+	mutex     sync.Mutex
+	stateFile string
+	timers    map[string]*time.Timer
+	stopAt    map[string]time.Time
+	stops     map[string]func()
+	// running counts the timers that have not been stopped, whose stop has not yet run or is running
+	running sync.WaitGroup
+}
+
+// NewStopScheduler creates an empty StopScheduler that persists pending stops to the given file. Pending stops are
+// only kept in memory when stateFile is empty.
+func NewStopScheduler(stateFile string) *StopScheduler {
+	return &StopScheduler{
+		stateFile: stateFile,
+		timers:    make(map[string]*time.Timer),
+		stopAt:    make(map[string]time.Time),
+		stops:     make(map[string]func()),
+	}
+}
+
+// Schedule runs stop for the named injector after the given duration, replacing any stop already scheduled for it.
+// The stop is always scheduled, an error is returned if it could not be persisted.
+func (s *StopScheduler) Schedule(deviceName string, after time.Duration, stop func()) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.schedule(deviceName, time.Now().Add(after), stop)
+	return s.save()
+}
+
+// Replay schedules the stops persisted by a previous run of the service. Stops that became due while the service
+// was not running are run immediately, before Replay returns. It returns the number of stops replayed.
+func (s *StopScheduler) Replay(stop func(deviceName string)) (int, error) {
+	pending, err := s.load()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	for _, entry := range pending {
+		deviceName := entry.DeviceName
+		if entry.StopAt.After(now) {
+			s.mutex.Lock()
+			s.schedule(deviceName, entry.StopAt, func() { stop(deviceName) })
+			s.mutex.Unlock()
+			continue
+		}
+
+		// Overdue, the injector may have been left on while the service was down
+		stop(deviceName)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.save(); err != nil {
+		return len(pending), err
+	}
+
+	return len(pending), nil
+}
+
+// Cancel cancels the stop scheduled for the named injector. It returns false if no stop was pending.
+func (s *StopScheduler) Cancel(deviceName string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	timer, exists := s.timers[deviceName]
+	if !exists {
+		return false
+	}
+
+	s.remove(deviceName)
+	return s.stopTimer(timer)
+}
+
+// Flush runs every pending stop now rather than when it is due, and waits for stops that are already running. It
+// is used when shutting down, so no injector is left on once the service exits. It returns the number of stops run.
+func (s *StopScheduler) Flush() int {
+	s.mutex.Lock()
+	timers := make(map[string]*time.Timer, len(s.timers))
+	stops := make(map[string]func(), len(s.timers))
+	for deviceName, timer := range s.timers {
+		// A timer that has already fired is running its stop
+		if s.stopTimer(timer) {
+			timers[deviceName] = timer
+			stops[deviceName] = s.stops[deviceName]
+		}
+	}
+	s.mutex.Unlock()
+
+	for deviceName, stop := range stops {
+		stop()
+
+		s.mutex.Lock()
+		if s.timers[deviceName] == timers[deviceName] {
+			s.remove(deviceName)
+		}
+		s.mutex.Unlock()
+	}
+
+	s.running.Wait()
+	return len(stops)
+}
+
+// Pending reports whether a stop is scheduled for the named injector.
+func (s *StopScheduler) Pending(deviceName string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, exists := s.timers[deviceName]
+	return exists
+}
+
+// schedule starts the timer that runs stop for the named injector at the given time. The stop is only removed
+// from the pending stops once it has run, so a stop interrupted by a restart is replayed. Caller must hold the lock.
+func (s *StopScheduler) schedule(deviceName string, at time.Time, stop func()) {
+	if timer, exists := s.timers[deviceName]; exists {
+		s.stopTimer(timer)
+	}
+
+	var timer *time.Timer
+	s.running.Add(1)
+	timer = time.AfterFunc(time.Until(at), func() {
+		defer s.running.Done()
+		stop()
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.timers[deviceName] == timer {
+			s.remove(deviceName)
+		}
+	})
+	s.timers[deviceName] = timer
+	s.stopAt[deviceName] = at
+	s.stops[deviceName] = stop
+}
+
+// stopTimer stops a timer, returning false if it has already fired and its stop has run or is running. Caller must
+// hold the lock.
+func (s *StopScheduler) stopTimer(timer *time.Timer) bool {
+	if !timer.Stop() {
+		return false
+	}
+	s.running.Done()
+	return true
+}
+
+// remove forgets the stop for the named injector. Failing to persist the removal is not reported, the stale entry
+// at worst stops the injector once more when replayed. Caller must hold the lock.
+func (s *StopScheduler) remove(deviceName string) {
+	delete(s.timers, deviceName)
+	delete(s.stopAt, deviceName)
+	delete(s.stops, deviceName)
+	_ = s.save()
+}
+
+// save writes the pending stops to the state file, replacing it atomically. Caller must hold the lock.
+func (s *StopScheduler) save() error {
+	if s.stateFile == "" {
+		return nil
+	}
+
+	pending := make([]PendingStop, 0, len(s.stopAt))
+	for deviceName, at := range s.stopAt {
+		pending = append(pending, PendingStop{DeviceName: deviceName, StopAt: at})
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].DeviceName < pending[j].DeviceName })
+
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return fmt.Errorf("unable to marshal pending stops: %s", err.Error())
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.stateFile), 0750); err != nil {
+		return fmt.Errorf("unable to create directory for pending stops: %s", err.Error())
+	}
+
+	temp := s.stateFile + ".tmp"
+	if err := os.WriteFile(temp, data, 0640); err != nil {
+		return fmt.Errorf("unable to write pending stops: %s", err.Error())
+	}
+
+	if err := os.Rename(temp, s.stateFile); err != nil {
+		return fmt.Errorf("unable to replace pending stops: %s", err.Error())
+	}
+
+	return nil
+}
+
+// load reads the pending stops from the state file. A missing file has no pending stops.
+func (s *StopScheduler) load() ([]PendingStop, error) {
+	if s.stateFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(s.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pending stops: %s", err.Error())
+	}
+
+	var pending []PendingStop
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal pending stops from %s: %s", s.stateFile, err.Error())
+	}
+
+	return pending, nil
+}
@@ -0,0 +1,184 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStopScheduler_Schedule(t *testing.T) {
+	target := NewStopScheduler("")
+
+	stopped := make(chan string, 2)
+	require.NoError(t, target.Schedule("injector", 10*time.Millisecond, func() { stopped <- "first" }))
+	require.NoError(t, target.Schedule("injector", 20*time.Millisecond, func() { stopped <- "second" }))
+	assert.True(t, target.Pending("injector"))
+
+	select {
+	case actual := <-stopped:
+		assert.Equal(t, "second", actual, "rescheduling replaces the pending stop")
+	case <-time.After(time.Second):
+		assert.Fail(t, "scheduled stop never ran")
+	}
+
+	assert.Eventually(t, func() bool { return !target.Pending("injector") }, time.Second, time.Millisecond)
+}
+
+func TestStopScheduler_Cancel(t *testing.T) {
+	target := NewStopScheduler("")
+
+	stopped := make(chan struct{}, 1)
+	require.NoError(t, target.Schedule("injector", 20*time.Millisecond, func() { stopped <- struct{}{} }))
+
+	assert.True(t, target.Cancel("injector"))
+	assert.False(t, target.Pending("injector"))
+	assert.False(t, target.Cancel("injector"), "nothing left to cancel")
+
+	select {
+	case <-stopped:
+		assert.Fail(t, "cancelled stop ran")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStopScheduler_Flush(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "pending-stops.json")
+	target := NewStopScheduler(stateFile)
+
+	var mutex sync.Mutex
+	var stopped []string
+	stop := func(deviceName string) func() {
+		return func() {
+			mutex.Lock()
+			defer mutex.Unlock()
+			stopped = append(stopped, deviceName)
+		}
+	}
+	require.NoError(t, target.Schedule("injector", time.Hour, stop("injector")))
+	require.NoError(t, target.Schedule("other-injector", time.Hour, stop("other-injector")))
+	require.NoError(t, target.Schedule("cancelled-injector", time.Hour, stop("cancelled-injector")))
+	target.Cancel("cancelled-injector")
+
+	assert.Equal(t, 2, target.Flush())
+	assert.ElementsMatch(t, []string{"injector", "other-injector"}, stopped)
+	assert.False(t, target.Pending("injector"))
+	assert.False(t, target.Pending("other-injector"))
+	data, err := os.ReadFile(stateFile)
+	require.NoError(t, err)
+	assert.Equal(t, "[]", string(data), "flushed stops are no longer pending")
+
+	assert.Equal(t, 0, target.Flush(), "nothing left to flush")
+	assert.Len(t, stopped, 2, "stops only run once")
+}
+
+func TestStopScheduler_Flush_WaitsForRunningStops(t *testing.T) {
+	target := NewStopScheduler("")
+
+	started := make(chan struct{})
+	finished := make(chan struct{})
+	require.NoError(t, target.Schedule("injector", time.Millisecond, func() {
+		close(started)
+		time.Sleep(20 * time.Millisecond)
+		close(finished)
+	}))
+	<-started
+
+	assert.Equal(t, 0, target.Flush())
+	select {
+	case <-finished:
+	default:
+		assert.Fail(t, "Flush returned before the running stop finished")
+	}
+}
+
+func TestStopScheduler_Persistence(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state", "pending-stops.json")
+	target := NewStopScheduler(stateFile)
+
+	require.NoError(t, target.Schedule("injector", time.Hour, func() {}))
+	require.NoError(t, target.Schedule("other-injector", time.Hour, func() {}))
+	assert.True(t, target.Cancel("other-injector"))
+
+	data, err := os.ReadFile(stateFile)
+	require.NoError(t, err)
+	var pending []PendingStop
+	require.NoError(t, json.Unmarshal(data, &pending))
+	require.Len(t, pending, 1)
+	assert.Equal(t, "injector", pending[0].DeviceName)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), pending[0].StopAt, time.Minute)
+
+	target.Cancel("injector")
+	stopped := make(chan struct{}, 1)
+	require.NoError(t, target.Schedule("injector", 10*time.Millisecond, func() { stopped <- struct{}{} }))
+	<-stopped
+	assert.Eventually(t, func() bool {
+		data, err := os.ReadFile(stateFile)
+		return err == nil && string(data) == "[]"
+	}, time.Second, time.Millisecond, "stop removed once it has run")
+}
+
+func TestStopScheduler_Replay(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "pending-stops.json")
+	pending := []PendingStop{
+		{DeviceName: "overdue-injector", StopAt: time.Now().Add(-time.Minute)},
+		{DeviceName: "injector", StopAt: time.Now().Add(time.Hour)},
+	}
+	data, err := json.Marshal(pending)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(stateFile, data, 0640))
+
+	target := NewStopScheduler(stateFile)
+	stopped := make(chan string, 2)
+	replayed, err := target.Replay(func(deviceName string) { stopped <- deviceName })
+	require.NoError(t, err)
+	assert.Equal(t, 2, replayed)
+
+	require.Len(t, stopped, 1, "overdue stop runs before Replay returns")
+	assert.Equal(t, "overdue-injector", <-stopped)
+	assert.False(t, target.Pending("overdue-injector"))
+	assert.True(t, target.Pending("injector"))
+	assert.Empty(t, stopped, "a stop that is not yet due is scheduled")
+
+	// Flushing runs the replayed stop rather than waiting for it to be due
+	assert.Equal(t, 1, target.Flush())
+	require.Len(t, stopped, 1)
+	assert.Equal(t, "injector", <-stopped)
+	assert.False(t, target.Pending("injector"))
+	data, err = os.ReadFile(stateFile)
+	require.NoError(t, err)
+	assert.Equal(t, "[]", string(data))
+}
+
+func TestStopScheduler_Replay_Errors(t *testing.T) {
+	replayed, err := NewStopScheduler(filepath.Join(t.TempDir(), "missing.json")).Replay(func(string) {})
+	require.NoError(t, err, "nothing to replay when no stops were persisted")
+	assert.Zero(t, replayed)
+
+	stateFile := filepath.Join(t.TempDir(), "pending-stops.json")
+	require.NoError(t, os.WriteFile(stateFile, []byte("not json"), 0640))
+	_, err = NewStopScheduler(stateFile).Replay(func(string) {})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unable to unmarshal pending stops")
+}
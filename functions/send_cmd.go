@@ -20,17 +20,30 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"strconv"
+	"math"
 	"time"
 
 	"github.com/edgexfoundry/app-functions-sdk-go/v3/pkg/interfaces"
-    "github.com/edgexfoundry/go-mod-core-contracts/v3/dtos"
 	"github.com/edgexfoundry/go-mod-core-contracts/v3/clients/http"
-	"github.com/edgexfoundry/go-mod-core-contracts/v3/dtos/requests"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/clients/logger"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/dtos"
 	"github.com/edgexfoundry/go-mod-core-contracts/v3/dtos/common"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/dtos/requests"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/models"
 	"github.com/google/uuid"
+
+	"app-insulin-service/config"
 )
 
+// predictedLowBand and predictedLowRule describe the notification sent when insulin is suspended for a predicted low
+const predictedLowBand = "predicted-low"
+
+var predictedLowRule = config.GlucoseRule{
+	Units:    config.UnitsMgDl,
+	Severity: models.Critical,
+	Category: "PREDICTED-HYPOGLYCEMIA",
+}
+
 type ActionRequest struct {
 	Action       string `json:"action"`
 	DeviceName   string `json:"deviceName"`
@@ -39,14 +52,63 @@ type ActionRequest struct {
 	Value        string `json:"value"`
 }
 
+// SendCommand evaluates glucose readings against the configured rules and commands the insulin injector. It is the
+// single decision engine for glucose readings, from the EdgeX MessageBus and from the MQTT glucose topics alike.
 type SendCommand struct {
+	rules          *RuleEngine
+	decoder        *ReadingDecoder
+	insulinOnBoard *InsulinOnBoard
+	doseCalculator *DoseCalculator
+	suspension     *Suspension
+	scheduler      *StopScheduler
+	history        *GlucoseHistory
+	injector       *InjectorCommander
+	lockout        *Lockout
+	patients       *Patients
+	filter         *GlucoseFilter
+	liveness       *SensorLiveness
+	// sendNotification, postAlert and postLiveData are replaced in tests to avoid sending notifications and posting
+	// to the dashboard
+	sendNotification func(lc logger.LoggingClient, notification dtos.Notification)
+	postAlert        func(AlertData) (string, error)
+	postLiveData     func(DeviceData) (string, error)
+}
+
+// NewSendCommand creates a SendCommand that evaluates readings against the configured glucose rules and
+// doses insulin using the shared dose calculator, insulin on board, suspension, stop scheduler, glucose history,
+// injector commander and lockout. Readings are filtered by the shared glucose filter, recorded by the shared sensor
+// liveness and dosed for the patient wearing the monitor they are from.
+func NewSendCommand(appCustom config.AppCustomConfig, insulinOnBoard *InsulinOnBoard, doseCalculator *DoseCalculator,
+	suspension *Suspension, scheduler *StopScheduler, history *GlucoseHistory, injector *InjectorCommander, lockout *Lockout,
+	patients *Patients, filter *GlucoseFilter, liveness *SensorLiveness) SendCommand {
+	return SendCommand{
+		rules:            NewRuleEngine(appCustom.GlucoseRules, appCustom.Patients),
+		decoder:          NewReadingDecoder(appCustom.GlucoseResources),
+		insulinOnBoard:   insulinOnBoard,
+		doseCalculator:   doseCalculator,
+		suspension:       suspension,
+		scheduler:        scheduler,
+		history:          history,
+		injector:         injector,
+		lockout:          lockout,
+		patients:         patients,
+		filter:           filter,
+		liveness:         liveness,
+		sendNotification: sendNotification,
+		postAlert:        PostAlertData,
+		postLiveData:     PostLiveData,
+	}
 }
 
-func NewSendCommand() SendCommand {
-	return SendCommand{}
+// UpdateConfig applies updated custom configuration to CheckAndSendCommand without requiring a restart.
+func (s *SendCommand) UpdateConfig(appCustom config.AppCustomConfig) {
+	s.rules.Update(appCustom.GlucoseRules, appCustom.Patients)
+	s.decoder.UpdateConfig(appCustom.GlucoseResources)
 }
 
-func(s *SendCommand) CheckAndSendCommand(funcCtx interfaces.AppFunctionContext, data interface{})  (bool, interface{}) {
+// CheckAndSendCommand matches each reading in the Event against the glucose response bands for the
+// Event's device and takes the action configured for the matching band.
+func (s *SendCommand) CheckAndSendCommand(funcCtx interfaces.AppFunctionContext, data interface{}) (bool, interface{}) {
 
 	lc := funcCtx.LoggingClient()
 
@@ -54,36 +116,88 @@ func(s *SendCommand) CheckAndSendCommand(funcCtx interfaces.AppFunctionContext,
 
 	if event, ok := data.(dtos.Event); ok {
 		for _, reading := range event.Readings {
-			intVar, err := strconv.Atoi(reading.Value)
+			readingTime := time.Now()
+			if reading.Origin > 0 {
+				readingTime = time.Unix(0, reading.Origin)
+			}
+
+			resourceName := s.decoder.ResourceName(reading)
+			if !s.rules.HasResource(event.DeviceName, resourceName, readingTime) {
+				continue
+			}
+
+			// A reading that cannot be decoded is skipped, the rest of the event is still acted on
+			raw, err := DecodeGlucose(reading)
 			if err != nil {
-				fmt.Errorf("CheckAndSendCommand int conversion error: %s", err.Error())
-				return false, data
+				lc.Errorf("CheckAndSendCommand unable to decode '%s' reading from %s: %s", reading.ResourceName, event.DeviceName, err.Error())
+				continue
+			}
+			// Even an outlier shows the monitor is still publishing
+			s.liveness.Received(event.DeviceName, readingTime)
+
+			// Dosing is decided on the filtered glucose, lows on the lower of the raw and filtered glucose, so the
+			// filter damps dosing without ever delaying a suspension
+			filtered := s.filter.Filter(event.DeviceName, raw, readingTime)
+			trend := s.history.Record(event.DeviceName, filtered, readingTime)
+			if filtered.Rejected {
+				lc.Warnf("Glucose reading of %v from %s rejected as an outlier, %s", raw, event.DeviceName, filtered.Reason)
+				// A fast fall may be real, rejection only keeps the reading from dosing, so a raw reading in a
+				// suspend band still suspends delivery
+				if name, rule, matched := s.rules.Match(event.DeviceName, resourceName, raw, readingTime); matched && rule.Action == config.ActionSuspend {
+					reason := fmt.Sprintf("glucose band '%s', reading rejected as an outlier", name)
+					s.suspendInsulin(funcCtx, s.patients.ForMonitor(event.DeviceName), raw, reason, name, rule)
+				}
+				continue
+			}
+			value := filtered.Value
+			if value != raw {
+				lc.Debugf("Glucose reading of %v from %s filtered to %.1f", raw, event.DeviceName, value)
+			}
+			low := math.Min(raw, value)
+			// The controller follows every accepted reading, the bands below decide whether it is dosed on
+			s.doseCalculator.Observe(event.DeviceName, value, readingTime)
+
+			patient := s.patients.ForMonitor(event.DeviceName)
+			injector := patient.InjectorDevice
+			if trend.PredictedLow {
+				lc.Warnf("Glucose from %s projected to fall to %.0f (%.2f per minute), predictive action is '%s'",
+					event.DeviceName, trend.Projected, trend.RatePerMinute, s.history.PredictiveAction())
+				if s.history.PredictiveAction() == config.ActionSuspend {
+					reason := fmt.Sprintf("glucose projected to fall to %.0f", trend.Projected)
+					s.suspendInsulin(funcCtx, patient, value, reason, predictedLowBand, predictedLowRule)
+				}
+			} else if s.suspension.Observe(injector, low) {
+				lc.Infof("Insulin delivery by %s resumed, glucose recovered to %v", injector, low)
 			}
-			if reading.ResourceName == "Uint16" && intVar > 120 {
-				lc.Info("Sending Insulin actuate command...")
 
-				device := "insulin-injector"
-				command := "WriteBoolValue"
-				settings := make(map[string]string)
-				settings["Bool"] = "true"
-				settings["EnableRandomization_Bool"] = "false"
-				funcCtx.CommandClient().IssueSetCommandByName(context.Background(), device, command, settings)
+			name, rule, matched := s.rules.Match(event.DeviceName, resourceName, value, readingTime)
+			if low < value {
+				// A raw low in a suspend band suspends while the filtered glucose still lags above it
+				if lowName, lowRule, lowMatched := s.rules.Match(event.DeviceName, resourceName, low, readingTime); lowMatched && lowRule.Action == config.ActionSuspend {
+					name, rule, matched, value = lowName, lowRule, true, low
+				}
+			}
+			if !matched {
+				continue
+			}
 
-				go stopInsulin(funcCtx)
+			lc.Infof("Glucose band '%s' (%s) matched %s reading of %v %s from %s", name, rule.Action, reading.ResourceName, value, rule.Units, event.DeviceName)
 
+			switch rule.Action {
+			case config.ActionActuate:
 				//Sending notifications
-				notify(funcCtx, intVar)
+				s.notify(funcCtx, patient, value, name, rule)
 
-				lc.Info("Sending glucose set command...")
+				s.actuate(funcCtx, patient, event.DeviceName, value, readingTime, trend)
 
-				//device = "Random-UnsignedInteger-Device"
-				device = "blood-glucose-monitor"
-				command = "WriteUint16Value"
-				settings = make(map[string]string)
-				settings["Uint16"] = "91"
-				settings["EnableRandomization_Uint16"] = "false"
-				funcCtx.CommandClient().IssueSetCommandByName(context.Background(), device, command, settings)
+			case config.ActionSuspend:
+				s.suspendInsulin(funcCtx, patient, value, fmt.Sprintf("glucose band '%s'", name), name, rule)
 
+			case config.ActionNotify:
+				s.notify(funcCtx, patient, value, name, rule)
+
+			case config.ActionNone:
+				lc.Debugf("No action for glucose band '%s'", name)
 			}
 		}
 	}
@@ -91,52 +205,211 @@ func(s *SendCommand) CheckAndSendCommand(funcCtx interfaces.AppFunctionContext,
 	return true, data
 }
 
-func stopInsulin(funcCtx interfaces.AppFunctionContext) {
-
+// actuate doses insulin for a glucose reading from the monitor when every check allows it. Once the injector is
+// started the dashboard shows the patient's insulin delivery live, with an alert for the dose, and the monitor is
+// reset.
+func (s *SendCommand) actuate(funcCtx interfaces.AppFunctionContext, patient PatientProfile, monitor string, value float64,
+	readingTime time.Time, trend GlucoseTrend) {
 	lc := funcCtx.LoggingClient()
-	lc.Info("Scheduling Insulin stop command...")
-	time.Sleep(time.Minute)
-	lc.Info("Sending Insulin stop command...")
 
-	//device := "Random-Boolean-Device"
-	device := "insulin-injector"
-	command := "WriteBoolValue"
+	units, started := s.start(lc, patient, monitor, value, readingTime, trend)
+	if !started {
+		return
+	}
+
+	// Posted once the injector's lock is released, so the dashboard never holds up an emergency stop
+	s.showDelivery(lc, patient, true)
+	message := fmt.Sprintf("Insulin actuated for %.2f units, current glucose - %s", units, patient.FormatGlucose(value))
+	if _, err := s.postAlert(NewAlertData(patient.Asset, value, message)); err != nil {
+		lc.Errorf("unable to post insulin actuated alert: %s", err.Error())
+	}
+
+	lc.Info("Sending glucose set command...")
+
+	//monitor := "Random-UnsignedInteger-Device"
+	command := "WriteUint16Value"
 	settings := make(map[string]string)
-	settings["Bool"] = "false"
-	settings["EnableRandomization_Bool"] = "false"
-	funcCtx.CommandClient().IssueSetCommandByName(context.Background(), device, command, settings)
+	settings["Uint16"] = "91"
+	settings["EnableRandomization_Uint16"] = "false"
+	// Events built for readings received over MQTT may have no command client to reset the monitor with
+	if commandClient := funcCtx.CommandClient(); commandClient != nil {
+		commandClient.IssueSetCommandByName(context.Background(), monitor, command, settings)
+	}
+}
+
+// start starts the patient's injector for the dose calculated for the reading and returns the units started, or
+// false if any check blocks the actuation or the injector is not confirmed started. The checks and the actuation are
+// made holding the lock of the patient's injector, so an injector suspended, or dosed, by another path meanwhile is
+// not actuated on a decision made before.
+func (s *SendCommand) start(lc logger.LoggingClient, patient PatientProfile, monitor string, value float64,
+	readingTime time.Time, trend GlucoseTrend) (float64, bool) {
+	device := patient.InjectorDevice
+
+	unlock := s.injector.Lock(device)
+	defer unlock()
+
+	if s.suspension.IsSuspended(device) {
+		lc.Warnf("Insulin actuation blocked, delivery by %s is suspended", device)
+		return 0, false
+	}
+	if age, stale := s.liveness.Stale(monitor, readingTime, time.Now()); stale {
+		lc.Warnf("Insulin actuation blocked, glucose reading from %s is %s old", monitor, age.Round(time.Second))
+		return 0, false
+	}
+	if trend.PredictedLow {
+		lc.Warnf("Insulin actuation skipped, glucose from %s is projected to go low", monitor)
+		return 0, false
+	}
+	now := time.Now()
+	remaining, acquired := s.lockout.TryAcquire(device, now)
+	if !acquired {
+		s.lockout.Skip(device)
+		lc.Infof("Insulin actuation skipped, %s is locked out for another %s", device, remaining.Round(time.Second))
+		return 0, false
+	}
+
+	// The limit reached alert is raised by the dose calculator
+	dose := s.doseCalculator.Calculate(monitor, device, value, now)
+	if dose.LimitReached {
+		lc.Warnf("Insulin actuation by %s refused, %s", device, dose.Reason)
+		s.lockout.Rollback(device, now)
+		return 0, false
+	}
+	if dose.Units <= 0 {
+		lc.Infof("No insulin delivered by %s, %s (correction %.2f units, %.2f units on board)",
+			device, dose.Reason, dose.CorrectionUnits, dose.InsulinOnBoard)
+		s.lockout.Rollback(device, now)
+		return 0, false
+	}
+	if dose.Reason != "" {
+		lc.Warnf("Insulin dose for %s %s", device, dose.Reason)
+	}
+	if dose.Segment != "" {
+		lc.Infof("Insulin dose for %s uses target %v and sensitivity %v of schedule segment '%s'",
+			device, dose.TargetGlucose, dose.SensitivityFactor, dose.Segment)
+	}
+
+	lc.Infof("Sending Insulin actuate command for %.2f units...", dose.Units)
+
+	actuation := s.doseCalculator.Actuation(patient.At(now).Insulin, dose.Units)
+	// Reserved before the injector is started, so the dose counts against the limits from the moment it is decided
+	reserved := s.insulinOnBoard.Reserve(device, dose.Units, now)
+	// The stop is persisted before the injector is started, so it is replayed if the service restarts
+	// while the actuation is in progress
+	stop := func() { s.stopInsulin(lc, patient) }
+	if actuation.StopAfter > 0 {
+		lc.Infof("Scheduling Insulin stop command in %s...", actuation.StopAfter)
+		if err := s.scheduler.Schedule(device, actuation.StopAfter, stop); err != nil {
+			lc.Errorf("Insulin stop for %s will not survive a restart: %s", device, err.Error())
+		}
+	}
+
+	err := s.injector.Start(device, actuation)
+	if err != nil {
+		lc.Errorf("Insulin actuation by %s not confirmed, stopping injector: %s", device, err.Error())
+		s.insulinOnBoard.Release(device, reserved)
+		s.lockout.Rollback(device, now)
+		s.scheduler.Cancel(device)
+		// Stop escalates an injector fault alert itself when the injector cannot be confirmed stopped
+		_ = s.injector.Stop(device)
+		return 0, false
+	}
+
+	// Scheduled again so the duration runs from the confirmed start rather than from the command
+	if actuation.StopAfter > 0 {
+		if err := s.scheduler.Schedule(device, actuation.StopAfter, stop); err != nil {
+			lc.Errorf("Insulin stop for %s will not survive a restart: %s", device, err.Error())
+		}
+	}
+	return dose.Units, true
+}
+
+// stopInsulin stops the patient's injector when its scheduled stop is due and shows the delivery stopped on the
+// dashboard.
+func (s *SendCommand) stopInsulin(lc logger.LoggingClient, patient PatientProfile) {
+	lc.Info("Sending Insulin stop command...")
+	// Stop escalates an injector fault alert itself when the injector cannot be confirmed stopped
+	_ = s.injector.Stop(patient.InjectorDevice)
+	s.showDelivery(lc, patient, false)
+}
+
+// StopInsulin stops the named injector and shows the delivery stopped on the dashboard, as a scheduled stop does.
+// It is used for the stops replayed after a restart.
+func (s *SendCommand) StopInsulin(lc logger.LoggingClient, deviceName string) {
+	s.stopInsulin(lc, s.patients.ForInjector(deviceName))
 }
 
-func notify(funcCtx interfaces.AppFunctionContext, reading int) {
+// showDelivery posts whether the patient's injector is delivering insulin to the dashboard.
+func (s *SendCommand) showDelivery(lc logger.LoggingClient, patient PatientProfile, delivering bool) {
+	if _, err := s.postLiveData(NewDeviceData(patient.Asset, delivering)); err != nil {
+		lc.Errorf("unable to post live insulin data: %s", err.Error())
+	}
+}
+
+// suspendInsulin stops the injector immediately, cancels its scheduled stop and raises an urgent alert the first
+// time a low, or predicted low, glucose is seen. Further actuation is blocked until glucose recovers.
+func (s *SendCommand) suspendInsulin(funcCtx interfaces.AppFunctionContext, patient PatientProfile, value float64, reason string, band string, rule config.GlucoseRule) {
 	lc := funcCtx.LoggingClient()
- 	// Create a new notification client edgex-support-notifications 10.43.117.99
+	device := patient.InjectorDevice
+
+	if !s.suspension.Suspend(device, reason, value, time.Now()) {
+		lc.Debugf("Insulin delivery by %s already suspended", device)
+		return
+	}
+
+	lc.Warnf("Suspending insulin delivery by %s, %s at %v %s", device, reason, value, rule.Units)
+
+	// Suspended first, so the stop waits only for an actuation already under way
+	unlock := s.injector.Lock(device)
+	if s.scheduler.Cancel(device) {
+		lc.Infof("Cancelled scheduled Insulin stop command for %s", device)
+	}
+	// Stop escalates an injector fault alert itself when the injector cannot be confirmed stopped
+	_ = s.injector.Stop(device)
+	unlock()
+	s.showDelivery(lc, patient, false)
+
+	s.notify(funcCtx, patient, value, band, rule)
+
+	message := fmt.Sprintf("Insulin suspended, %s, current glucose - %s", reason, patient.FormatGlucose(value))
+	if _, err := s.postAlert(NewAlertData(patient.Asset, value, message)); err != nil {
+		lc.Errorf("unable to post low glucose alert: %s", err.Error())
+	}
+}
+
+func (s *SendCommand) notify(funcCtx interfaces.AppFunctionContext, patient PatientProfile, reading float64, band string, rule config.GlucoseRule) {
+	s.sendNotification(funcCtx.LoggingClient(), dtos.Notification{
+		Sender:      "Glucose-Monitor-Device",
+		Category:    rule.Category,
+		Severity:    rule.Severity,
+		Content:     "Glucose level - " + patient.FormatGlucose(reading),
+		Labels:      patient.Labels("glucose", band),
+		Status:      "NEW",
+		ContentType: "json",
+		Description: "Glucose band '" + band + "' alert",
+	})
+}
+
+func sendNotification(lc logger.LoggingClient, notification dtos.Notification) {
+	// Create a new notification client edgex-support-notifications 10.43.117.99
 	client := http.NewNotificationClient("http://edgex-support-notifications:59860", nil, false)
 
 	// Create a new notification
-	notification := requests.AddNotificationRequest{
+	request := requests.AddNotificationRequest{
 		BaseRequest: common.BaseRequest{
-			RequestId: uuid.New().String(),  // Generate a new UUID
+			RequestId: uuid.New().String(), // Generate a new UUID
 			Versionable: common.Versionable{
-				ApiVersion: "v3",  // Replace with the API version you're using
+				ApiVersion: "v3", // Replace with the API version you're using
 			},
 		},
-		Notification: dtos.Notification{
-			Sender:   "Glucose-Monitor-Device",
-			Category: "ALERT",
-			Severity: "CRITICAL",
-			Content:  "Glucose level - "+strconv.Itoa(reading),
-			Labels:   []string{"glucose", "alert"},
-			Status:   "NEW",
-			ContentType: "json",
-			Description: "High Glucose Level Alert",
-		},
+		Notification: notification,
 	}
 
 	// Send the notification
-	_, err := client.SendNotification(context.Background(), []requests.AddNotificationRequest{notification})
+	_, err := client.SendNotification(context.Background(), []requests.AddNotificationRequest{request})
 	if err != nil {
-		// Handle error
-		fmt.Printf("Error sending notification: %v", err)
+		lc.Errorf("Error sending %s notification: %s", notification.Category, err.Error())
+		return
 	}
 	lc.Info("Notification sent successfully")
 }
@@ -167,7 +440,6 @@ func (s *SendCommand) SendCommand(funcCtx interfaces.AppFunctionContext, data in
 		return false, fmt.Errorf("function LogEventDetails in pipeline '%s', type received is not an Event", funcCtx.PipelineId())
 	}
 
-
 	action := "set"
 	device := event.DeviceName
 	command := "WriteUint16Value"
@@ -183,7 +455,7 @@ func (s *SendCommand) SendCommand(funcCtx interfaces.AppFunctionContext, data in
 		settings := make(map[string]string)
 		settings["Uint16"] = "88"
 		response, err = funcCtx.CommandClient().IssueSetCommandByName(context.Background(), device, command, settings)
-		//response, err = funcCtx.CommandClient().IssueSetCommand("Random-Integer-Device", "Uint16", "100") 
+		//response, err = funcCtx.CommandClient().IssueSetCommand("Random-Integer-Device", "Uint16", "100")
 		if err != nil {
 			return false, fmt.Errorf("failed to send '%s' set command to '%s' device: %s", command, device, err.Error())
 		}
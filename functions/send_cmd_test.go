@@ -0,0 +1,313 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/edgexfoundry/app-functions-sdk-go/v3/pkg"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/clients/logger"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/common"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/dtos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"app-insulin-service/config"
+)
+
+// sentAlerts records the notifications, dashboard alerts and live insulin data sent by a SendCommand under test.
+type sentAlerts struct {
+	notifications []string
+	alerts        []string
+	alertValues   []int
+	liveData      []DeviceData
+}
+
+// newTestSendCommand returns a SendCommand dosing through the fake injector for Uint16 readings from any monitor,
+// actuating above 180 mg/dL and suspending below 70 mg/dL, with the given glucose filter.
+func newTestSendCommand(injector *fakeInjector, filter config.FilterConfig) (*SendCommand, *sentAlerts) {
+	insulin := testInsulinConfig(config.DecayCurveLinear)
+	patients := newTestPatients(nil)
+	commander, _, _ := newTestInjectorCommander(injector.client())
+	insulinOnBoard := NewInsulinOnBoard(insulin)
+	doseCalculator := NewDoseCalculator(testInjectorConfig(), logger.NewMockClient(), insulinOnBoard, patients)
+	doseCalculator.alert = func(string, string, DoseCalculation) {}
+	liveness, _ := newTestSensorLiveness(config.LivenessConfig{StaleMinutes: 10}, time.Now())
+
+	appCustom := config.AppCustomConfig{GlucoseRules: map[string]config.GlucoseRule{
+		"high": {ResourceName: "Uint16", Comparison: config.ComparisonGreater, Threshold: 180, Units: config.UnitsMgDl, Action: config.ActionActuate},
+		"low":  {ResourceName: "Uint16", Comparison: config.ComparisonLess, Threshold: 70, Units: config.UnitsMgDl, Action: config.ActionSuspend},
+	}}
+	target := NewSendCommand(appCustom, insulinOnBoard, doseCalculator, NewSuspension(90), NewStopScheduler(""),
+		NewGlucoseHistory(testSuspendConfig(config.ActionSuspend)), commander, NewLockout(config.LockoutConfig{Minutes: 15}),
+		patients, NewGlucoseFilter(filter), liveness)
+
+	sent := &sentAlerts{}
+	target.sendNotification = func(_ logger.LoggingClient, notification dtos.Notification) {
+		sent.notifications = append(sent.notifications, notification.Description)
+	}
+	target.postAlert = func(alert AlertData) (string, error) {
+		sent.alerts = append(sent.alerts, alert.Message)
+		sent.alertValues = append(sent.alertValues, alert.Value)
+		return "", nil
+	}
+	target.postLiveData = func(deviceData DeviceData) (string, error) {
+		sent.liveData = append(sent.liveData, deviceData)
+		return "", nil
+	}
+	return &target, sent
+}
+
+// glucoseEvent returns an event from the monitor with a single Uint16 glucose reading taken at the given time.
+func glucoseEvent(t *testing.T, glucose uint16, at time.Time) dtos.Event {
+	event := dtos.NewEvent("monitor-profile", "monitor", "glucose")
+	require.NoError(t, event.AddSimpleReading("Uint16", common.ValueTypeUint16, glucose))
+	event.Readings[0].Origin = at.UnixNano()
+	return event
+}
+
+func TestSendCommand_CheckAndSendCommand_Outlier(t *testing.T) {
+	filter := config.FilterConfig{Type: config.FilterNone, MaxRatePerMinute: 5, MaxRejected: 2}
+	now := time.Now()
+
+	tests := []struct {
+		Name              string
+		Glucose           uint16
+		ExpectedSuspended bool
+		ExpectedCommands  []string
+	}{
+		{"Fast rise does not dose", 250, false, nil},
+		{"Fast fall into suspend band suspends", 60, true, []string{"stop"}},
+		{"Fast fall above suspend band", 100, false, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			injector := &fakeInjector{}
+			target, sent := newTestSendCommand(injector, filter)
+			funcCtx := pkg.NewAppFuncContextForTest("", logger.NewMockClient())
+
+			target.CheckAndSendCommand(funcCtx, glucoseEvent(t, 150, now.Add(-5*time.Minute)))
+			target.CheckAndSendCommand(funcCtx, glucoseEvent(t, test.Glucose, now))
+
+			_, commands := injector.state()
+			assert.Equal(t, test.ExpectedCommands, commands)
+			assert.Equal(t, test.ExpectedSuspended, target.suspension.IsSuspended("injector"))
+			assert.Zero(t, target.insulinOnBoard.Active("injector", now), "an outlier never doses")
+			_, latest, found := target.history.Latest(func(string) bool { return true })
+			require.True(t, found)
+			assert.Equal(t, 150.0, latest.Value, "an outlier is not the latest glucose")
+			samples := target.history.Samples("monitor")
+			require.Len(t, samples, 2, "an outlier is recorded")
+			assert.Equal(t, GlucoseSample{Raw: float64(test.Glucose), Time: time.Unix(0, now.UnixNano()), Rejected: true}, samples[1])
+			if test.ExpectedSuspended {
+				assert.Equal(t, []string{"Glucose band 'low' alert"}, sent.notifications)
+				assert.Len(t, sent.alerts, 1)
+				assert.Contains(t, sent.alerts[0], "reading rejected as an outlier")
+			}
+		})
+	}
+}
+
+func TestSendCommand_CheckAndSendCommand_LiveData(t *testing.T) {
+	injector := &fakeInjector{}
+	target, sent := newTestSendCommand(injector, config.FilterConfig{Type: config.FilterNone})
+	funcCtx := pkg.NewAppFuncContextForTest("", logger.NewMockClient())
+	delivering := DeviceData{AssetId: 34, DeviceName: "Patient_Monitor_19524", Value: 1, SensorName: "insulin"}
+	stopped := DeviceData{AssetId: 34, DeviceName: "Patient_Monitor_19524", Value: 0, SensorName: "insulin"}
+
+	target.CheckAndSendCommand(funcCtx, glucoseEvent(t, 250, time.Now()))
+
+	on, _ := injector.state()
+	require.True(t, on)
+	assert.Equal(t, []DeviceData{delivering}, sent.liveData)
+	assert.Equal(t, []string{"Patient_Monitor_19524: Insulin actuated for 2.00 units, current glucose - 250 mg/dL"}, sent.alerts)
+
+	// The scheduled stop shows the delivery stopped
+	require.True(t, target.scheduler.Pending("injector"))
+	assert.Equal(t, 1, target.scheduler.Flush())
+	on, _ = injector.state()
+	assert.False(t, on)
+	assert.Equal(t, []DeviceData{delivering, stopped}, sent.liveData)
+}
+
+func TestSendCommand_CheckAndSendCommand_LiveData_Suspended(t *testing.T) {
+	injector := &fakeInjector{}
+	target, sent := newTestSendCommand(injector, config.FilterConfig{Type: config.FilterNone})
+	funcCtx := pkg.NewAppFuncContextForTest("", logger.NewMockClient())
+
+	target.CheckAndSendCommand(funcCtx, glucoseEvent(t, 250, time.Now().Add(-time.Minute)))
+	target.CheckAndSendCommand(funcCtx, glucoseEvent(t, 60, time.Now()))
+
+	// Suspending cancels the scheduled stop, so it shows the delivery stopped itself
+	assert.False(t, target.scheduler.Pending("injector"))
+	require.Len(t, sent.liveData, 2)
+	assert.Equal(t, 1, sent.liveData[0].Value)
+	assert.Equal(t, 0, sent.liveData[1].Value)
+}
+
+func TestSendCommand_CheckAndSendCommand_FilterLag(t *testing.T) {
+	filter := config.FilterConfig{Type: config.FilterMedian, WindowSize: 5}
+	injector := &fakeInjector{}
+	target, sent := newTestSendCommand(injector, filter)
+	funcCtx := pkg.NewAppFuncContextForTest("", logger.NewMockClient())
+	start := time.Now().Add(-30 * time.Minute)
+
+	tests := []struct {
+		Name              string
+		Glucose           uint16
+		ExpectedSuspended bool
+	}{
+		{"In range", 150, false},
+		{"Still in range", 150, false},
+		{"Steady", 150, false},
+		{"Raw low suspends while the median is 150", 60, true},
+		{"Raw below resume while the median is 150", 80, true},
+		{"Raw and median recovered", 120, false},
+	}
+
+	// Each reading is received in turn by the same SendCommand
+	for index, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			target.CheckAndSendCommand(funcCtx, glucoseEvent(t, test.Glucose, start.Add(time.Duration(index)*5*time.Minute)))
+			assert.Equal(t, test.ExpectedSuspended, target.suspension.IsSuspended("injector"))
+		})
+	}
+
+	assert.Contains(t, target.history.Samples("monitor"),
+		GlucoseSample{Value: 150, Raw: 60, Time: time.Unix(0, start.Add(15*time.Minute).UnixNano())}, "raw and filtered are recorded")
+	_, commands := injector.state()
+	assert.Equal(t, []string{"stop"}, commands)
+	assert.Equal(t, []string{"Glucose band 'low' alert"}, sent.notifications)
+	require.Len(t, sent.alerts, 1)
+	assert.Contains(t, sent.alerts[0], "current glucose - 60 mg/dL")
+}
+
+func TestSendCommand_CheckAndSendCommand_ControllerObservesEveryReading(t *testing.T) {
+	injector := &fakeInjector{}
+	target, sent := newTestSendCommand(injector, config.FilterConfig{Type: config.FilterNone})
+	target.patients.UpdateConfig(config.AppCustomConfig{
+		Asset:      testAsset,
+		Insulin:    testInsulinConfig(config.DecayCurveLinear),
+		Injector:   testInjectorConfig(),
+		Controller: config.ControllerConfig{Type: config.ControllerPID, Ki: 0.001, IntegralLimit: 1},
+	})
+	funcCtx := pkg.NewAppFuncContextForTest("", logger.NewMockClient())
+	start := time.Now().Add(-10 * time.Minute)
+
+	// In range readings are not dosed on, the controller still integrates them
+	target.CheckAndSendCommand(funcCtx, glucoseEvent(t, 150, start))
+	target.CheckAndSendCommand(funcCtx, glucoseEvent(t, 150, start.Add(5*time.Minute)))
+	assert.Empty(t, sent.alerts)
+	target.CheckAndSendCommand(funcCtx, glucoseEvent(t, 210, start.Add(10*time.Minute)))
+
+	assert.Equal(t, []string{"Patient_Monitor_19524: Insulin actuated for 0.70 units, current glucose - 210 mg/dL"}, sent.alerts)
+}
+
+func TestSendCommand_StopInsulin(t *testing.T) {
+	injector := &fakeInjector{}
+	target, sent := newTestSendCommand(injector, config.FilterConfig{Type: config.FilterNone})
+
+	// As for a stop replayed after a restart, nothing was actuated by this SendCommand
+	target.StopInsulin(logger.NewMockClient(), "injector")
+
+	_, commands := injector.state()
+	assert.Equal(t, []string{"stop"}, commands)
+	assert.Equal(t, []DeviceData{{AssetId: 34, DeviceName: "Patient_Monitor_19524", Value: 0, SensorName: "insulin"}}, sent.liveData)
+}
+
+func TestSendCommand_CheckAndSendCommand_Actions(t *testing.T) {
+	high := config.GlucoseRule{ResourceName: "Uint16", Comparison: config.ComparisonGreater, Threshold: 180, Units: config.UnitsMgDl, Action: config.ActionActuate}
+	low := config.GlucoseRule{ResourceName: "Uint16", Comparison: config.ComparisonLess, Threshold: 70, Units: config.UnitsMgDl, Action: config.ActionSuspend}
+	elevated, inRange, falling := high, high, high
+	elevated.Action, inRange.Action, falling.Threshold = config.ActionNotify, config.ActionNone, 130
+
+	tests := []struct {
+		Name                  string
+		Rules                 map[string]config.GlucoseRule
+		PredictiveAction      string
+		Seed                  []float64
+		Readings              []uint16
+		ExpectedCommands      []string
+		ExpectedNotifications []string
+		ExpectedAlerts        []string
+		ExpectedLiveData      []int
+		ExpectedLocked        bool
+		ExpectedSuspended     bool
+	}{
+		{"Notify", map[string]config.GlucoseRule{"elevated": elevated}, config.ActionSuspend, nil, []uint16{200},
+			nil, []string{"Glucose band 'elevated' alert"}, nil, nil, false, false},
+		{"None", map[string]config.GlucoseRule{"in-range": inRange}, config.ActionSuspend, nil, []uint16{200},
+			nil, nil, nil, nil, false, false},
+		{"Suspend", map[string]config.GlucoseRule{"low": low}, config.ActionSuspend, nil, []uint16{60},
+			[]string{"stop"}, []string{"Glucose band 'low' alert"},
+			[]string{"Patient_Monitor_19524: Insulin suspended, glucose band 'low', current glucose - 60 mg/dL"}, []int{0}, false, true},
+		{"Suspend after actuation", map[string]config.GlucoseRule{"high": high, "low": low}, config.ActionSuspend, nil, []uint16{250, 60},
+			[]string{"start", "stop"}, []string{"Glucose band 'high' alert", "Glucose band 'low' alert"},
+			[]string{"Patient_Monitor_19524: Insulin actuated for 2.00 units, current glucose - 250 mg/dL",
+				"Patient_Monitor_19524: Insulin suspended, glucose band 'low', current glucose - 60 mg/dL"}, []int{1, 0}, true, true},
+		{"Predicted low suspends", map[string]config.GlucoseRule{"falling": falling}, config.ActionSuspend, []float64{170, 155}, []uint16{140},
+			[]string{"stop"}, []string{"Glucose band 'predicted-low' alert", "Glucose band 'falling' alert"},
+			[]string{"Patient_Monitor_19524: Insulin suspended, glucose projected to fall to 50, current glucose - 140 mg/dL"}, []int{0}, false, true},
+		{"Predicted low skips", map[string]config.GlucoseRule{"falling": falling}, config.ActionSkip, []float64{170, 155}, []uint16{140},
+			nil, []string{"Glucose band 'falling' alert"}, nil, nil, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			injector := &fakeInjector{}
+			target, sent := newTestSendCommand(injector, config.FilterConfig{Type: config.FilterNone})
+			target.UpdateConfig(config.AppCustomConfig{GlucoseRules: test.Rules})
+			target.history = NewGlucoseHistory(testSuspendConfig(test.PredictiveAction))
+			funcCtx := pkg.NewAppFuncContextForTest("", logger.NewMockClient())
+			// Each reading 5 minutes after the one before, the last one now
+			start := time.Now().Add(-time.Duration(len(test.Seed)+len(test.Readings)-1) * 5 * time.Minute)
+			for index, value := range test.Seed {
+				target.history.Add("monitor", value, start.Add(time.Duration(index)*5*time.Minute))
+			}
+			for index, glucose := range test.Readings {
+				target.CheckAndSendCommand(funcCtx, glucoseEvent(t, glucose, start.Add(time.Duration(len(test.Seed)+index)*5*time.Minute)))
+			}
+
+			_, commands := injector.state()
+			assert.Equal(t, test.ExpectedCommands, commands)
+			assert.Equal(t, test.ExpectedNotifications, sent.notifications)
+			assert.Equal(t, test.ExpectedAlerts, sent.alerts)
+			var liveData []int
+			for _, data := range sent.liveData {
+				liveData = append(liveData, data.Value)
+			}
+			assert.Equal(t, test.ExpectedLiveData, liveData)
+			assert.Equal(t, test.ExpectedLocked, target.lockout.Remaining("injector", time.Now()) > 0)
+			assert.Equal(t, test.ExpectedSuspended, target.suspension.IsSuspended("injector"))
+			assert.False(t, target.scheduler.Pending("injector"), "no stop is left scheduled")
+		})
+	}
+}
+
+func TestSendCommand_AlertGlucoseRounded(t *testing.T) {
+	injector := &fakeInjector{}
+	target, sent := newTestSendCommand(injector, config.FilterConfig{Type: config.FilterNone})
+	funcCtx := pkg.NewAppFuncContextForTest("", logger.NewMockClient())
+	low := config.GlucoseRule{Comparison: config.ComparisonLess, Threshold: 70, Units: config.UnitsMgDl, Action: config.ActionSuspend}
+
+	// A filtered glucose is rarely whole, the alert reports it to the nearest mg/dL
+	target.suspendInsulin(funcCtx, target.patients.ForMonitor("monitor"), 69.6, "glucose band 'low'", "low", low)
+
+	assert.Equal(t, []int{70}, sent.alertValues)
+}
@@ -0,0 +1,163 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// SuspendState describes why and since when insulin delivery by an injector is suspended.
+type SuspendState struct {
+	DeviceName string    `json:"deviceName"`
+	Reason     string    `json:"reason"`
+	Glucose    float64   `json:"glucose"`
+	Since      time.Time `json:"since"`
+	// Latched is true for an emergency stop, which only ends when it is released by an operator
+	Latched     bool   `json:"latched"`
+	RequestedBy string `json:"requestedBy,omitempty"`
+}
+
+// Suspension tracks injectors whose insulin delivery is suspended because of low glucose or an emergency stop.
+// A suspended injector must not be actuated until glucose has recovered to the resume level, or for an emergency
+// stop until it is released. The two are tracked separately, an injector suspended for both stays suspended until
+// glucose has recovered and the emergency stop is released, in either order. It is shared by every path that
+// actuates an injector.
+type Suspension struct {
+	mutex         sync.Mutex
+	resumeGlucose float64
+	// low holds the low glucose suspensions and latched the emergency stops, by injector
+	low     map[string]SuspendState
+	latched map[string]SuspendState
+}
+
+// NewSuspension creates a Suspension that resumes delivery once glucose reaches resumeGlucose.
+func NewSuspension(resumeGlucose float64) *Suspension {
+	return &Suspension{
+		resumeGlucose: resumeGlucose,
+		low:           make(map[string]SuspendState),
+		latched:       make(map[string]SuspendState),
+	}
+}
+
+// UpdateConfig replaces the glucose level at which delivery resumes.
+func (s *Suspension) UpdateConfig(resumeGlucose float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.resumeGlucose = resumeGlucose
+}
+
+// Suspend suspends delivery by the named injector for low glucose. It returns false if the injector was already
+// suspended, for either reason. An injector under an emergency stop records the low glucose suspension all the same,
+// so it stays suspended if the emergency stop is released before glucose recovers.
+func (s *Suspension) Suspend(deviceName string, reason string, glucose float64, at time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, latched := s.latched[deviceName]
+	if _, exists := s.low[deviceName]; exists {
+		return false
+	}
+
+	s.low[deviceName] = SuspendState{
+		DeviceName: deviceName,
+		Reason:     reason,
+		Glucose:    glucose,
+		Since:      at,
+	}
+
+	return !latched
+}
+
+// Latch suspends delivery by the named injector for an emergency stop requested by the named operator. Unlike a
+// low glucose suspension it does not end when glucose recovers, only when released. A low glucose suspension
+// already in place is kept, to end when glucose recovers.
+func (s *Suspension) Latch(deviceName string, reason string, requestedBy string, at time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.latched[deviceName] = SuspendState{
+		DeviceName:  deviceName,
+		Reason:      reason,
+		Since:       at,
+		Latched:     true,
+		RequestedBy: requestedBy,
+	}
+}
+
+// Release ends the emergency stop of the named injector, leaving any low glucose suspension in place. It returns
+// false if the injector was not latched.
+func (s *Suspension) Release(deviceName string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.latched[deviceName]; !exists {
+		return false
+	}
+
+	delete(s.latched, deviceName)
+	return true
+}
+
+// IsSuspended reports whether delivery by the named injector is suspended, for either reason.
+func (s *Suspension) IsSuspended(deviceName string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, low := s.low[deviceName]
+	_, latched := s.latched[deviceName]
+	return low || latched
+}
+
+// Observe ends the low glucose suspension of the named injector when glucose has recovered to the resume level. It
+// returns true if delivery was resumed, which it is not while the injector is latched by an emergency stop.
+func (s *Suspension) Observe(deviceName string, glucose float64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.low[deviceName]; !exists || glucose < s.resumeGlucose {
+		return false
+	}
+
+	delete(s.low, deviceName)
+	_, latched := s.latched[deviceName]
+	return !latched
+}
+
+// Status returns the state of every suspended injector, ordered by injector name. An injector suspended for both
+// low glucose and an emergency stop has a state for each, the low glucose suspension first.
+func (s *Suspension) Status() []SuspendState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	states := make([]SuspendState, 0, len(s.low)+len(s.latched))
+	for _, state := range s.low {
+		states = append(states, state)
+	}
+	for _, state := range s.latched {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].DeviceName != states[j].DeviceName {
+			return states[i].DeviceName < states[j].DeviceName
+		}
+		return !states[i].Latched && states[j].Latched
+	})
+
+	return states
+}
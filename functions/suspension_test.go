@@ -0,0 +1,104 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSuspension(t *testing.T) {
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	target := NewSuspension(90)
+
+	assert.False(t, target.IsSuspended("injector"))
+	assert.False(t, target.Observe("injector", 150), "nothing to resume")
+
+	require.True(t, target.Suspend("injector", "glucose band 'hypoglycemia'", 62, now))
+	assert.False(t, target.Suspend("injector", "glucose band 'hypoglycemia'", 58, now.Add(time.Minute)), "already suspended")
+	assert.True(t, target.IsSuspended("injector"))
+	assert.False(t, target.IsSuspended("other-injector"))
+
+	status := target.Status()
+	require.Len(t, status, 1)
+	assert.Equal(t, SuspendState{DeviceName: "injector", Reason: "glucose band 'hypoglycemia'", Glucose: 62, Since: now}, status[0])
+
+	assert.False(t, target.Observe("injector", 85), "not yet recovered")
+	assert.True(t, target.IsSuspended("injector"))
+
+	target.UpdateConfig(80)
+	assert.True(t, target.Observe("injector", 85))
+	assert.False(t, target.IsSuspended("injector"))
+	assert.Empty(t, target.Status())
+}
+
+func TestSuspension_Latch(t *testing.T) {
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	target := NewSuspension(90)
+
+	require.True(t, target.Suspend("injector", "glucose band 'hypoglycemia'", 62, now))
+	assert.False(t, target.Release("injector"), "low glucose suspension is not latched")
+
+	target.Latch("injector", "emergency stop", "nurse", now.Add(time.Minute))
+	assert.False(t, target.Suspend("injector", "glucose band 'hypoglycemia'", 60, now.Add(2*time.Minute)))
+	assert.Equal(t, []SuspendState{
+		{DeviceName: "injector", Reason: "glucose band 'hypoglycemia'", Glucose: 62, Since: now},
+		{DeviceName: "injector", Reason: "emergency stop", Since: now.Add(time.Minute), Latched: true, RequestedBy: "nurse"},
+	}, target.Status())
+	assert.False(t, target.Observe("injector", 150), "latched suspension does not resume with glucose")
+	assert.True(t, target.IsSuspended("injector"))
+
+	assert.True(t, target.Release("injector"))
+	assert.False(t, target.IsSuspended("injector"), "glucose recovered while latched")
+	assert.False(t, target.Release("injector"), "nothing left to release")
+}
+
+func TestSuspension_ReleaseWhileLow(t *testing.T) {
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		Name          string
+		SuspendBefore bool
+	}{
+		{"Low glucose before the emergency stop", true},
+		{"Low glucose during the emergency stop", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			target := NewSuspension(90)
+			if test.SuspendBefore {
+				require.True(t, target.Suspend("injector", "glucose band 'hypoglycemia'", 62, now))
+			}
+			target.Latch("injector", "emergency stop", "nurse", now.Add(time.Minute))
+			if !test.SuspendBefore {
+				assert.False(t, target.Suspend("injector", "glucose band 'hypoglycemia'", 62, now), "already stopped")
+			}
+
+			require.True(t, target.Release("injector"))
+			assert.True(t, target.IsSuspended("injector"), "still suspended for low glucose")
+			assert.Equal(t, []SuspendState{{DeviceName: "injector", Reason: "glucose band 'hypoglycemia'", Glucose: 62, Since: now}},
+				target.Status())
+
+			assert.True(t, target.Observe("injector", 95))
+			assert.False(t, target.IsSuspended("injector"))
+		})
+	}
+}
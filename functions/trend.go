@@ -0,0 +1,197 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"sync"
+	"time"
+
+	"app-insulin-service/config"
+)
+
+// GlucoseSample is a single glucose reading kept in a device's history.
+type GlucoseSample struct {
+	// Value is the filtered glucose, acted on in place of the Raw reading
+	Value float64   `json:"value"`
+	Raw   float64   `json:"raw"`
+	Time  time.Time `json:"time"`
+	// Rejected is true when the reading was rejected as an outlier, it has no filtered Value and is kept only as a
+	// record of what the monitor reported
+	Rejected bool `json:"rejected,omitempty"`
+}
+
+// GlucoseTrend is the rate of change of a device's recent glucose readings and the resulting projection.
+type GlucoseTrend struct {
+	// Readings is the number of readings in the window the trend was calculated from
+	Readings int `json:"readings"`
+	// RatePerMinute is the rate of change in mg/dL per minute, only valid when Valid is true
+	RatePerMinute float64 `json:"ratePerMinute"`
+	// Projected is the glucose level projected PredictionMinutes ahead, only valid when Valid is true
+	Projected float64 `json:"projected"`
+	// Valid is true when there were enough readings to calculate a trend
+	Valid bool `json:"valid"`
+	// PredictedLow is true when the projection falls below the predictive floor
+	PredictedLow bool `json:"predictedLow"`
+}
+
+// GlucoseHistory keeps a rolling window of glucose readings per device and projects where glucose is heading
+// so insulin can be suspended or skipped before a low occurs. It is shared by every path that reads glucose.
+type GlucoseHistory struct {
+	mutex   sync.Mutex
+	config  config.SuspendConfig
+	samples map[string][]GlucoseSample
+}
+
+// NewGlucoseHistory creates an empty GlucoseHistory using the given, already validated, suspend configuration.
+func NewGlucoseHistory(suspend config.SuspendConfig) *GlucoseHistory {
+	return &GlucoseHistory{
+		config:  suspend,
+		samples: make(map[string][]GlucoseSample),
+	}
+}
+
+// UpdateConfig replaces the suspend configuration. Readings already in the history are kept.
+func (h *GlucoseHistory) UpdateConfig(suspend config.SuspendConfig) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.config = suspend
+}
+
+// PredictiveAction returns the action to take when a low is predicted.
+func (h *GlucoseHistory) PredictiveAction() string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.config.PredictiveAction
+}
+
+// Add records an unfiltered glucose reading from the named device and returns the resulting trend.
+func (h *GlucoseHistory) Add(deviceName string, value float64, at time.Time) GlucoseTrend {
+	return h.Record(deviceName, FilteredReading{Raw: value, Value: value}, at)
+}
+
+// Record records a filtered glucose reading from the named device, raw and filtered, and returns the resulting
+// trend, which follows the filtered values. A reading rejected as an outlier is recorded but left out of the trend
+// and of the latest reading. Readings older than the trend window, relative to the newest reading, are dropped.
+func (h *GlucoseHistory) Record(deviceName string, reading FilteredReading, at time.Time) GlucoseTrend {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	sample := GlucoseSample{Value: reading.Value, Raw: reading.Raw, Time: at, Rejected: reading.Rejected}
+	samples := append(h.samples[deviceName], sample)
+
+	newest := samples[0].Time
+	for _, sample := range samples {
+		if sample.Time.After(newest) {
+			newest = sample.Time
+		}
+	}
+
+	window := time.Duration(h.config.TrendWindowMinutes) * time.Minute
+	current := samples[:0]
+	for _, sample := range samples {
+		if newest.Sub(sample.Time) <= window {
+			current = append(current, sample)
+		}
+	}
+	h.samples[deviceName] = current
+
+	return h.trend(current)
+}
+
+// Samples returns the readings currently in the named device's window.
+func (h *GlucoseHistory) Samples(deviceName string) []GlucoseSample {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]GlucoseSample(nil), h.samples[deviceName]...)
+}
+
+// Trend returns the current trend of the named device's readings.
+func (h *GlucoseHistory) Trend(deviceName string) GlucoseTrend {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.trend(h.samples[deviceName])
+}
+
+// Latest returns the newest reading, not rejected as an outlier, from any device accepted by include, false when
+// there are none.
+func (h *GlucoseHistory) Latest(include func(deviceName string) bool) (string, GlucoseSample, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var latestDevice string
+	var latest GlucoseSample
+	for deviceName, samples := range h.samples {
+		if !include(deviceName) {
+			continue
+		}
+		for _, sample := range samples {
+			if sample.Rejected {
+				continue
+			}
+			if latestDevice == "" || sample.Time.After(latest.Time) {
+				latestDevice = deviceName
+				latest = sample
+			}
+		}
+	}
+
+	return latestDevice, latest, latestDevice != ""
+}
+
+// trend fits a least squares line through the samples not rejected as outliers and projects it PredictionMinutes
+// past the newest of them. Caller must hold the lock.
+func (h *GlucoseHistory) trend(all []GlucoseSample) GlucoseTrend {
+	samples := make([]GlucoseSample, 0, len(all))
+	for _, sample := range all {
+		if !sample.Rejected {
+			samples = append(samples, sample)
+		}
+	}
+
+	trend := GlucoseTrend{Readings: len(samples)}
+	if h.config.PredictiveAction == config.ActionNone || len(samples) < h.config.MinTrendReadings || len(samples) < 2 {
+		return trend
+	}
+
+	origin := samples[0].Time
+	newest := samples[0]
+	var sumX, sumY, sumXY, sumXX float64
+	for _, sample := range samples {
+		x := sample.Time.Sub(origin).Minutes()
+		sumX += x
+		sumY += sample.Value
+		sumXY += x * sample.Value
+		sumXX += x * x
+		if sample.Time.After(newest.Time) {
+			newest = sample
+		}
+	}
+
+	n := float64(len(samples))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		// All readings have the same timestamp, there is no rate of change to calculate
+		return trend
+	}
+
+	trend.Valid = true
+	trend.RatePerMinute = (n*sumXY - sumX*sumY) / denominator
+	trend.Projected = newest.Value + trend.RatePerMinute*float64(h.config.PredictionMinutes)
+	trend.PredictedLow = trend.Projected < h.config.PredictiveFloor
+
+	return trend
+}
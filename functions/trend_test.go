@@ -0,0 +1,123 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"app-insulin-service/config"
+)
+
+func testSuspendConfig(action string) config.SuspendConfig {
+	return config.SuspendConfig{
+		ResumeGlucose:      90,
+		PredictiveAction:   action,
+		PredictiveFloor:    80,
+		PredictionMinutes:  30,
+		TrendWindowMinutes: 20,
+		MinTrendReadings:   3,
+	}
+}
+
+func TestGlucoseHistory_Add(t *testing.T) {
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		Name                 string
+		Action               string
+		Readings             []float64
+		ExpectedValid        bool
+		ExpectedRate         float64
+		ExpectedProjected    float64
+		ExpectedPredictedLow bool
+	}{
+		{"Too few readings", config.ActionSuspend, []float64{140, 130}, false, 0, 0, false},
+		{"Falling fast", config.ActionSuspend, []float64{140, 130, 120}, true, -2, 60, true},
+		{"Falling slowly", config.ActionSuspend, []float64{140, 137.5, 135}, true, -0.5, 120, false},
+		{"Rising", config.ActionSkip, []float64{100, 110, 120}, true, 2, 180, false},
+		{"Prediction disabled", config.ActionNone, []float64{140, 130, 120}, false, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			target := NewGlucoseHistory(testSuspendConfig(test.Action))
+
+			var trend GlucoseTrend
+			for index, value := range test.Readings {
+				trend = target.Add("monitor", value, now.Add(time.Duration(index)*5*time.Minute))
+			}
+
+			assert.Equal(t, len(test.Readings), trend.Readings)
+			assert.Equal(t, test.ExpectedValid, trend.Valid)
+			assert.InDelta(t, test.ExpectedRate, trend.RatePerMinute, 0.0001)
+			assert.InDelta(t, test.ExpectedProjected, trend.Projected, 0.0001)
+			assert.Equal(t, test.ExpectedPredictedLow, trend.PredictedLow)
+		})
+	}
+}
+
+func TestGlucoseHistory_Window(t *testing.T) {
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	target := NewGlucoseHistory(testSuspendConfig(config.ActionSuspend))
+
+	// A steep fall long ago must not count towards the current, flat, trend
+	target.Add("monitor", 200, now)
+	target.Add("monitor", 150, now.Add(5*time.Minute))
+	target.Add("monitor", 120, now.Add(30*time.Minute))
+	target.Add("monitor", 120, now.Add(35*time.Minute))
+	trend := target.Add("monitor", 120, now.Add(40*time.Minute))
+
+	require.Len(t, target.Samples("monitor"), 3)
+	assert.Empty(t, target.Samples("other-monitor"))
+	assert.True(t, trend.Valid)
+	assert.False(t, trend.PredictedLow)
+	assert.InDelta(t, 0, trend.RatePerMinute, 0.0001)
+
+	target.UpdateConfig(testSuspendConfig(config.ActionSkip))
+	assert.Equal(t, config.ActionSkip, target.PredictiveAction())
+	assert.Len(t, target.Samples("monitor"), 3, "readings kept when configuration changes")
+}
+
+func TestGlucoseHistory_Record(t *testing.T) {
+	now := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	target := NewGlucoseHistory(testSuspendConfig(config.ActionSuspend))
+
+	target.Add("monitor", 115, now)
+	target.Add("monitor", 120, now.Add(5*time.Minute))
+	trend := target.Record("monitor", FilteredReading{Raw: 300, Value: 125}, now.Add(10*time.Minute))
+
+	samples := target.Samples("monitor")
+	require.Len(t, samples, 3)
+	assert.Equal(t, GlucoseSample{Value: 120, Raw: 120, Time: now.Add(5 * time.Minute)}, samples[1])
+	assert.Equal(t, GlucoseSample{Value: 125, Raw: 300, Time: now.Add(10 * time.Minute)}, samples[2])
+	assert.InDelta(t, 1, trend.RatePerMinute, 0.0001, "trend follows the filtered values")
+
+	// An outlier is recorded but neither moves the trend nor is the latest reading
+	trend = target.Record("monitor", FilteredReading{Raw: 40, Rejected: true, Reason: "changed too fast"}, now.Add(15*time.Minute))
+	samples = target.Samples("monitor")
+	require.Len(t, samples, 4)
+	assert.Equal(t, GlucoseSample{Raw: 40, Time: now.Add(15 * time.Minute), Rejected: true}, samples[3])
+	assert.Equal(t, 3, trend.Readings)
+	assert.InDelta(t, 1, trend.RatePerMinute, 0.0001)
+	_, latest, found := target.Latest(func(string) bool { return true })
+	require.True(t, found)
+	assert.Equal(t, 125.0, latest.Value)
+}
@@ -0,0 +1,70 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"app-insulin-service/config"
+)
+
+// ParseGlucose parses a glucose reading, integer or decimal, in the given units and returns it in mg/dL, which every
+// decision is made in. Readings without units are taken to be in mg/dL.
+func ParseGlucose(value string, units string) (float64, error) {
+	normalized, ok := config.NormalizeUnits(units)
+	if !ok {
+		return 0, fmt.Errorf("glucose units '%s' are not supported", units)
+	}
+
+	glucose, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0, fmt.Errorf("glucose value '%s' is not a number", value)
+	}
+	if math.IsNaN(glucose) || math.IsInf(glucose, 0) || glucose < 0 {
+		return 0, fmt.Errorf("glucose value '%s' is not a valid reading", value)
+	}
+
+	return ToMgDl(glucose, normalized), nil
+}
+
+// ToMgDl converts glucose in the given, supported, units to mg/dL.
+func ToMgDl(glucose float64, units string) float64 {
+	if units == config.UnitsMmolL {
+		return glucose * config.MgDlPerMmolL
+	}
+	return glucose
+}
+
+// FromMgDl converts glucose in mg/dL to the given, supported, units.
+func FromMgDl(glucose float64, units string) float64 {
+	if units == config.UnitsMmolL {
+		return glucose / config.MgDlPerMmolL
+	}
+	return glucose
+}
+
+// FormatGlucose formats glucose in mg/dL for display in the given units, whole mg/dL or mmol/L to one decimal place.
+// Empty units display in mg/dL.
+func FormatGlucose(glucose float64, units string) string {
+	if units == config.UnitsMmolL {
+		return strconv.FormatFloat(FromMgDl(glucose, units), 'f', 1, 64) + " " + config.UnitsMmolL
+	}
+	return strconv.FormatFloat(glucose, 'f', 0, 64) + " " + config.UnitsMgDl
+}
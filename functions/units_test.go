@@ -0,0 +1,67 @@
+//
+// Copyright (c) 2021 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package functions
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"app-insulin-service/config"
+)
+
+func TestParseGlucose(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Value         string
+		Units         string
+		Expected      float64
+		ExpectedError string
+	}{
+		{"Integer", "145", "", 145, ""},
+		{"Float", "145.5", config.UnitsMgDl, 145.5, ""},
+		{"Padded", " 145 ", "", 145, ""},
+		{"mmol/L", "10", config.UnitsMmolL, 180.182, ""},
+		{"mmol/L any case", "10", "MMOL/L", 180.182, ""},
+		{"Unsupported units", "10", "g/L", 0, "glucose units 'g/L' are not supported"},
+		{"Not a number", "high", "", 0, "glucose value 'high' is not a number"},
+		{"Negative", "-5", "", 0, "glucose value '-5' is not a valid reading"},
+		{"Not finite", "NaN", "", 0, "glucose value 'NaN' is not a valid reading"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			actual, err := ParseGlucose(test.Value, test.Units)
+			if test.ExpectedError != "" {
+				require.EqualError(t, err, test.ExpectedError)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.InDelta(t, test.Expected, actual, 0.0001)
+		})
+	}
+}
+
+func TestFormatGlucose(t *testing.T) {
+	assert.Equal(t, "145 mg/dL", FormatGlucose(145.4, config.UnitsMgDl))
+	assert.Equal(t, "145 mg/dL", FormatGlucose(145.4, ""))
+	assert.Equal(t, "8.1 mmol/L", FormatGlucose(145.4, config.UnitsMmolL))
+	assert.InDelta(t, 145.4, ToMgDl(FromMgDl(145.4, config.UnitsMmolL), config.UnitsMmolL), 0.0001)
+	assert.Equal(t, 145.4, FromMgDl(145.4, config.UnitsMgDl))
+}
@@ -10,6 +10,7 @@ go 1.21
 require (
 	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/edgexfoundry/app-functions-sdk-go/v3 v3.1.0
+	github.com/edgexfoundry/go-mod-bootstrap/v3 v3.1.0
 	github.com/edgexfoundry/go-mod-core-contracts v0.1.149
 	github.com/edgexfoundry/go-mod-core-contracts/v3 v3.1.0
 	github.com/google/uuid v1.3.1
@@ -25,7 +26,6 @@ require (
 	github.com/cenkalti/backoff v2.2.1+incompatible // indirect
 	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc // indirect
 	github.com/diegoholiveira/jsonlogic/v3 v3.3.2 // indirect
-	github.com/edgexfoundry/go-mod-bootstrap/v3 v3.1.0 // indirect
 	github.com/edgexfoundry/go-mod-configuration/v3 v3.1.0 // indirect
 	github.com/edgexfoundry/go-mod-messaging/v3 v3.1.0 // indirect
 	github.com/edgexfoundry/go-mod-registry/v3 v3.1.0 // indirect
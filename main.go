@@ -19,22 +19,28 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"github.com/labstack/echo/v4"
+	"maps"
 	"net/http"
 	"os"
 	"reflect"
+	"strings"
+	"sync"
+	"time"
 
 	"app-insulin-service/config"
-	//"app-insulin-service/functions"
-
-	//"send-command/functions"
-        "app-insulin-service/messages"
+	"app-insulin-service/functions"
+	"app-insulin-service/messages"
 
 	"github.com/edgexfoundry/app-functions-sdk-go/v3/pkg"
 	"github.com/edgexfoundry/app-functions-sdk-go/v3/pkg/interfaces"
-//	"github.com/edgexfoundry/app-functions-sdk-go/v3/pkg/transforms"
+	"github.com/edgexfoundry/go-mod-bootstrap/v3/bootstrap/secret"
 	"github.com/edgexfoundry/go-mod-core-contracts/v3/clients/logger"
-//	"github.com/edgexfoundry/go-mod-core-contracts/v3/dtos"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/common"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/dtos"
 )
 
 const (
@@ -48,6 +54,22 @@ type myApp struct {
 	appCtx        context.Context
 	serviceConfig *config.ServiceConfig
 	configChanged chan bool
+	// configMutex serializes configuration updates from the configuration provider and the REST API
+	configMutex    sync.Mutex
+	patients       *functions.Patients
+	sendCommand    functions.SendCommand
+	insulinOnBoard *functions.InsulinOnBoard
+	doseCalculator *functions.DoseCalculator
+	suspension     *functions.Suspension
+	stopScheduler  *functions.StopScheduler
+	glucoseHistory *functions.GlucoseHistory
+	injector       *functions.InjectorCommander
+	emergencyStop  *functions.EmergencyStop
+	manualBolus    *functions.ManualBolus
+	lockout        *functions.Lockout
+	glucoseFilter  *functions.GlucoseFilter
+	sensors        *functions.SensorLiveness
+	subscriber     *messages.Subscriber
 }
 
 func main() {
@@ -61,7 +83,6 @@ func main() {
 // CreateAndRunAppService wraps what would normally be in main() so that it can be unit tested
 // TODO: Remove and just use regular main() if unit tests of main logic not needed.
 func (app *myApp) CreateAndRunAppService(serviceKey string, newServiceFactory func(string) (interfaces.ApplicationService, bool)) int {
-    _ = os.Setenv("EDGEX_SECURITY_SECRET_STORE", "false")
 	var ok bool
 	app.service, ok = newServiceFactory(serviceKey)
 	if !ok {
@@ -106,27 +127,160 @@ func (app *myApp) CreateAndRunAppService(serviceKey string, newServiceFactory fu
 		return -1
 	}
 
-	go messages.Subscribe()
+	app.patients = functions.NewPatients(app.serviceConfig.AppCustom)
+	app.insulinOnBoard = functions.NewInsulinOnBoard(app.serviceConfig.AppCustom.Insulin)
+	app.doseCalculator = functions.NewDoseCalculator(app.serviceConfig.AppCustom.Injector, app.lc, app.insulinOnBoard,
+		app.patients)
+	app.suspension = functions.NewSuspension(app.serviceConfig.AppCustom.Suspend.ResumeGlucose)
+	app.injector = functions.NewInjectorCommander(app.serviceConfig.AppCustom.Injector, app.lc, app.service.CommandClient(), app.patients)
+	app.stopScheduler = functions.NewStopScheduler(app.serviceConfig.AppCustom.Injector.PendingStopsFile)
+	app.glucoseHistory = functions.NewGlucoseHistory(app.serviceConfig.AppCustom.Suspend)
+	app.lockout = functions.NewLockout(app.serviceConfig.AppCustom.Lockout)
+	app.glucoseFilter = functions.NewGlucoseFilter(app.serviceConfig.AppCustom.Filter)
+	app.sensors = functions.NewSensorLiveness(app.serviceConfig.AppCustom.Liveness, app.lc, app.patients)
+	app.sendCommand = functions.NewSendCommand(app.serviceConfig.AppCustom, app.insulinOnBoard, app.doseCalculator,
+		app.suspension, app.stopScheduler, app.glucoseHistory, app.injector, app.lockout, app.patients, app.glucoseFilter,
+		app.sensors)
+	// Replayed stops show the delivery stopped on the dashboard, as the scheduled stops they replace do
+	replayed, err := app.stopScheduler.Replay(func(deviceName string) {
+		app.lc.Warnf("Replaying Insulin stop for %s scheduled before restart", deviceName)
+		app.sendCommand.StopInsulin(app.lc, deviceName)
+	})
+	if err != nil {
+		app.lc.Errorf("unable to replay pending Insulin stops: %s", err.Error())
+	}
+	if replayed > 0 {
+		app.lc.Infof("Replayed %d pending Insulin stops", replayed)
+	}
+	if err := app.service.SetDefaultFunctionsPipeline(app.sendCommand.CheckAndSendCommand); err != nil {
+		app.lc.Errorf("SetDefaultFunctionsPipeline returned error: %s", err.Error())
+		return -1
+	}
+
+	app.emergencyStop = functions.NewEmergencyStop(app.lc, app.injector, app.stopScheduler, app.suspension, app.patients)
+	app.manualBolus = functions.NewManualBolus(app.serviceConfig.AppCustom.Bolus, app.lc, app.doseCalculator, app.insulinOnBoard,
+		app.suspension, app.stopScheduler, app.glucoseHistory, app.injector, app.lockout, app.patients)
+
+	secretProvider := app.service.SecretProvider()
+	var secrets messages.SecretProvider
+	if secretProvider != nil {
+		secrets = secretProvider
+	}
+	// Glucose readings from MQTT are decided on by the functions pipeline's SendCommand, as MessageBus events are
+	app.subscriber = messages.NewSubscriber(app.serviceConfig.AppCustom.Mqtt, secrets, app.patients, app.processGlucoseEvent)
+	if secretProvider != nil {
+		if secret.IsSecurityEnabled() {
+			app.lc.Info("MQTT credentials are read from the secret store")
+		} else {
+			app.lc.Warn("Security is disabled, MQTT credentials are read from InsecureSecrets")
+		}
+		// Rotated broker credentials are picked up by reconnecting
+		err := secretProvider.RegisterSecretUpdatedCallback(secret.WildcardName, func(secretName string) {
+			app.subscriber.SecretUpdated(secretName)
+		})
+		if err != nil {
+			app.lc.Errorf("unable to watch for MQTT credential updates: %s", err.Error())
+		}
+	} else {
+		app.lc.Warn("Secret provider not available, MQTT credentials cannot be resolved")
+	}
+	metrics := map[string]interface{}{
+		functions.ActuationsLockedOutName:     app.lockout.Metric(),
+		functions.GlucoseReadingsRejectedName: app.glucoseFilter.Metric(),
+	}
+	for name, metric := range app.subscriber.Metrics() {
+		metrics[name] = metric
+	}
+	if metricsManager := app.service.MetricsManager(); metricsManager != nil {
+		for name, metric := range metrics {
+			if err := metricsManager.Register(name, metric, nil); err != nil {
+				app.lc.Errorf("Unable to register metric %s. Collection will continue, but metric will not be reported: %s",
+					name, err.Error())
+			}
+		}
+	} else {
+		app.lc.Warn("Metrics manager not available, custom metrics will not be reported")
+	}
+
+	// TODO: Use this context in long running function to detect when the context is cancel for function can exit.
+	//       Remove if no long running functions
+	app.appCtx = app.service.AppContext()
+	go app.sensors.Run(app.appCtx)
+	app.subscriber.Start(app.appCtx)
 
-        // TODO: Use this context in long running function to detect when the context is cancel for function can exit.
-        //       Remove if no long running functions
-        app.appCtx = app.service.AppContext()
+	// TODO: Add any custom routes your service may have for its REST API
+	if err := app.service.AddCustomRoute("/api/v3/hello", true, app.helloHandler, http.MethodGet); err != nil {
+		app.lc.Errorf("AddCustomRoute returned error: %s", err.Error())
+		return -1
+	}
 
-        // TODO: Add any custom routes your service may have for its REST API
-        if err := app.service.AddCustomRoute("/api/v3/hello", true, app.helloHandler, http.MethodGet); err != nil {
-                app.lc.Errorf("AddCustomRoute returned error: %s", err.Error())
-                return -1
-        }
+	if err := app.service.AddCustomRoute("/api/v3/insulin/onboard", true, app.insulinOnBoardHandler, http.MethodGet); err != nil {
+		app.lc.Errorf("AddCustomRoute returned error: %s", err.Error())
+		return -1
+	}
 
-        if err := app.service.Run(); err != nil {
-                app.lc.Errorf("Run returned error: %s", err.Error())
-                return -1
-        }
-	//messages.Subscribe()
+	if err := app.service.AddCustomRoute("/api/v3/insulin/stop", true, app.emergencyStopHandler,
+		http.MethodGet, http.MethodPost, http.MethodDelete); err != nil {
+		app.lc.Errorf("AddCustomRoute returned error: %s", err.Error())
+		return -1
+	}
+
+	if err := app.service.AddCustomRoute("/api/v3/insulin/bolus", true, app.bolusHandler, http.MethodPost); err != nil {
+		app.lc.Errorf("AddCustomRoute returned error: %s", err.Error())
+		return -1
+	}
+
+	if err := app.service.AddCustomRoute("/api/v3/meals", true, app.mealHandler, http.MethodPost); err != nil {
+		app.lc.Errorf("AddCustomRoute returned error: %s", err.Error())
+		return -1
+	}
+
+	if err := app.service.AddCustomRoute("/api/v3/insulin/lockout", true, app.lockoutHandler, http.MethodGet); err != nil {
+		app.lc.Errorf("AddCustomRoute returned error: %s", err.Error())
+		return -1
+	}
+
+	if err := app.service.AddCustomRoute("/api/v3/sensors", true, app.sensorsHandler, http.MethodGet); err != nil {
+		app.lc.Errorf("AddCustomRoute returned error: %s", err.Error())
+		return -1
+	}
+
+	if err := app.service.AddCustomRoute("/api/v3/mqtt/health", true, app.mqttHealthHandler, http.MethodGet); err != nil {
+		app.lc.Errorf("AddCustomRoute returned error: %s", err.Error())
+		return -1
+	}
+
+	if err := app.service.AddCustomRoute("/api/v3/patients", true, app.patientsHandler, http.MethodGet); err != nil {
+		app.lc.Errorf("AddCustomRoute returned error: %s", err.Error())
+		return -1
+	}
+
+	if err := app.service.AddCustomRoute("/api/v3/patients/:name", true, app.patientHandler,
+		http.MethodGet, http.MethodPut, http.MethodDelete); err != nil {
+		app.lc.Errorf("AddCustomRoute returned error: %s", err.Error())
+		return -1
+	}
+
+	err = app.service.Run()
+	// Run returns once the service has shut down
+	app.shutdown()
+	if err != nil {
+		app.lc.Errorf("Run returned error: %s", err.Error())
+		return -1
+	}
 
 	return 0
 }
 
+// shutdown stops the MQTT subscriber, waiting for the readings it is handling, and then runs every pending insulin
+// stop, whichever source dosed, so no injector is left on once the service exits.
+func (app *myApp) shutdown() {
+	app.subscriber.Stop()
+	if stopped := app.stopScheduler.Flush(); stopped > 0 {
+		app.lc.Infof("Sent %d pending Insulin stop commands before exiting", stopped)
+	}
+}
+
 // ProcessConfigUpdates processes the updated configuration for the service's writable configuration.
 // At a minimum it must copy the updated configuration into the service's current configuration. Then it can
 // do any special processing for changes that require more.
@@ -138,23 +292,100 @@ func (app *myApp) ProcessConfigUpdates(rawWritableConfig interface{}) {
 		return
 	}
 
+	app.configMutex.Lock()
+	defer app.configMutex.Unlock()
+
+	if err := app.applyConfig(updated); err != nil {
+		app.lc.Errorf("rejecting custom configuration update, failed validation: %s", err.Error())
+	}
+}
+
+// applyConfig validates the updated custom configuration and applies it to every component. Caller must hold
+// the config mutex.
+func (app *myApp) applyConfig(updated *config.AppCustomConfig) error {
+	if err := updated.Validate(); err != nil {
+		return err
+	}
+
 	previous := app.serviceConfig.AppCustom
 	app.serviceConfig.AppCustom = *updated
 
-	if reflect.DeepEqual(previous, updated) {
+	if reflect.DeepEqual(previous, *updated) {
 		app.lc.Info("No changes detected")
-		return
+		return nil
 	}
 
-	if previous.SomeValue != updated.SomeValue {
-		app.lc.Infof("AppCustom.SomeValue changed to: %d", updated.SomeValue)
-	}
 	if previous.ResourceNames != updated.ResourceNames {
 		app.lc.Infof("AppCustom.ResourceNames changed to: %s", updated.ResourceNames)
 	}
-	if !reflect.DeepEqual(previous.SomeService, updated.SomeService) {
-		app.lc.Infof("AppCustom.SomeService changed to: %v", updated.SomeService)
+	if !reflect.DeepEqual(previous.GlucoseRules, updated.GlucoseRules) {
+		app.lc.Infof("AppCustom.GlucoseRules changed to: %v", updated.GlucoseRules)
+	}
+	if previous.Asset != updated.Asset {
+		app.lc.Infof("AppCustom.Asset changed to: %+v", updated.Asset)
+	}
+	if previous.MqttMonitorDevice != updated.MqttMonitorDevice {
+		app.lc.Infof("AppCustom.MqttMonitorDevice changed to: %s", updated.MqttMonitorDevice)
+	}
+	if previous.DisplayUnits != updated.DisplayUnits {
+		app.lc.Infof("AppCustom.DisplayUnits changed to: %s", updated.DisplayUnits)
+	}
+	if !reflect.DeepEqual(previous.GlucoseResources, updated.GlucoseResources) {
+		app.lc.Infof("AppCustom.GlucoseResources changed to: %v", updated.GlucoseResources)
+	}
+	if previous.Mqtt != updated.Mqtt {
+		app.lc.Infof("AppCustom.Mqtt changed to: %+v", updated.Mqtt)
+	}
+	if !reflect.DeepEqual(previous.Patients, updated.Patients) {
+		app.lc.Infof("AppCustom.Patients changed to: %v", updated.Patients)
+	}
+	if previous.Insulin != updated.Insulin {
+		app.lc.Infof("AppCustom.Insulin changed to: %+v", updated.Insulin)
+	}
+	if previous.Injector != updated.Injector {
+		app.lc.Infof("AppCustom.Injector changed to: %+v", updated.Injector)
+		if previous.Injector.PendingStopsFile != updated.Injector.PendingStopsFile {
+			app.lc.Warn("AppCustom.Injector.PendingStopsFile change takes effect on the next restart")
+		}
+	}
+	if previous.Suspend != updated.Suspend {
+		app.lc.Infof("AppCustom.Suspend changed to: %+v", updated.Suspend)
+	}
+	if previous.Bolus != updated.Bolus {
+		app.lc.Infof("AppCustom.Bolus changed to: %+v", updated.Bolus)
+	}
+	if !reflect.DeepEqual(previous.Lockout, updated.Lockout) {
+		app.lc.Infof("AppCustom.Lockout changed to: %+v", updated.Lockout)
+	}
+	if previous.Controller != updated.Controller {
+		app.lc.Infof("AppCustom.Controller changed to: %+v", updated.Controller)
+	}
+	if previous.Filter != updated.Filter {
+		app.lc.Infof("AppCustom.Filter changed to: %+v", updated.Filter)
 	}
+	if !reflect.DeepEqual(previous.Liveness, updated.Liveness) {
+		app.lc.Infof("AppCustom.Liveness changed to: %+v", updated.Liveness)
+	}
+
+	app.patients.UpdateConfig(*updated)
+	app.insulinOnBoard.UpdateConfig(updated.Insulin)
+	app.doseCalculator.UpdateConfig(updated.Injector)
+	app.suspension.UpdateConfig(updated.Suspend.ResumeGlucose)
+	app.glucoseHistory.UpdateConfig(updated.Suspend)
+	app.injector.UpdateConfig(updated.Injector)
+	app.manualBolus.UpdateConfig(updated.Bolus)
+	app.lockout.UpdateConfig(updated.Lockout)
+	app.glucoseFilter.UpdateConfig(updated.Filter)
+	app.sensors.UpdateConfig(updated.Liveness)
+
+	app.sendCommand.UpdateConfig(*updated)
+
+	// The configuration is valid, a broker that cannot be reached now is retried on the next update
+	if err := app.subscriber.UpdateConfig(updated.Mqtt); err != nil {
+		app.lc.Errorf("unable to apply AppCustom.Mqtt: %s", err.Error())
+	}
+
+	return nil
 }
 
 func (app *myApp) helloHandler(c echo.Context) error {
@@ -163,3 +394,205 @@ func (app *myApp) helloHandler(c echo.Context) error {
 	return nil
 }
 
+// insulinOnBoardHandler reports the insulin still active for each injector.
+func (app *myApp) insulinOnBoardHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, app.insulinOnBoard.Status(time.Now()))
+}
+
+// lockoutHandler reports how long each injector remains locked out following its last actuation.
+func (app *myApp) lockoutHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, app.lockout.Status(time.Now()))
+}
+
+// processGlucoseEvent passes an event from the MQTT glucose topics to the functions pipeline's SendCommand, so the
+// same filtering, safety limits, history and alerting apply whichever way the reading arrived.
+func (app *myApp) processGlucoseEvent(event dtos.Event) {
+	funcCtx := app.service.BuildContext(event.Id, common.ContentTypeJSON)
+	app.sendCommand.CheckAndSendCommand(funcCtx, event)
+}
+
+// mqttHealthHandler reports the connection to the MQTT broker, unavailable unless connected and subscribed.
+func (app *myApp) mqttHealthHandler(c echo.Context) error {
+	status := app.subscriber.Status()
+	if status.State != messages.StateConnected {
+		return c.JSON(http.StatusServiceUnavailable, status)
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+// sensorsHandler reports how recently each glucose monitor last published a reading and whether it is stale.
+func (app *myApp) sensorsHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, app.sensors.Status(time.Now()))
+}
+
+// patientsHandler reports the therapy profile of every patient, with the defaults and the currently active schedule
+// segment applied.
+func (app *myApp) patientsHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, app.patients.Profiles(time.Now()))
+}
+
+// patientHandler returns the configured profile of the named patient on GET, adds or replaces it on PUT and removes
+// it on DELETE. Changes are validated and applied like a configuration update, they last until the service restarts
+// or the configuration provider next updates the Patients configuration.
+func (app *myApp) patientHandler(c echo.Context) error {
+	name := c.Param("name")
+
+	app.configMutex.Lock()
+	defer app.configMutex.Unlock()
+
+	patient, exists := app.serviceConfig.AppCustom.Patients[name]
+	if c.Request().Method == http.MethodGet {
+		if !exists {
+			return c.String(http.StatusNotFound, fmt.Sprintf("patient '%s' not found", name))
+		}
+		return c.JSON(http.StatusOK, patient)
+	}
+
+	updated := app.serviceConfig.AppCustom
+	updated.Patients = maps.Clone(updated.Patients)
+	if updated.Patients == nil {
+		updated.Patients = make(map[string]config.PatientConfig)
+	}
+
+	change := "removed"
+	if c.Request().Method == http.MethodDelete {
+		if !exists {
+			return c.String(http.StatusNotFound, fmt.Sprintf("patient '%s' not found", name))
+		}
+		delete(updated.Patients, name)
+	} else {
+		var profile config.PatientConfig
+		if err := json.NewDecoder(c.Request().Body).Decode(&profile); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("unable to decode patient profile: %s", err.Error()))
+		}
+		updated.Patients[name] = profile
+		change = "updated"
+	}
+
+	if err := app.applyConfig(&updated); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	app.lc.Infof("Patient '%s' profile %s through the REST API by %s", name, change, requestedBy(c, "an unknown user"))
+	return c.JSON(http.StatusOK, app.patients.Profiles(time.Now()))
+}
+
+// emergencyStopHandler stops insulin delivery by one or all injectors on POST and latches them suspended until
+// released by DELETE. GET returns the audit log of who stopped and released which injectors, recorded as the user
+// the request was authenticated as.
+func (app *myApp) emergencyStopHandler(c echo.Context) error {
+	if c.Request().Method == http.MethodGet {
+		return c.JSON(http.StatusOK, app.emergencyStop.Events())
+	}
+
+	var request functions.EmergencyStopRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&request); err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("unable to decode emergency stop request: %s", err.Error()))
+	}
+	request.RequestedBy = requestedBy(c, request.RequestedBy)
+
+	if c.Request().Method == http.MethodDelete {
+		event, err := app.emergencyStop.Release(request, c.RealIP(), time.Now())
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.JSON(http.StatusOK, event)
+	}
+
+	event, err := app.emergencyStop.Stop(request, c.RealIP(), time.Now())
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	// The injectors are latched suspended regardless, but an operator must check any not confirmed stopped
+	for _, result := range event.Results {
+		if !result.Confirmed {
+			return c.JSON(http.StatusInternalServerError, event)
+		}
+	}
+
+	return c.JSON(http.StatusOK, event)
+}
+
+// bolusHandler delivers a dose requested by a clinician when it passes the safety checks. The response reports
+// whether the dose was accepted, with the reasons when it was not, and whether it was delivered.
+func (app *myApp) bolusHandler(c echo.Context) error {
+	var request functions.BolusRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&request); err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("unable to decode bolus request: %s", err.Error()))
+	}
+	request.RequestedBy = requestedBy(c, request.RequestedBy)
+
+	response := app.manualBolus.Request(request, time.Now())
+	switch {
+	case !response.Accepted:
+		return c.JSON(http.StatusUnprocessableEntity, response)
+	case !response.Delivered:
+		return c.JSON(http.StatusInternalServerError, response)
+	default:
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// mealHandler delivers the dose covering an announced meal when it passes the safety checks. The response reports
+// the calculated dose, whether it was accepted, with the reasons when it was not, and whether it was delivered.
+func (app *myApp) mealHandler(c echo.Context) error {
+	var request functions.MealRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&request); err != nil {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("unable to decode meal request: %s", err.Error()))
+	}
+	request.RequestedBy = requestedBy(c, request.RequestedBy)
+
+	response := app.manualBolus.Meal(request, time.Now())
+	switch {
+	case !response.Accepted:
+		return c.JSON(http.StatusUnprocessableEntity, response)
+	case !response.Delivered:
+		return c.JSON(http.StatusInternalServerError, response)
+	default:
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// authenticatedUser returns the user a request was authenticated as, the name claim of its bearer token or failing
+// that the subject. The token is validated against the secret store before the handler is called, so its claims can
+// be trusted. It returns false for a request without a token, which is only accepted when security is disabled.
+func authenticatedUser(c echo.Context) (string, bool) {
+	scheme, token, found := strings.Cut(c.Request().Header.Get(echo.HeaderAuthorization), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+
+	var claims struct {
+		Name    string `json:"name"`
+		Subject string `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", false
+	}
+	if claims.Name != "" {
+		return claims.Name, true
+	}
+	return claims.Subject, claims.Subject != ""
+}
+
+// requestedBy returns who made a request for the audit log and alerts: the authenticated user, or when security is
+// disabled the user the request reports, marked as unauthenticated so it is not mistaken for a verified identity.
+func requestedBy(c echo.Context, reported string) string {
+	if user, authenticated := authenticatedUser(c); authenticated {
+		return user
+	}
+	if reported == "" {
+		return ""
+	}
+	return reported + " (unauthenticated)"
+}
@@ -19,16 +19,30 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/edgexfoundry/go-mod-core-contracts/v3/clients/logger"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/common"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/dtos"
+	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 
+	"github.com/edgexfoundry/app-functions-sdk-go/v3/pkg"
 	"github.com/edgexfoundry/app-functions-sdk-go/v3/pkg/interfaces"
 	"github.com/edgexfoundry/app-functions-sdk-go/v3/pkg/interfaces/mocks"
+
+	"app-insulin-service/config"
+	"app-insulin-service/functions"
+	"app-insulin-service/messages"
 )
 
 // This is an example of how to test the code that would typically be in the main() function use mocks
@@ -40,7 +54,7 @@ func TestCreateAndRunService_Success(t *testing.T) {
 
 	mockFactory := func(_ string) (interfaces.ApplicationService, bool) {
 		mockAppService := &mocks.ApplicationService{}
-		mockAppService.On("AppContext").Return(context.Background())
+		mockAppService.On("AppContext").Return(cancelledContext())
 		mockAppService.On("LoggingClient").Return(logger.NewMockClient())
 		mockAppService.On("GetAppSettingStrings", "DeviceNames").
 			Return([]string{"Random-Boolean-Device, Random-Integer-Device"}, nil)
@@ -51,13 +65,17 @@ func TestCreateAndRunService_Success(t *testing.T) {
 		mockAppService.On("LoadCustomConfig", mock.Anything, mock.Anything, mock.Anything).
 			Return(nil).Run(func(args mock.Arguments) {
 			// set the required configuration so validation passes
-			app.serviceConfig.AppCustom.SomeValue = 987
-			app.serviceConfig.AppCustom.SomeService.Host = "SomeHost"
+			app.serviceConfig.AppCustom = validAppCustomConfig(t)
 		})
 		mockAppService.On("ListenForCustomConfigChanges", mock.Anything, mock.Anything, mock.Anything).
 			Return(nil)
+		mockAppService.On("CommandClient").Return(nil)
+		mockAppService.On("MetricsManager").Return(nil)
+		mockAppService.On("SecretProvider").Return(nil)
 		mockAppService.On("AddCustomRoute", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
 			Return(nil)
+		mockAppService.On("AddCustomRoute", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+			Return(nil)
 		mockAppService.On("Run").Return(nil)
 
 		return mockAppService, true
@@ -66,6 +84,7 @@ func TestCreateAndRunService_Success(t *testing.T) {
 	expected := 0
 	actual := app.CreateAndRunAppService("TestKey", mockFactory)
 	assert.Equal(t, expected, actual)
+	assert.Equal(t, messages.StateStopped, app.subscriber.Status().State, "subscriber stopped once the service has run")
 }
 
 func TestCreateAndRunService_NewService_Failed(t *testing.T) {
@@ -85,7 +104,7 @@ func TestCreateAndRunService_GetAppSettingStrings_Failed(t *testing.T) {
 	getAppSettingStringsCalled := false
 	mockFactory := func(_ string) (interfaces.ApplicationService, bool) {
 		mockAppService := &mocks.ApplicationService{}
-		mockAppService.On("AppContext").Return(context.Background())
+		mockAppService.On("AppContext").Return(cancelledContext())
 		mockAppService.On("LoggingClient").Return(logger.NewMockClient())
 		mockAppService.On("GetAppSettingStrings", "DeviceNames").
 			Return(nil, fmt.Errorf("Failed")).Run(func(args mock.Arguments) {
@@ -109,18 +128,18 @@ func TestCreateAndRunService_SetFunctionsPipeline_Failed(t *testing.T) {
 
 	mockFactory := func(_ string) (interfaces.ApplicationService, bool) {
 		mockAppService := &mocks.ApplicationService{}
-		mockAppService.On("AppContext").Return(context.Background())
+		mockAppService.On("AppContext").Return(cancelledContext())
 		mockAppService.On("LoggingClient").Return(logger.NewMockClient())
 		mockAppService.On("GetAppSettingStrings", "DeviceNames").
 			Return([]string{"Random-Boolean-Device, Random-Integer-Device"}, nil)
 		mockAppService.On("LoadCustomConfig", mock.Anything, mock.Anything, mock.Anything).
 			Return(nil).Run(func(args mock.Arguments) {
 			// set the required configuration so validation passes
-			app.serviceConfig.AppCustom.SomeValue = 987
-			app.serviceConfig.AppCustom.SomeService.Host = "SomeHost"
+			app.serviceConfig.AppCustom = validAppCustomConfig(t)
 		})
 		mockAppService.On("ListenForCustomConfigChanges", mock.Anything, mock.Anything, mock.Anything).
 			Return(nil)
+		mockAppService.On("CommandClient").Return(nil)
 		mockAppService.On("SetDefaultFunctionsPipeline", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
 			Return(fmt.Errorf("Failed")).Run(func(args mock.Arguments) {
 			setFunctionsPipelineCalled = true
@@ -143,24 +162,28 @@ func TestCreateAndRunService_Run_Failed(t *testing.T) {
 
 	mockFactory := func(_ string) (interfaces.ApplicationService, bool) {
 		mockAppService := &mocks.ApplicationService{}
-		mockAppService.On("AppContext").Return(context.Background())
+		mockAppService.On("AppContext").Return(cancelledContext())
 		mockAppService.On("LoggingClient").Return(logger.NewMockClient())
 		mockAppService.On("GetAppSettingStrings", "DeviceNames").
 			Return([]string{"Random-Boolean-Device, Random-Integer-Device"}, nil)
 		mockAppService.On("LoadCustomConfig", mock.Anything, mock.Anything, mock.Anything).
 			Return(nil).Run(func(args mock.Arguments) {
 			// set the required configuration so validation passes
-			app.serviceConfig.AppCustom.SomeValue = 987
-			app.serviceConfig.AppCustom.SomeService.Host = "SomeHost"
+			app.serviceConfig.AppCustom = validAppCustomConfig(t)
 		})
 		mockAppService.On("ListenForCustomConfigChanges", mock.Anything, mock.Anything, mock.Anything).
 			Return(nil)
+		mockAppService.On("CommandClient").Return(nil)
 		mockAppService.On("SetDefaultFunctionsPipeline", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
 			Return(nil)
 		mockAppService.On("AddFunctionsPipelineForTopics", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
 			Return(nil)
+		mockAppService.On("MetricsManager").Return(nil)
+		mockAppService.On("SecretProvider").Return(nil)
 		mockAppService.On("AddCustomRoute", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
 			Return(nil)
+		mockAppService.On("AddCustomRoute", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+			Return(nil)
 		mockAppService.On("Run").Return(fmt.Errorf("Failed")).Run(func(args mock.Arguments) {
 			RunCalled = true
 		})
@@ -173,3 +196,301 @@ func TestCreateAndRunService_Run_Failed(t *testing.T) {
 	require.True(t, RunCalled, "Run never called")
 	assert.Equal(t, expected, actual)
 }
+
+func TestProcessConfigUpdates(t *testing.T) {
+	// Every configuration persists pending stops to the same file, so they differ only as changed below
+	pendingStopsFile := filepath.Join(t.TempDir(), "pending-stops.json")
+	valid := func() config.AppCustomConfig {
+		appCustom := validAppCustomConfig(t)
+		appCustom.Injector.PendingStopsFile = pendingStopsFile
+		return appCustom
+	}
+	initial := valid()
+
+	changed := valid()
+	changed.GlucoseRules["high"] = config.GlucoseRule{
+		ResourceName: "Uint16",
+		Comparison:   config.ComparisonGreater,
+		Threshold:    150,
+		Units:        config.UnitsMgDl,
+		Action:       config.ActionActuate,
+		Severity:     "CRITICAL",
+		Category:     "HYPERGLYCEMIA",
+	}
+
+	invalid := valid()
+	invalid.GlucoseRules["unsafe"] = config.GlucoseRule{
+		ResourceName: "Uint16",
+		Comparison:   config.ComparisonLess,
+		Threshold:    70,
+		Units:        config.UnitsMgDl,
+		Action:       config.ActionActuate,
+		Severity:     "CRITICAL",
+		Category:     "HYPOGLYCEMIA",
+	}
+
+	patient := valid()
+	patient.Patients = map[string]config.PatientConfig{
+		"patient-1": {
+			MonitorDevice:  "blood-glucose-monitor-1",
+			InjectorDevice: "insulin-injector-1",
+			Asset:          config.AssetConfig{Id: 35, Name: "Patient_Monitor_1"},
+			GlucoseRules:   valid().GlucoseRules,
+		},
+	}
+
+	lockout := valid()
+	lockout.Lockout = config.LockoutConfig{Minutes: 30, Devices: map[string]int{"insulin-injector": 45}}
+
+	controller := valid()
+	controller.Controller = config.ControllerConfig{Type: config.ControllerPID, Kp: 0.01, IntegralLimit: 1}
+
+	liveness := valid()
+	liveness.Liveness = config.LivenessConfig{StaleMinutes: 10, Devices: map[string]int{"blood-glucose-monitor-1": 20}}
+
+	mqtt := valid()
+	mqtt.Mqtt.Topics = "high-glucose, glucose/+/high"
+	mqtt.Mqtt.Qos = 1
+	mqtt.GlucoseResources = map[string]string{"Dexcom-CGM": "GlucoseValue"}
+
+	tests := []struct {
+		Name     string
+		Updated  config.AppCustomConfig
+		Expected config.AppCustomConfig
+	}{
+		{"No changes", valid(), initial},
+		{"Rules changed", changed, changed},
+		{"Patient added", patient, patient},
+		{"Lockout changed", lockout, lockout},
+		{"Controller changed", controller, controller},
+		{"Liveness changed", liveness, liveness},
+		{"Mqtt changed", mqtt, mqtt},
+		{"Invalid rules rejected", invalid, initial},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			app := newTestApp(initial)
+			app.ProcessConfigUpdates(&test.Updated)
+			assert.Equal(t, test.Expected, app.serviceConfig.AppCustom)
+		})
+	}
+}
+
+func TestPatientHandler(t *testing.T) {
+	app := newTestApp(validAppCustomConfig(t))
+	request := func(method string, name string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(method, "/api/v3/patients/"+name, strings.NewReader(body)), recorder)
+		c.SetParamNames("name")
+		c.SetParamValues(name)
+		require.NoError(t, app.patientHandler(c))
+		return recorder
+	}
+
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "alice", "").Code)
+
+	profile := `{"MonitorDevice": "monitor-1", "InjectorDevice": "injector-1", "Asset": {"Id": 35, "Name": "Patient_Monitor_1"},
+		"Recipients": "ward-3", "TargetGlucose": 120, "GlucoseRules": {"high": {"ResourceName": "Uint16", "Comparison": ">",
+		"Threshold": 120, "Units": "mg/dL", "Action": "actuate", "Severity": "CRITICAL", "Category": "HYPERGLYCEMIA"}}}`
+	response := request(http.MethodPut, "alice", profile)
+	require.Equal(t, http.StatusOK, response.Code, response.Body.String())
+	assert.Equal(t, "injector-1", app.patients.ForMonitor("monitor-1").InjectorDevice)
+	assert.Equal(t, 120.0, app.patients.ForMonitor("monitor-1").Insulin.TargetGlucose)
+	assert.Equal(t, "monitor-1", app.serviceConfig.AppCustom.Patients["alice"].MonitorDevice)
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "alice", "").Code)
+
+	response = request(http.MethodPut, "bob", `{"MonitorDevice": "monitor-1"}`)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.Contains(t, response.Body.String(), "Patients 'bob' Asset Id must be greater than zero")
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPut, "bob", "not json").Code)
+	assert.NotContains(t, app.serviceConfig.AppCustom.Patients, "bob")
+
+	assert.Equal(t, http.StatusOK, request(http.MethodDelete, "alice", "").Code)
+	assert.Empty(t, app.serviceConfig.AppCustom.Patients)
+	assert.Empty(t, app.patients.ForMonitor("monitor-1").Name)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "alice", "").Code)
+}
+
+func TestRequestedBy(t *testing.T) {
+	token := func(claims string) string {
+		return "Bearer eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c2lnbmF0dXJl"
+	}
+
+	tests := []struct {
+		Name          string
+		Authorization string
+		Reported      string
+		Expected      string
+	}{
+		{"Name claim", token(`{"name": "dr-smith", "sub": "0b5e-entity"}`), "nurse", "dr-smith"},
+		{"Subject claim", token(`{"sub": "0b5e-entity"}`), "nurse", "0b5e-entity"},
+		{"No token", "", "nurse", "nurse (unauthenticated)"},
+		{"No token or reported user", "", "", ""},
+		{"Not a bearer token", "Basic bnVyc2U6cGFzc3dvcmQ=", "nurse", "nurse (unauthenticated)"},
+		{"Malformed token", "Bearer not-a-jwt", "nurse", "nurse (unauthenticated)"},
+		{"No identity claims", token(`{"iss": "vault"}`), "nurse", "nurse (unauthenticated)"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/api/v3/insulin/stop", nil)
+			if test.Authorization != "" {
+				request.Header.Set(echo.HeaderAuthorization, test.Authorization)
+			}
+			c := echo.New().NewContext(request, httptest.NewRecorder())
+			assert.Equal(t, test.Expected, requestedBy(c, test.Reported))
+		})
+	}
+}
+
+func TestMqttHealthHandler(t *testing.T) {
+	app := newTestApp(validAppCustomConfig(t))
+	recorder := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/api/v3/mqtt/health", nil), recorder)
+	require.NoError(t, app.mqttHealthHandler(c))
+
+	// Not connected until subscribed
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"state":"connecting"`)
+	assert.Contains(t, recorder.Body.String(), `"brokerAddress":"tcp://edgex-mqtt-broker:1883"`)
+
+	app.subscriber.Stop()
+	recorder = httptest.NewRecorder()
+	c = echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/api/v3/mqtt/health", nil), recorder)
+	require.NoError(t, app.mqttHealthHandler(c))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"state":"stopped"`)
+}
+
+func TestShutdown(t *testing.T) {
+	app := newTestApp(validAppCustomConfig(t))
+	stopped := make(chan struct{}, 1)
+	require.NoError(t, app.stopScheduler.Schedule("Random-Boolean-Device", time.Hour, func() { stopped <- struct{}{} }))
+
+	// Stopping the subscriber leaves the stops of every other source to the app
+	app.subscriber.Stop()
+	assert.True(t, app.stopScheduler.Pending("Random-Boolean-Device"))
+
+	app.shutdown()
+	assert.False(t, app.stopScheduler.Pending("Random-Boolean-Device"))
+	assert.Len(t, stopped, 1)
+}
+
+func TestProcessGlucoseEvent(t *testing.T) {
+	app := newTestApp(validAppCustomConfig(t))
+	mockAppService := &mocks.ApplicationService{}
+	mockAppService.On("BuildContext", mock.Anything, common.ContentTypeJSON).
+		Return(pkg.NewAppFuncContextForTest("test", app.lc))
+	app.service = mockAppService
+
+	readingTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+	event := dtos.NewEvent("", "Patient_Monitor_19524", config.GlucoseResource)
+	require.NoError(t, event.AddSimpleReading("Uint16", common.ValueTypeUint16, uint16(100)))
+	event.Readings[0].Origin = readingTime.UnixNano()
+	app.processGlucoseEvent(event)
+
+	// Recorded by the same decisions as events from the MessageBus
+	mockAppService.AssertExpectations(t)
+	status := app.sensors.Status(time.Now())
+	require.Len(t, status, 1)
+	require.NotNil(t, status[0].LastReading)
+	assert.True(t, readingTime.Equal(*status[0].LastReading))
+}
+
+// newTestApp returns an app with every component created from the given configuration, without the app service.
+func newTestApp(initial config.AppCustomConfig) *myApp {
+	app := &myApp{
+		lc:            logger.NewMockClient(),
+		serviceConfig: &config.ServiceConfig{AppCustom: initial},
+	}
+	app.insulinOnBoard = functions.NewInsulinOnBoard(initial.Insulin)
+	app.patients = functions.NewPatients(initial)
+	app.doseCalculator = functions.NewDoseCalculator(initial.Injector, app.lc, app.insulinOnBoard, app.patients)
+	app.suspension = functions.NewSuspension(initial.Suspend.ResumeGlucose)
+	app.stopScheduler = functions.NewStopScheduler("")
+	app.glucoseHistory = functions.NewGlucoseHistory(initial.Suspend)
+	app.injector = functions.NewInjectorCommander(initial.Injector, app.lc, nil, app.patients)
+	app.lockout = functions.NewLockout(initial.Lockout)
+	app.glucoseFilter = functions.NewGlucoseFilter(initial.Filter)
+	app.sensors = functions.NewSensorLiveness(initial.Liveness, app.lc, app.patients)
+	app.manualBolus = functions.NewManualBolus(initial.Bolus, app.lc, app.doseCalculator, app.insulinOnBoard,
+		app.suspension, app.stopScheduler, app.glucoseHistory, app.injector, app.lockout, app.patients)
+	app.sendCommand = functions.NewSendCommand(initial, app.insulinOnBoard, app.doseCalculator, app.suspension,
+		app.stopScheduler, app.glucoseHistory, app.injector, app.lockout, app.patients, app.glucoseFilter, app.sensors)
+	app.subscriber = messages.NewSubscriber(initial.Mqtt, nil, app.patients, app.processGlucoseEvent)
+	return app
+}
+
+// cancelledContext returns the AppContext of a service that is already shutting down, so the MQTT subscriber is
+// never connected to a broker.
+func cancelledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+// validAppCustomConfig returns a valid configuration persisting pending stops in the test's temporary directory.
+func validAppCustomConfig(t *testing.T) config.AppCustomConfig {
+	return config.AppCustomConfig{
+		GlucoseRules: map[string]config.GlucoseRule{
+			"high": {
+				ResourceName: "Uint16",
+				Comparison:   config.ComparisonGreater,
+				Threshold:    120,
+				Units:        config.UnitsMgDl,
+				Action:       config.ActionActuate,
+				Severity:     "CRITICAL",
+				Category:     "HYPERGLYCEMIA",
+			},
+		},
+		Insulin: config.InsulinConfig{
+			ActionDurationMinutes:  240,
+			DecayCurve:             config.DecayCurveLinear,
+			TargetGlucose:          110,
+			SensitivityFactor:      50,
+			CarbRatio:              10,
+			MinDoseUnits:           0.05,
+			MaxDoseUnits:           2,
+			PumpRateUnitsPerMinute: 1,
+			MaxOnBoardUnits:        3,
+			MaxHourlyUnits:         4,
+			MaxDailyUnits:          20,
+		},
+		Asset: config.AssetConfig{
+			Id:   34,
+			Name: "Patient_Monitor_19524",
+		},
+		MqttMonitorDevice: "Patient_Monitor_19524",
+		Mqtt: config.MqttConfig{
+			BrokerAddress:       "tcp://edgex-mqtt-broker:1883",
+			Topics:              "high-glucose",
+			CleanSession:        true,
+			KeepAliveSeconds:    30,
+			MaxReconnectSeconds: 60,
+		},
+		Injector: config.InjectorConfig{
+			DeviceName:            "insulin-injector",
+			DeliveryMode:          config.DeliveryModeDuration,
+			PendingStopsFile:      filepath.Join(t.TempDir(), "pending-stops.json"),
+			CommandAttempts:       3,
+			RetryBackoffMillis:    100,
+			MaxRetryBackoffMillis: 1000,
+		},
+		Suspend: config.SuspendConfig{
+			ResumeGlucose:      90,
+			PredictiveAction:   config.ActionSuspend,
+			PredictiveFloor:    80,
+			PredictionMinutes:  30,
+			TrendWindowMinutes: 20,
+			MinTrendReadings:   3,
+		},
+		Bolus: config.BolusConfig{
+			MinGlucose:           120,
+			MaxGlucoseAgeMinutes: 15,
+		},
+		Lockout: config.LockoutConfig{
+			Minutes: 15,
+		},
+	}
+}
@@ -0,0 +1,85 @@
+package messages
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"app-insulin-service/config"
+)
+
+// Keys of the MQTT credentials in the secret named by the Mqtt SecretName, as used by the EdgeX MQTT export
+const (
+	usernameSecret   = "username"
+	passwordSecret   = "password"
+	clientCertSecret = "clientcert"
+	clientKeySecret  = "clientkey"
+	caCertSecret     = "cacert"
+)
+
+// SecretProvider retrieves secrets from the service's secret store, as the ApplicationService SecretProvider does.
+type SecretProvider interface {
+	GetSecret(secretName string, keys ...string) (map[string]string, error)
+}
+
+// applyCredentials configures TLS for a TLS broker and the credentials for the configured AuthMode, which are
+// resolved from the secret store each time so rotated credentials are used on the next connection.
+func applyCredentials(opts *mqtt.ClientOptions, mqttConfig config.MqttConfig, secrets SecretProvider) error {
+	var secretData map[string]string
+	if mqttConfig.AuthMode != "" && mqttConfig.AuthMode != config.MqttAuthNone {
+		if secrets == nil {
+			return errors.New("secret store is not available")
+		}
+
+		var err error
+		secretData, err = secrets.GetSecret(mqttConfig.SecretName)
+		if err != nil {
+			return fmt.Errorf("unable to get secret '%s': %s", mqttConfig.SecretName, err.Error())
+		}
+	}
+
+	required := map[string][]string{
+		config.MqttAuthUsernamePassword: {usernameSecret, passwordSecret},
+		config.MqttAuthClientCert:       {clientCertSecret, clientKeySecret},
+		config.MqttAuthCACert:           {caCertSecret},
+	}
+	for _, key := range required[mqttConfig.AuthMode] {
+		if secretData[key] == "" {
+			return fmt.Errorf("secret '%s' has no %s", mqttConfig.SecretName, key)
+		}
+	}
+
+	if mqttConfig.AuthMode == config.MqttAuthUsernamePassword {
+		opts.SetUsername(secretData[usernameSecret])
+		opts.SetPassword(secretData[passwordSecret])
+	}
+
+	if !mqttConfig.TLS() {
+		return nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: mqttConfig.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	// Without a CA certificate the broker is verified against the system roots
+	if caCert := secretData[caCertSecret]; caCert != "" {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM([]byte(caCert)) {
+			return fmt.Errorf("secret '%s' %s is not a PEM encoded certificate", mqttConfig.SecretName, caCertSecret)
+		}
+	}
+	if mqttConfig.AuthMode == config.MqttAuthClientCert {
+		certificate, err := tls.X509KeyPair([]byte(secretData[clientCertSecret]), []byte(secretData[clientKeySecret]))
+		if err != nil {
+			return fmt.Errorf("secret '%s' client certificate is not valid: %s", mqttConfig.SecretName, err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	opts.SetTLSConfig(tlsConfig)
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package messages
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/edgexfoundry/go-mod-bootstrap/v3/bootstrap/interfaces/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"app-insulin-service/config"
+)
+
+// testCertificate returns a self signed PEM encoded certificate and its private key.
+func testCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "edgex-mqtt-broker"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+}
+
+func TestApplyCredentials(t *testing.T) {
+	cert, key := testCertificate(t)
+
+	tests := []struct {
+		Name             string
+		BrokerAddress    string
+		AuthMode         string
+		Secret           map[string]string
+		SecretError      error
+		ExpectedUsername string
+		ExpectedPassword string
+		ExpectedTLS      bool
+		ExpectedRootCAs  bool
+		ExpectedCerts    int
+		ExpectedError    string
+	}{
+		{"No auth", "tcp://edgex-mqtt-broker:1883", config.MqttAuthNone, nil, nil, "", "", false, false, 0, ""},
+		{"No auth over TLS", "ssl://edgex-mqtt-broker:8883", config.MqttAuthNone, nil, nil, "", "", true, false, 0, ""},
+		{"Username and password", "ssl://edgex-mqtt-broker:8883", config.MqttAuthUsernamePassword,
+			map[string]string{"username": "insulin", "password": "secret"}, nil, "insulin", "secret", true, false, 0, ""},
+		{"Username and password with CA", "mqtts://edgex-mqtt-broker:8883", config.MqttAuthUsernamePassword,
+			map[string]string{"username": "insulin", "password": "secret", "cacert": cert}, nil, "insulin", "secret", true, true, 0, ""},
+		{"CA certificate", "tls://edgex-mqtt-broker:8883", config.MqttAuthCACert,
+			map[string]string{"cacert": cert}, nil, "", "", true, true, 0, ""},
+		{"Client certificate", "ssl://edgex-mqtt-broker:8883", config.MqttAuthClientCert,
+			map[string]string{"clientcert": cert, "clientkey": key, "cacert": cert}, nil, "", "", true, true, 1, ""},
+		{"Missing password", "ssl://edgex-mqtt-broker:8883", config.MqttAuthUsernamePassword,
+			map[string]string{"username": "insulin"}, nil, "", "", false, false, 0, "secret 'mqtt' has no password"},
+		{"Missing client key", "ssl://edgex-mqtt-broker:8883", config.MqttAuthClientCert,
+			map[string]string{"clientcert": cert}, nil, "", "", false, false, 0, "secret 'mqtt' has no clientkey"},
+		{"Invalid CA certificate", "ssl://edgex-mqtt-broker:8883", config.MqttAuthCACert,
+			map[string]string{"cacert": "not a certificate"}, nil, "", "", false, false, 0, "secret 'mqtt' cacert is not a PEM encoded certificate"},
+		{"Invalid client certificate", "ssl://edgex-mqtt-broker:8883", config.MqttAuthClientCert,
+			map[string]string{"clientcert": cert, "clientkey": "not a key"}, nil, "", "", false, false, 0, "secret 'mqtt' client certificate is not valid"},
+		{"Secret store error", "ssl://edgex-mqtt-broker:8883", config.MqttAuthUsernamePassword,
+			nil, errors.New("permission denied"), "", "", false, false, 0, "unable to get secret 'mqtt': permission denied"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			secrets := &mocks.SecretProvider{}
+			secrets.On("GetSecret", "mqtt").Return(test.Secret, test.SecretError)
+			mqttConfig := config.MqttConfig{
+				BrokerAddress: test.BrokerAddress,
+				AuthMode:      test.AuthMode,
+				SecretName:    "mqtt",
+				ServerName:    "broker.example.com",
+			}
+
+			opts := mqtt.NewClientOptions()
+			err := applyCredentials(opts, mqttConfig, secrets)
+			if test.ExpectedError != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.ExpectedError)
+				return
+			}
+			require.NoError(t, err)
+
+			assert.Equal(t, test.ExpectedUsername, opts.Username)
+			assert.Equal(t, test.ExpectedPassword, opts.Password)
+			if test.AuthMode == config.MqttAuthNone {
+				secrets.AssertNotCalled(t, "GetSecret", "mqtt")
+			}
+			if !test.ExpectedTLS {
+				assert.Nil(t, opts.TLSConfig)
+				return
+			}
+			require.NotNil(t, opts.TLSConfig)
+			assert.Equal(t, "broker.example.com", opts.TLSConfig.ServerName)
+			assert.Equal(t, uint16(tls.VersionTLS12), opts.TLSConfig.MinVersion)
+			assert.Equal(t, test.ExpectedRootCAs, opts.TLSConfig.RootCAs != nil)
+			assert.Len(t, opts.TLSConfig.Certificates, test.ExpectedCerts)
+		})
+	}
+}
+
+func TestApplyCredentials_NoSecretStore(t *testing.T) {
+	mqttConfig := config.MqttConfig{BrokerAddress: "ssl://edgex-mqtt-broker:8883", AuthMode: config.MqttAuthCACert, SecretName: "mqtt"}
+
+	err := applyCredentials(mqtt.NewClientOptions(), mqttConfig, nil)
+	require.Error(t, err)
+	assert.Equal(t, "secret store is not available", err.Error())
+
+	// Without credentials no secret store is needed
+	mqttConfig.AuthMode = config.MqttAuthNone
+	require.NoError(t, applyCredentials(mqtt.NewClientOptions(), mqttConfig, nil))
+}
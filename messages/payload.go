@@ -0,0 +1,140 @@
+package messages
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/common"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/dtos"
+
+	"app-insulin-service/config"
+	"app-insulin-service/functions"
+)
+
+// GlucoseMessageVersion is the version of the glucose message schema accepted on the glucose topics
+const GlucoseMessageVersion = 1
+
+// maxClockSkew is how far in the future a glucose message may be timestamped, allowing for the monitor's clock
+const maxClockSkew = time.Minute
+
+// GlucoseMessage is a glucose reading published on the glucose topics, e.g.
+//
+//	{"version": 1, "device": "Patient_Monitor_19524", "patientId": "alice", "value": 7.2, "units": "mmol/L",
+//	 "timestamp": "2024-05-01T10:15:00Z", "sequence": 42}
+//
+// Every field is required except patientId, which is empty for a monitor without a patient profile.
+type GlucoseMessage struct {
+	Version int    `json:"version"`
+	Device  string `json:"device"`
+	// PatientId is the name of the patient profile of the patient wearing the device
+	PatientId string     `json:"patientId,omitempty"`
+	Value     *float64   `json:"value"`
+	Units     string     `json:"units"`
+	Timestamp *time.Time `json:"timestamp"`
+	// Sequence increases with each message the device publishes
+	Sequence *uint64 `json:"sequence"`
+}
+
+// DeadLetter is published to the dead letter topic for each glucose message that is rejected.
+type DeadLetter struct {
+	Topic      string    `json:"topic"`
+	Payload    string    `json:"payload"`
+	Reason     string    `json:"reason"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+// decodeGlucoseMessage decodes a glucose message, rejecting any that is not exactly the supported schema or is not
+// a valid glucose reading.
+func decodeGlucoseMessage(payload []byte, now time.Time) (GlucoseMessage, error) {
+	// The version is checked first, so a message of another version is reported as such rather than as malformed.
+	// Data after the JSON object is rejected here too.
+	var versioned struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal(payload, &versioned); err != nil {
+		return GlucoseMessage{}, fmt.Errorf("message is not valid JSON: %s", err.Error())
+	}
+	if versioned.Version == nil {
+		return GlucoseMessage{}, errors.New("version is required")
+	}
+	if *versioned.Version != GlucoseMessageVersion {
+		return GlucoseMessage{}, fmt.Errorf("version %d is not supported", *versioned.Version)
+	}
+
+	var message GlucoseMessage
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&message); err != nil {
+		return GlucoseMessage{}, fmt.Errorf("message does not match version %d: %s", GlucoseMessageVersion,
+			err.Error())
+	}
+
+	switch {
+	case strings.TrimSpace(message.Device) == "":
+		return GlucoseMessage{}, errors.New("device is required")
+	case message.Value == nil:
+		return GlucoseMessage{}, errors.New("value is required")
+	case message.Units == "":
+		return GlucoseMessage{}, errors.New("units are required")
+	case message.Timestamp == nil || message.Timestamp.IsZero():
+		return GlucoseMessage{}, errors.New("timestamp is required")
+	case message.Sequence == nil:
+		return GlucoseMessage{}, errors.New("sequence is required")
+	}
+
+	if message.Timestamp.After(now.Add(maxClockSkew)) {
+		return GlucoseMessage{}, fmt.Errorf("timestamp %s is in the future", message.Timestamp.Format(time.RFC3339))
+	}
+
+	if _, err := functions.ParseGlucose(strconv.FormatFloat(*message.Value, 'f', -1, 64), message.Units); err != nil {
+		return GlucoseMessage{}, err
+	}
+
+	return message, nil
+}
+
+// Event returns the message as an event from its device with a single reading of the Glucose resource, taken at
+// the message's timestamp, so it is matched against the bands for that resource.
+func (m GlucoseMessage) Event() (dtos.Event, error) {
+	event := dtos.NewEvent("", m.Device, config.GlucoseResource)
+	event.Origin = m.Timestamp.UnixNano()
+	if err := event.AddSimpleReading(config.GlucoseResource, common.ValueTypeFloat64, *m.Value); err != nil {
+		return dtos.Event{}, fmt.Errorf("unable to create glucose reading: %s", err.Error())
+	}
+	event.Readings[0].Origin = event.Origin
+	event.Readings[0].Units = m.Units
+	return event, nil
+}
+
+// sequenceTracker rejects glucose messages that repeat or precede one already accepted from the same device, e.g.
+// when redelivered by the broker.
+type sequenceTracker struct {
+	mutex sync.Mutex
+	last  map[string]GlucoseMessage
+}
+
+func newSequenceTracker() *sequenceTracker {
+	return &sequenceTracker{last: make(map[string]GlucoseMessage)}
+}
+
+// Accept records the message as the latest from its device, or returns an error if it is not newer than the last
+// accepted. A lower sequence with a later timestamp is accepted, as the device has restarted its sequence.
+func (t *sequenceTracker) Accept(message GlucoseMessage) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if last, exists := t.last[message.Device]; exists && *message.Sequence <= *last.Sequence &&
+		!message.Timestamp.After(*last.Timestamp) {
+		return fmt.Errorf("sequence %d is not after %d, the message is a duplicate or out of order",
+			*message.Sequence, *last.Sequence)
+	}
+
+	t.last[message.Device] = message
+	return nil
+}
@@ -0,0 +1,191 @@
+package messages
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/dtos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"app-insulin-service/config"
+)
+
+// fakeMessage is a message received on a topic. Methods the subscriber does not use are left to the embedded nil
+// Message.
+type fakeMessage struct {
+	mqtt.Message
+	topic   string
+	payload string
+}
+
+func (m fakeMessage) Topic() string   { return m.topic }
+func (m fakeMessage) Payload() []byte { return []byte(m.payload) }
+
+func TestDecodeGlucoseMessage(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 20, 0, 0, time.UTC)
+
+	tests := []struct {
+		Name          string
+		Payload       string
+		ExpectedValue float64
+		ExpectedError string
+	}{
+		{"Valid mmol/L", `{"version": 1, "device": "monitor-1", "patientId": "alice", "value": 7.2, "units": "mmol/L", "timestamp": "2024-05-01T10:15:00Z", "sequence": 42}`,
+			7.2, ""},
+		{"Valid mg/dL without patient", `{"version": 1, "device": "mqtt-monitor", "value": 130, "units": "mg/dL", "timestamp": "2024-05-01T10:15:00Z", "sequence": 0}`,
+			130, ""},
+		{"Within clock skew", `{"version": 1, "device": "monitor-1", "value": 130, "units": "mg/dL", "timestamp": "2024-05-01T10:20:30Z", "sequence": 1}`,
+			130, ""},
+		{"Not JSON", `glucose 130`, 0, "message is not valid JSON"},
+		{"Missing version", `{"device": "monitor-1", "value": 130, "units": "mg/dL", "timestamp": "2024-05-01T10:15:00Z", "sequence": 1}`,
+			0, "version is required"},
+		{"Unsupported version", `{"version": 2, "device": "monitor-1", "reading": {"value": 130}}`, 0, "version 2 is not supported"},
+		{"Unknown field", `{"version": 1, "device": "monitor-1", "value": 130, "units": "mg/dL", "timestamp": "2024-05-01T10:15:00Z", "sequence": 1, "trend": "up"}`,
+			0, `message does not match version 1: json: unknown field "trend"`},
+		{"Wrong type", `{"version": 1, "device": "monitor-1", "value": "130", "units": "mg/dL", "timestamp": "2024-05-01T10:15:00Z", "sequence": 1}`,
+			0, "message does not match version 1"},
+		{"Trailing data", `{"version": 1, "device": "monitor-1", "value": 130, "units": "mg/dL", "timestamp": "2024-05-01T10:15:00Z", "sequence": 1} {}`,
+			0, "message is not valid JSON: invalid character '{' after top-level value"},
+		{"Missing device", `{"version": 1, "device": " ", "value": 130, "units": "mg/dL", "timestamp": "2024-05-01T10:15:00Z", "sequence": 1}`,
+			0, "device is required"},
+		{"Missing value", `{"version": 1, "device": "monitor-1", "units": "mg/dL", "timestamp": "2024-05-01T10:15:00Z", "sequence": 1}`,
+			0, "value is required"},
+		{"Missing units", `{"version": 1, "device": "monitor-1", "value": 130, "timestamp": "2024-05-01T10:15:00Z", "sequence": 1}`,
+			0, "units are required"},
+		{"Missing timestamp", `{"version": 1, "device": "monitor-1", "value": 130, "units": "mg/dL", "sequence": 1}`,
+			0, "timestamp is required"},
+		{"Zero timestamp", `{"version": 1, "device": "monitor-1", "value": 130, "units": "mg/dL", "timestamp": "0001-01-01T00:00:00Z", "sequence": 1}`,
+			0, "timestamp is required"},
+		{"Missing sequence", `{"version": 1, "device": "monitor-1", "value": 130, "units": "mg/dL", "timestamp": "2024-05-01T10:15:00Z"}`,
+			0, "sequence is required"},
+		{"Future timestamp", `{"version": 1, "device": "monitor-1", "value": 130, "units": "mg/dL", "timestamp": "2024-05-01T10:25:00Z", "sequence": 1}`,
+			0, "timestamp 2024-05-01T10:25:00Z is in the future"},
+		{"Unsupported units", `{"version": 1, "device": "monitor-1", "value": 130, "units": "g/L", "timestamp": "2024-05-01T10:15:00Z", "sequence": 1}`,
+			0, "glucose units 'g/L' are not supported"},
+		{"Negative value", `{"version": 1, "device": "monitor-1", "value": -5, "units": "mg/dL", "timestamp": "2024-05-01T10:15:00Z", "sequence": 1}`,
+			0, "glucose value '-5' is not a valid reading"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			message, err := decodeGlucoseMessage([]byte(test.Payload), now)
+			if test.ExpectedError != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.ExpectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, message.Value)
+			assert.Equal(t, test.ExpectedValue, *message.Value)
+		})
+	}
+}
+
+func TestSequenceTracker_Accept(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 15, 0, 0, time.UTC)
+	message := func(device string, sequence uint64, minutes int) GlucoseMessage {
+		timestamp := start.Add(time.Duration(minutes) * time.Minute)
+		return GlucoseMessage{Version: GlucoseMessageVersion, Device: device, Sequence: &sequence, Timestamp: &timestamp}
+	}
+
+	// Each message is offered in turn to the same tracker
+	tests := []struct {
+		Name          string
+		Message       GlucoseMessage
+		ExpectedError string
+	}{
+		{"First", message("monitor-1", 10, 0), ""},
+		{"Next", message("monitor-1", 11, 5), ""},
+		{"Duplicate", message("monitor-1", 11, 5), "sequence 11 is not after 11, the message is a duplicate or out of order"},
+		{"Out of order", message("monitor-1", 10, 0), "sequence 10 is not after 11, the message is a duplicate or out of order"},
+		{"Lower sequence at the same time", message("monitor-1", 3, 5), "sequence 3 is not after 11"},
+		{"Other device", message("monitor-2", 1, 0), ""},
+		{"Restarted sequence", message("monitor-1", 1, 10), ""},
+		{"After restart", message("monitor-1", 2, 15), ""},
+	}
+
+	tracker := newSequenceTracker()
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := tracker.Accept(test.Message)
+			if test.ExpectedError != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.ExpectedError)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestSubscriber_Handle_DeadLetter(t *testing.T) {
+	valid := `{"version": 1, "device": "monitor-1", "patientId": "alice", "value": 7.2, "units": "mmol/L", "timestamp": "2024-05-01T10:15:00Z", "sequence": 42}`
+
+	tests := []struct {
+		Name            string
+		Payloads        []string
+		DeadLetterTopic string
+		ExpectedEvents  int
+		ExpectedReasons []string
+	}{
+		{"Valid", []string{valid}, "high-glucose/dead-letter", 1, nil},
+		{"Malformed", []string{`{"version": 1}`}, "high-glucose/dead-letter", 0, []string{"device is required"}},
+		{"Unsupported version", []string{`{"version": 3}`}, "high-glucose/dead-letter", 0, []string{"version 3 is not supported"}},
+		{"Unknown monitor", []string{`{"version": 1, "device": "monitor-9", "value": 130, "units": "mg/dL", "timestamp": "2024-05-01T10:15:00Z", "sequence": 1}`},
+			"high-glucose/dead-letter", 0, []string{"device 'monitor-9' is not a configured glucose monitor"}},
+		{"Wrong patient", []string{`{"version": 1, "device": "monitor-1", "patientId": "bob", "value": 130, "units": "mg/dL", "timestamp": "2024-05-01T10:15:00Z", "sequence": 1}`},
+			"high-glucose/dead-letter", 0, []string{"patientId 'bob' does not match patient 'alice' wearing device 'monitor-1'"}},
+		{"Redelivered", []string{valid, valid}, "high-glucose/dead-letter", 1,
+			[]string{"sequence 42 is not after 42, the message is a duplicate or out of order"}},
+		{"No dead letter topic", []string{`{"version": 1}`}, "", 0, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var events []dtos.Event
+			target := newTestSubscriber(func(event dtos.Event) { events = append(events, event) })
+			mqttConfig := testMqttConfig()
+			mqttConfig.DeadLetterTopic = test.DeadLetterTopic
+			require.NoError(t, target.UpdateConfig(mqttConfig))
+			client := newFakeClient()
+
+			for _, payload := range test.Payloads {
+				target.handle(client, fakeMessage{topic: "high-glucose/alice", payload: payload})
+			}
+			// Stopping handles the queued messages
+			target.Stop()
+
+			assert.Len(t, events, test.ExpectedEvents)
+			for _, event := range events {
+				assert.Equal(t, "monitor-1", event.DeviceName)
+				assert.Equal(t, config.GlucoseResource, event.Readings[0].ResourceName)
+			}
+
+			deadLetters := client.publishedTo("high-glucose/dead-letter")
+			require.Len(t, deadLetters, len(test.ExpectedReasons))
+			for index, data := range deadLetters {
+				var deadLetter DeadLetter
+				require.NoError(t, json.Unmarshal([]byte(data), &deadLetter))
+				assert.Equal(t, "high-glucose/alice", deadLetter.Topic)
+				assert.Equal(t, test.Payloads[index+test.ExpectedEvents], deadLetter.Payload)
+				assert.Equal(t, test.ExpectedReasons[index], deadLetter.Reason)
+				assert.False(t, deadLetter.ReceivedAt.IsZero())
+			}
+		})
+	}
+}
+
+func TestSubscriber_Handle_Stopping(t *testing.T) {
+	processed := 0
+	target := newTestSubscriber(func(dtos.Event) { processed++ })
+	client := newFakeClient()
+	target.Stop()
+
+	// Dropped rather than rejected, it is redelivered to the next subscriber
+	target.handle(client, fakeMessage{topic: "high-glucose/alice", payload: `{"version": 1}`})
+	assert.Zero(t, processed)
+	assert.Empty(t, client.publishedTo("high-glucose/dead-letter"))
+}
@@ -0,0 +1,526 @@
+package messages
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	gometrics "github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+
+	"app-insulin-service/config"
+	"app-insulin-service/functions"
+)
+
+// States of the connection to the MQTT broker
+const (
+	StateConnecting   = "connecting"
+	StateConnected    = "connected"
+	StateReconnecting = "reconnecting"
+	StateStopped      = "stopped"
+)
+
+// Names of the metrics reporting the connection to the MQTT broker
+const (
+	MqttConnectedName       = "MqttConnected"
+	MqttConnectionsLostName = "MqttConnectionsLost"
+)
+
+const (
+	// connectTimeout bounds each attempt to connect, subscribe or unsubscribe
+	connectTimeout = 10 * time.Second
+	// initialRetryInterval is the wait after the first failed attempt to connect or subscribe, doubled after each
+	// further failure up to the configured MaxReconnectSeconds
+	initialRetryInterval = time.Second
+	// disconnectQuiesce is how long, in milliseconds, in-flight work is given to complete when disconnecting
+	disconnectQuiesce = 250
+	// messageQueueSize bounds the messages received but not yet handled
+	messageQueueSize = 100
+)
+
+// errSuperseded is returned by a connection attempt when the connection has since been restarted
+var errSuperseded = errors.New("connection superseded")
+
+// receivedMessage is a message received from the broker waiting to be handled.
+type receivedMessage struct {
+	client mqtt.Client
+	msg    mqtt.Message
+}
+
+// ConnectionStatus describes the connection to the MQTT broker.
+type ConnectionStatus struct {
+	BrokerAddress string `json:"brokerAddress"`
+	Topics        string `json:"topics"`
+	// State is connected once the topics are subscribed
+	State string    `json:"state"`
+	Since time.Time `json:"since"`
+	// LastError is the reason the last attempt to connect or subscribe failed, or the connection was lost
+	LastError       string `json:"lastError,omitempty"`
+	ConnectionsLost int64  `json:"connectionsLost"`
+}
+
+// Subscriber subscribes to glucose readings published on the configured MQTT topics and processes each as an event
+// from its glucose monitor, through the same decisions as events from the EdgeX MessageBus. Messages are
+// GlucoseMessage readings from a configured glucose monitor, malformed messages are rejected to the dead letter
+// topic. Broker credentials are resolved from the secret store.
+//
+// Failed attempts to connect are retried with exponential backoff and a lost connection is re-established the same
+// way, resubscribing to the topics each time it connects. Nothing the broker does stops the service.
+//
+// Messages are queued as they are received and handled in order by a single worker, so the client's callback never
+// waits on the dosing decisions.
+type Subscriber struct {
+	mutex    sync.Mutex
+	config   config.MqttConfig
+	secrets  SecretProvider
+	handler  messageHandler
+	started  bool
+	stopping bool
+	// done is closed when stopping, ending retries
+	done     chan struct{}
+	stopOnce sync.Once
+	// queue holds the messages received but not yet handled, it is closed when stopping
+	queue chan receivedMessage
+	// drained is closed once the worker has handled every queued message after stopping
+	drained chan struct{}
+	// client is nil until connected
+	client mqtt.Client
+	// generation is incremented each time the connection is restarted, callbacks and retries of earlier
+	// connections are ignored
+	generation      int
+	state           string
+	since           time.Time
+	lastError       string
+	connected       gometrics.Gauge
+	connectionsLost gometrics.Counter
+}
+
+// NewSubscriber creates a Subscriber using the given, already validated, configuration that passes glucose events
+// to process. It does not connect until started, the worker handling received messages runs until it is stopped.
+func NewSubscriber(mqttConfig config.MqttConfig, secrets SecretProvider, patients *functions.Patients,
+	process EventProcessor) *Subscriber {
+	s := &Subscriber{
+		config:          mqttConfig,
+		secrets:         secrets,
+		handler:         makeMessageHandler(patients, process),
+		done:            make(chan struct{}),
+		queue:           make(chan receivedMessage, messageQueueSize),
+		drained:         make(chan struct{}),
+		state:           StateConnecting,
+		since:           time.Now(),
+		connected:       gometrics.NewGauge(),
+		connectionsLost: gometrics.NewCounter(),
+	}
+	go s.work()
+	return s
+}
+
+// Start connects to the MQTT broker in the background and subscribes to the configured topics once connected. The
+// subscriber is stopped when the context is cancelled, as the service's AppContext is when the service shuts down.
+// It does not connect once the context is cancelled.
+func (s *Subscriber) Start(ctx context.Context) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.started || s.stopping || ctx.Err() != nil {
+		return
+	}
+	s.started = true
+	s.restart()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Stop()
+		case <-s.done:
+		}
+	}()
+}
+
+// Stop stops receiving glucose readings. It disconnects from the broker and handles the messages already received,
+// returning once they are handled, however many times it is called.
+func (s *Subscriber) Stop() {
+	s.stopOnce.Do(func() {
+		s.mutex.Lock()
+		s.stopping = true
+		s.generation++
+		client := s.client
+		s.client = nil
+		s.setState(StateStopped, nil)
+		close(s.done)
+		close(s.queue)
+		s.mutex.Unlock()
+
+		if client != nil {
+			client.Disconnect(disconnectQuiesce)
+		}
+		<-s.drained
+		log.Info("MQTT subscriber stopped")
+	})
+}
+
+// UpdateConfig applies an updated MQTT configuration without restarting the service. The subscriber reconnects
+// when the connection settings change and resubscribes when only the topics or QoS change. An updated dead letter
+// topic applies to the next rejected message.
+func (s *Subscriber) UpdateConfig(mqttConfig config.MqttConfig) error {
+	previous, client := s.applyConfig(mqttConfig)
+	if client == nil {
+		return nil
+	}
+
+	// Waited on without the lock, which the client's message and connection callbacks take
+	token := client.Unsubscribe(previous.TopicList()...)
+	if token.WaitTimeout(connectTimeout) && token.Error() != nil {
+		log.Warnf("Unable to unsubscribe from %s: %s", previous.Topics, token.Error().Error())
+	}
+	return subscribe(client, mqttConfig)
+}
+
+// applyConfig records the updated configuration, restarting the connection when the connection settings change. It
+// returns the previous configuration and the client to resubscribe when only the topics or QoS change, which is nil
+// when there is nothing to resubscribe. Until connected the updated topics are subscribed once it is.
+func (s *Subscriber) applyConfig(mqttConfig config.MqttConfig) (config.MqttConfig, mqtt.Client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := s.config
+	s.config = mqttConfig
+	if !s.running() || previous == mqttConfig {
+		return previous, nil
+	}
+
+	connection, updated := previous, mqttConfig
+	connection.Topics, connection.Qos, connection.DeadLetterTopic = "", 0, ""
+	updated.Topics, updated.Qos, updated.DeadLetterTopic = "", 0, ""
+	if connection != updated {
+		s.restart()
+		return previous, nil
+	}
+	return previous, s.client
+}
+
+// SecretUpdated reconnects with the updated credentials when the named secret holds the broker credentials.
+func (s *Subscriber) SecretUpdated(secretName string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.running() && secretName == s.config.SecretName {
+		s.restart()
+	}
+}
+
+// Status returns the state of the connection to the broker.
+func (s *Subscriber) Status() ConnectionStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return ConnectionStatus{
+		BrokerAddress:   s.config.BrokerAddress,
+		Topics:          s.config.Topics,
+		State:           s.state,
+		Since:           s.since,
+		LastError:       s.lastError,
+		ConnectionsLost: s.connectionsLost.Count(),
+	}
+}
+
+// Metrics returns the metrics reporting the connection to the broker by name: whether it is connected and
+// subscribed, 1 or 0, and how many times the connection has been lost.
+func (s *Subscriber) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		MqttConnectedName:       s.connected,
+		MqttConnectionsLostName: s.connectionsLost,
+	}
+}
+
+// running returns whether the subscriber has been started and is not stopping. Caller must hold the lock.
+func (s *Subscriber) running() bool {
+	return s.started && !s.stopping
+}
+
+// handle queues a message for the worker without waiting, unless stopping, in which case it is dropped so Stop
+// does not wait on new messages. A message that finds the queue full is rejected to the dead letter topic rather
+// than holding up the client.
+func (s *Subscriber) handle(client mqtt.Client, msg mqtt.Message) {
+	s.mutex.Lock()
+	if s.stopping {
+		s.mutex.Unlock()
+		log.Warnf("Message from topic %s dropped, the subscriber is stopping", msg.Topic())
+		return
+	}
+	select {
+	case s.queue <- receivedMessage{client: client, msg: msg}:
+		s.mutex.Unlock()
+	default:
+		s.mutex.Unlock()
+		s.deadLetter(client, msg, fmt.Errorf("%d glucose messages are already waiting to be handled", messageQueueSize))
+	}
+}
+
+// work handles queued messages in the order they were received until the queue is closed and drained. Malformed
+// messages are published to the dead letter topic.
+func (s *Subscriber) work() {
+	defer close(s.drained)
+	for received := range s.queue {
+		if err := s.handler(received.msg); err != nil {
+			s.deadLetter(received.client, received.msg, err)
+		}
+	}
+}
+
+// deadLetter publishes a rejected message to the dead letter topic, with the reason it was rejected.
+func (s *Subscriber) deadLetter(client mqtt.Client, msg mqtt.Message, reason error) {
+	s.mutex.Lock()
+	topic, qos := s.config.DeadLetterTopic, byte(s.config.Qos)
+	s.mutex.Unlock()
+
+	log.Errorf("Glucose message from topic %s rejected: %s", msg.Topic(), reason.Error())
+	if topic == "" {
+		return
+	}
+
+	data, err := json.Marshal(DeadLetter{
+		Topic:      msg.Topic(),
+		Payload:    string(msg.Payload()),
+		Reason:     reason.Error(),
+		ReceivedAt: time.Now(),
+	})
+	if err != nil {
+		log.Errorf("Unable to marshal dead letter: %s", err.Error())
+		return
+	}
+
+	token := client.Publish(topic, qos, false, data)
+	// Waiting within a message handler would block the delivery of further messages
+	go func() {
+		if !token.WaitTimeout(connectTimeout) {
+			log.Errorf("Timed out publishing dead letter to %s", topic)
+		} else if token.Error() != nil {
+			log.Errorf("Unable to publish dead letter to %s: %s", topic, token.Error().Error())
+		}
+	}()
+}
+
+// restart disconnects from the broker, if connected, and connects again in the background with the current
+// configuration and credentials. Caller must hold the lock.
+func (s *Subscriber) restart() {
+	s.generation++
+	if s.client != nil {
+		go s.client.Disconnect(disconnectQuiesce)
+		s.client = nil
+	}
+	s.setState(StateConnecting, nil)
+
+	go s.connect(s.generation)
+}
+
+// connect connects to the broker, retrying with exponential backoff until connected or the connection is restarted.
+func (s *Subscriber) connect(generation int) {
+	wait := initialRetryInterval
+	for {
+		err := s.tryConnect(generation)
+		if err == nil || errors.Is(err, errSuperseded) {
+			return
+		}
+
+		if !s.failed(generation, err) {
+			return
+		}
+		log.Errorf("Unable to connect to the MQTT broker, retrying in %s: %s", wait, err.Error())
+		if !s.sleep(wait) {
+			return
+		}
+		wait = s.backoff(wait)
+	}
+}
+
+// tryConnect makes a single attempt to connect to the broker. Topics are subscribed by the connect handler.
+func (s *Subscriber) tryConnect(generation int) error {
+	s.mutex.Lock()
+	if s.generation != generation {
+		s.mutex.Unlock()
+		return errSuperseded
+	}
+	mqttConfig := s.config
+	s.mutex.Unlock()
+
+	// Credentials are looked up without the lock
+	opts, err := s.clientOptions(generation, mqttConfig)
+	if err != nil {
+		return err
+	}
+
+	client := mqtt.NewClient(opts)
+	// Bounded by the connect timeout
+	token := client.Connect()
+	token.Wait()
+	if token.Error() != nil {
+		return fmt.Errorf("unable to connect to %s: %s", mqttConfig.BrokerAddress, token.Error().Error())
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.generation != generation {
+		go client.Disconnect(disconnectQuiesce)
+		return errSuperseded
+	}
+	s.client = client
+	return nil
+}
+
+// clientOptions returns the client options for the given configuration, with the credentials from the secret store
+// and the connection state handlers of the given generation.
+func (s *Subscriber) clientOptions(generation int, mqttConfig config.MqttConfig) (*mqtt.ClientOptions, error) {
+	opts := mqtt.NewClientOptions().AddBroker(mqttConfig.BrokerAddress)
+	opts.SetClientID(mqttConfig.ClientId)
+	opts.SetCleanSession(mqttConfig.CleanSession)
+	opts.SetKeepAlive(time.Duration(mqttConfig.KeepAliveSeconds) * time.Second)
+	opts.SetConnectTimeout(connectTimeout)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(time.Duration(mqttConfig.MaxReconnectSeconds) * time.Second)
+	opts.SetDefaultPublishHandler(s.handle)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		s.onConnect(generation, client)
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		s.onConnectionLost(generation, err)
+	})
+	opts.SetReconnectingHandler(func(mqtt.Client, *mqtt.ClientOptions) {
+		log.Infof("Reconnecting to the MQTT broker")
+	})
+	if err := applyCredentials(opts, mqttConfig, s.secrets); err != nil {
+		return nil, fmt.Errorf("unable to configure MQTT credentials: %s", err.Error())
+	}
+	return opts, nil
+}
+
+// onConnect subscribes to the configured topics each time the client connects, retrying with exponential backoff
+// while the client stays connected.
+func (s *Subscriber) onConnect(generation int, client mqtt.Client) {
+	wait := initialRetryInterval
+	for {
+		s.mutex.Lock()
+		if s.generation != generation {
+			s.mutex.Unlock()
+			return
+		}
+		mqttConfig := s.config
+		s.mutex.Unlock()
+
+		err := subscribe(client, mqttConfig)
+
+		s.mutex.Lock()
+		if s.generation != generation {
+			s.mutex.Unlock()
+			return
+		}
+		if err == nil {
+			s.setState(StateConnected, nil)
+			s.mutex.Unlock()
+			log.Infof("Connected to the MQTT broker at %s", mqttConfig.BrokerAddress)
+			return
+		}
+		s.lastError = err.Error()
+		s.mutex.Unlock()
+
+		// Once the connection is lost the next connect subscribes again
+		if !client.IsConnectionOpen() {
+			return
+		}
+		log.Errorf("Unable to subscribe to glucose topics, retrying in %s: %s", wait, err.Error())
+		if !s.sleep(wait) {
+			return
+		}
+		wait = s.backoff(wait)
+	}
+}
+
+// onConnectionLost records a lost connection, which the client re-establishes itself.
+func (s *Subscriber) onConnectionLost(generation int, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.generation != generation {
+		return
+	}
+	s.connectionsLost.Inc(1)
+	s.setState(StateReconnecting, err)
+	log.Warnf("Lost connection to the MQTT broker, glucose readings are not received until reconnected: %s",
+		err.Error())
+}
+
+// failed records a failed attempt to connect and returns whether the connection is still current.
+func (s *Subscriber) failed(generation int, err error) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.generation != generation {
+		return false
+	}
+	s.lastError = err.Error()
+	return true
+}
+
+// sleep waits before retrying and returns false, without waiting out the interval, if stopped meanwhile.
+func (s *Subscriber) sleep(wait time.Duration) bool {
+	select {
+	case <-s.done:
+		return false
+	case <-time.After(wait):
+		return true
+	}
+}
+
+// backoff returns the wait before the next retry, double the last wait up to the configured maximum.
+func (s *Subscriber) backoff(wait time.Duration) time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	maximum := time.Duration(s.config.MaxReconnectSeconds) * time.Second
+	if wait *= 2; wait > maximum {
+		return maximum
+	}
+	return wait
+}
+
+// setState records a change of connection state, with the error that caused it if any. Caller must hold the lock.
+func (s *Subscriber) setState(state string, err error) {
+	if err != nil {
+		s.lastError = err.Error()
+	} else if state == StateConnected {
+		s.lastError = ""
+	}
+	if state != s.state {
+		s.state = state
+		s.since = time.Now()
+	}
+
+	if state == StateConnected {
+		s.connected.Update(1)
+	} else {
+		s.connected.Update(0)
+	}
+}
+
+// subscribe subscribes the client to every configured topic.
+func subscribe(client mqtt.Client, mqttConfig config.MqttConfig) error {
+	filters := make(map[string]byte)
+	for _, topic := range mqttConfig.TopicList() {
+		filters[topic] = byte(mqttConfig.Qos)
+	}
+
+	token := client.SubscribeMultiple(filters, nil)
+	if !token.WaitTimeout(connectTimeout) {
+		return fmt.Errorf("timed out subscribing to %s", mqttConfig.Topics)
+	}
+	if token.Error() != nil {
+		return fmt.Errorf("unable to subscribe to %s: %s", mqttConfig.Topics, token.Error().Error())
+	}
+
+	log.Infof("Successfully subscribed to topics: %s with QoS %d", mqttConfig.Topics, mqttConfig.Qos)
+	return nil
+}
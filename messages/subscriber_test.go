@@ -0,0 +1,333 @@
+package messages
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/edgexfoundry/go-mod-bootstrap/v3/bootstrap/interfaces/mocks"
+	"github.com/edgexfoundry/go-mod-core-contracts/v3/dtos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"app-insulin-service/config"
+	"app-insulin-service/functions"
+)
+
+// fakeToken is a token that has already completed with the given error.
+type fakeToken struct {
+	err error
+}
+
+func (t fakeToken) Wait() bool                     { return true }
+func (t fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (t fakeToken) Error() error                   { return t.err }
+
+func (t fakeToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// fakeClient is a connected MQTT client recording what it subscribes to and publishes. Methods the subscriber
+// does not use are left to the embedded nil Client.
+type fakeClient struct {
+	mqtt.Client
+	mutex        sync.Mutex
+	open         bool
+	subscribeErr error
+	subscribed   []map[string]byte
+	published    map[string][]string
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{open: true, published: make(map[string][]string)}
+}
+
+func (c *fakeClient) IsConnectionOpen() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.open
+}
+
+func (c *fakeClient) SubscribeMultiple(filters map[string]byte, _ mqtt.MessageHandler) mqtt.Token {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.subscribed = append(c.subscribed, filters)
+	return fakeToken{err: c.subscribeErr}
+}
+
+func (c *fakeClient) Unsubscribe(...string) mqtt.Token {
+	return fakeToken{}
+}
+
+func (c *fakeClient) Publish(topic string, _ byte, _ bool, payload interface{}) mqtt.Token {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.published[topic] = append(c.published[topic], string(payload.([]byte)))
+	return fakeToken{}
+}
+
+func (c *fakeClient) Disconnect(uint) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.open = false
+}
+
+// publishedTo returns the payloads published to the topic.
+func (c *fakeClient) publishedTo(topic string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.published[topic]...)
+}
+
+// blockingClient is a connected client whose Unsubscribe waits until released, as it does on a slow broker.
+type blockingClient struct {
+	*fakeClient
+	unsubscribing chan struct{}
+	release       chan struct{}
+}
+
+func (c blockingClient) Unsubscribe(...string) mqtt.Token {
+	close(c.unsubscribing)
+	<-c.release
+	return fakeToken{}
+}
+
+func testMqttConfig() config.MqttConfig {
+	return config.MqttConfig{
+		BrokerAddress:       "tcp://edgex-mqtt-broker:1883",
+		Topics:              "high-glucose/#",
+		DeadLetterTopic:     "high-glucose/dead-letter",
+		Qos:                 1,
+		CleanSession:        true,
+		KeepAliveSeconds:    30,
+		MaxReconnectSeconds: 10,
+		AuthMode:            config.MqttAuthNone,
+	}
+}
+
+// newTestSubscriber returns a subscriber that has not been started, passing the events it receives to process.
+func newTestSubscriber(process EventProcessor) *Subscriber {
+	patients := functions.NewPatients(config.AppCustomConfig{
+		MqttMonitorDevice: "mqtt-monitor",
+		Patients: map[string]config.PatientConfig{
+			"alice": {MonitorDevice: "monitor-1", InjectorDevice: "injector-1"},
+		},
+	})
+	return NewSubscriber(testMqttConfig(), nil, patients, process)
+}
+
+func TestSubscriber_Backoff(t *testing.T) {
+	target := newTestSubscriber(func(dtos.Event) {})
+
+	tests := []struct {
+		Name     string
+		Wait     time.Duration
+		Expected time.Duration
+	}{
+		{"Doubles", initialRetryInterval, 2 * time.Second},
+		{"Doubles again", 4 * time.Second, 8 * time.Second},
+		{"Capped at the maximum", 8 * time.Second, 10 * time.Second},
+		{"Stays at the maximum", 10 * time.Second, 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			assert.Equal(t, test.Expected, target.backoff(test.Wait))
+		})
+	}
+
+	// The maximum follows configuration updates
+	updated := testMqttConfig()
+	updated.MaxReconnectSeconds = 3
+	require.NoError(t, target.UpdateConfig(updated))
+	assert.Equal(t, 3*time.Second, target.backoff(2*time.Second))
+}
+
+func TestSubscriber_StaleCallbacks(t *testing.T) {
+	target := newTestSubscriber(func(dtos.Event) {})
+	client := newFakeClient()
+
+	// The connection has been restarted since generation 1 connected
+	target.generation = 2
+	target.onConnect(1, client)
+	target.onConnectionLost(1, errors.New("EOF"))
+	assert.False(t, target.failed(1, errors.New("connection refused")))
+
+	status := target.Status()
+	assert.Equal(t, StateConnecting, status.State, "callbacks of an earlier connection are ignored")
+	assert.Empty(t, status.LastError)
+	assert.Zero(t, status.ConnectionsLost)
+	assert.Empty(t, client.subscribed, "an earlier connection does not subscribe")
+
+	assert.True(t, target.failed(2, errors.New("connection refused")))
+	assert.Equal(t, "connection refused", target.Status().LastError)
+
+	// A connection superseded while connecting is abandoned
+	assert.ErrorIs(t, target.tryConnect(1), errSuperseded)
+}
+
+func TestSubscriber_Status(t *testing.T) {
+	target := newTestSubscriber(func(dtos.Event) {})
+	connected := target.Metrics()[MqttConnectedName].(interface{ Value() int64 })
+	client := newFakeClient()
+	generation := target.generation
+
+	status := target.Status()
+	assert.Equal(t, StateConnecting, status.State)
+	assert.Equal(t, "tcp://edgex-mqtt-broker:1883", status.BrokerAddress)
+	assert.Equal(t, "high-glucose/#", status.Topics)
+
+	// Not connected until subscribed
+	client.subscribeErr = errors.New("not authorized")
+	client.open = false
+	target.onConnect(generation, client)
+	status = target.Status()
+	assert.Equal(t, StateConnecting, status.State)
+	assert.Equal(t, "unable to subscribe to high-glucose/#: not authorized", status.LastError)
+	assert.Zero(t, connected.Value())
+
+	client.subscribeErr = nil
+	client.open = true
+	target.onConnect(generation, client)
+	status = target.Status()
+	assert.Equal(t, StateConnected, status.State)
+	assert.Empty(t, status.LastError)
+	assert.Equal(t, int64(1), connected.Value())
+	assert.Equal(t, map[string]byte{"high-glucose/#": 1}, client.subscribed[len(client.subscribed)-1])
+	since := status.Since
+
+	target.onConnectionLost(generation, errors.New("EOF"))
+	status = target.Status()
+	assert.Equal(t, StateReconnecting, status.State)
+	assert.Equal(t, "EOF", status.LastError)
+	assert.Equal(t, int64(1), status.ConnectionsLost)
+	assert.False(t, status.Since.Before(since))
+	assert.Zero(t, connected.Value())
+
+	// Resubscribed on reconnecting
+	target.onConnect(generation, client)
+	status = target.Status()
+	assert.Equal(t, StateConnected, status.State)
+	assert.Empty(t, status.LastError)
+	assert.Equal(t, int64(1), status.ConnectionsLost)
+	assert.Len(t, client.subscribed, 3)
+
+	target.Stop()
+	status = target.Status()
+	assert.Equal(t, StateStopped, status.State)
+	assert.Zero(t, connected.Value())
+
+	// Nothing changes the state once stopped
+	target.onConnectionLost(generation, errors.New("EOF"))
+	assert.Equal(t, StateStopped, target.Status().State)
+}
+
+func TestSubscriber_Handle_Queued(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var processed []dtos.Event
+	target := newTestSubscriber(func(event dtos.Event) {
+		if len(processed) == 0 {
+			close(started)
+			<-release
+		}
+		processed = append(processed, event)
+	})
+	client := newFakeClient()
+	message := func(sequence int) fakeMessage {
+		payload := fmt.Sprintf(`{"version": 1, "device": "monitor-1", "patientId": "alice", "value": 130, "units": "mg/dL", "timestamp": "2024-05-01T10:15:00Z", "sequence": %d}`,
+			sequence)
+		return fakeMessage{topic: "high-glucose/alice", payload: payload}
+	}
+
+	// The first message holds up the worker, the callback does not wait on it
+	target.handle(client, message(0))
+	<-started
+	for sequence := 1; sequence <= messageQueueSize; sequence++ {
+		target.handle(client, message(sequence))
+	}
+	target.handle(client, message(messageQueueSize+1))
+
+	deadLetters := client.publishedTo("high-glucose/dead-letter")
+	require.Len(t, deadLetters, 1, "a message finding the queue full is rejected")
+	var deadLetter DeadLetter
+	require.NoError(t, json.Unmarshal([]byte(deadLetters[0]), &deadLetter))
+	assert.Equal(t, "100 glucose messages are already waiting to be handled", deadLetter.Reason)
+
+	// Stop waits for the queued messages to be handled
+	close(release)
+	target.Stop()
+	assert.Len(t, processed, messageQueueSize+1)
+	assert.Len(t, client.publishedTo("high-glucose/dead-letter"), 1)
+}
+
+func TestSubscriber_NotLockedWhileWaiting(t *testing.T) {
+	t.Run("Resubscribing", func(t *testing.T) {
+		target := newTestSubscriber(func(dtos.Event) {})
+		client := blockingClient{fakeClient: newFakeClient(), unsubscribing: make(chan struct{}), release: make(chan struct{})}
+		target.started = true
+		target.client = client
+
+		updated := testMqttConfig()
+		updated.Topics = "glucose/#"
+		result := make(chan error)
+		go func() { result <- target.UpdateConfig(updated) }()
+		<-client.unsubscribing
+
+		// Neither the status nor the client's message callback waits on the broker
+		assert.Equal(t, "glucose/#", target.Status().Topics)
+		target.handle(client, fakeMessage{topic: "glucose/alice", payload: `{"version": 1}`})
+
+		close(client.release)
+		require.NoError(t, <-result)
+		assert.Equal(t, []map[string]byte{{"glucose/#": 1}}, client.subscribed)
+		target.Stop()
+	})
+
+	t.Run("Credentials", func(t *testing.T) {
+		looking := make(chan struct{})
+		release := make(chan struct{})
+		secrets := &mocks.SecretProvider{}
+		secrets.On("GetSecret", "mqtt").Run(func(mock.Arguments) {
+			close(looking)
+			<-release
+		}).Return(map[string]string{}, nil)
+		mqttConfig := testMqttConfig()
+		mqttConfig.AuthMode, mqttConfig.SecretName = config.MqttAuthUsernamePassword, "mqtt"
+		target := NewSubscriber(mqttConfig, secrets, functions.NewPatients(config.AppCustomConfig{}), func(dtos.Event) {})
+
+		result := make(chan error)
+		go func() { result <- target.tryConnect(target.generation) }()
+		<-looking
+
+		// The secret store is not waited on under the lock
+		assert.Equal(t, StateConnecting, target.Status().State)
+
+		close(release)
+		require.Error(t, <-result)
+		target.Stop()
+	})
+}
+
+func TestSubscriber_Start_Cancelled(t *testing.T) {
+	target := newTestSubscriber(func(dtos.Event) {})
+	generation := target.generation
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The service is already shutting down, there is nothing to connect for
+	target.Start(ctx)
+	assert.False(t, target.started)
+	assert.Equal(t, generation, target.generation, "no connection is attempted")
+
+	target.Stop()
+	assert.Equal(t, StateStopped, target.Status().State)
+}